@@ -1,15 +1,21 @@
 package calculatedfields
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"regexp"
+	"slices"
 	"strings"
-	"github.com/expr-lang/expr"
+	"time"
+
 	"github.com/expr-lang/expr/file"
+	"github.com/expr-lang/expr/vm"
 	"github.com/ganigeorgiev/fexpr"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tools/types"
@@ -20,16 +26,38 @@ func BindCalculatedFieldsHooks(app core.App) error {
 	app.OnCollectionValidate().BindFunc(CalculatedFieldsOwnersSchemaGuards)
 	app.OnRecordViewRequest("calculated_fields").BindFunc(CalculatedFieldsViewRequestGuard)
 	app.OnRecordsListRequest("calculated_fields").BindFunc(CalculatedFieldsListRequestGuard) // o l’equivalente nella tua versione
+	app.OnRecordEnrich("calculated_fields").BindFunc(OnCalculatedFieldsEnrich)
 
 	app.OnRecordCreate().BindFunc(OnOwnerCreate_AutoCreateCalculatedFields)
+	app.OnRecordUpdate().BindFunc(OnOwnerUpdate_RecalculateCalculatedFields)
 	app.OnRecordDelete().BindFunc(OnOwnerDelete_AutoDeleteCalculatedFields)
 
+	// SUMWHERE/COUNTWHERE/AVGWHERE: ogni modifica della collection aggregata ricalcola i CF
+	app.OnRecordCreate().BindFunc(OnRecordChange_RecalculateCollectionAggregates)
+	app.OnRecordUpdate().BindFunc(OnRecordChange_RecalculateCollectionAggregates)
+	app.OnRecordDelete().BindFunc(OnRecordChange_RecalculateCollectionAggregates)
+
+	// prev.<field>: riordino e cancellazione di righe owner ricollegano la riga precedente
+	app.OnRecordUpdate().BindFunc(OnOwnerChange_RelinkPreviousRows)
+	app.OnRecordDelete().BindFunc(OnOwnerChange_RelinkPreviousRows)
+
 	app.OnRecordCreate("calculated_fields").BindFunc(OnCalculatedFieldsCreateUpdate)
 	// user può fare update sul record solo se può fare update sull'owner
 	app.OnRecordUpdateRequest("calculated_fields").BindFunc(CalculatedFieldsUpdateRequestGuard)
 	app.OnRecordUpdate("calculated_fields").BindFunc(OnCalculatedFieldsCreateUpdate)
 	app.OnRecordDelete("calculated_fields").BindFunc(OnCalculatedFieldsDelete)
-	return nil
+
+	// indice in memoria del grafo delle dipendenze
+	bindGraphIndex(app)
+
+	// route HTTP (batch, ...)
+	bindRoutes(app)
+
+	// Config.AsyncMode: worker che svuota la coda dei ricalcoli
+	bindRecalculationWorker(app)
+
+	// NOW/TODAY e funzioni custom volatili: ricalcolo periodico
+	return bindVolatileCron(app)
 }
 
 func OnCalculatedFieldsCreateUpdate(e *core.RecordEvent) error {
@@ -37,17 +65,27 @@ func OnCalculatedFieldsCreateUpdate(e *core.RecordEvent) error {
 	originalApp := e.App
 	txErr := originalApp.RunInTransaction(func(txApp core.App) error {
 		e.App = txApp
+		if err := validateAlias(txApp, e.Record); err != nil {
+			return err
+		}
+
+		isNew := e.Record.IsNew()
+
 		//salviamo prima il nuovo record e poi calcoliamo le formule in una transaction
 		//se fallisce fa il rollback di tutto
 		if err := e.Next(); err != nil {
 			return err
 		}
+		indexDependsOn(txApp, e.Record)
 
 		orig := e.Record.Original()
-		origFormula := orig.GetString("formula")
-		newFormula := e.Record.GetString("formula")
 
-		if newFormula == origFormula {
+		// rinomina dell'alias: aggiorna il testo delle formule che lo usano
+		if err := renameAliasInDependents(txApp, e.Record, orig.GetString("alias"), e.Record.GetString("alias")); err != nil {
+			return err
+		}
+
+		if !needsRecalculation(orig, e.Record) {
 			// niente ricalcolo, niente touch owner
 			return nil
 		}
@@ -66,7 +104,14 @@ func OnCalculatedFieldsCreateUpdate(e *core.RecordEvent) error {
 		var err error
 		var init_env map[string]any
 		if init_env, err = ResolveDepsAndTxSave(txApp, e.Record); err == nil {
-			err = evaluateFormulaGraph(txApp, e.Record, init_env)
+			err = recalculateFormulaChange(txApp, e.Record, init_env)
+		}
+		if err == nil && isNew {
+			// nuova cella di una colonna: entra nei COLUMN che la aggregano
+			// e diventa la riga precedente (prev.<field>) della riga successiva
+			if err = attachToColumnDependents(txApp, e.Record); err == nil {
+				err = relinkPreviousRows(txApp, e.Record.GetString("owner_collection"))
+			}
 		}
 		return err
 	})
@@ -86,13 +131,21 @@ func OnCalculatedFieldsDelete(e *core.RecordEvent) error {
 
 		//transitiveDepQueues := []*core.Record{}
 		visited := map[string]struct{}{}
+		// dipendenti solo tramite COLUMN o prev.<field>: la cella esce dalla colonna, nessun #REF!
+		columnDependents, err := findColumnReaders(txApp, deletedRecord)
+		if err != nil {
+			return err
+		}
 
 		//cicla i nodi direttamente dipendenti, aggiorna i campi e crea transitiveDepQueues
 		for _, direct := range e.Record.ExpandedAll("calculated_fields_via_depends_on") {
 			visited[direct.Id] = struct{}{}
 			formula := direct.GetString("formula")
-			updatedFormula := strings.ReplaceAll(formula, deletedRecord.Id, "#REF!")
-			direct.Set("formula", updatedFormula)
+			updatedFormula := replaceFormulaIdentifier(formula, deletedRecord.Id, "#REF!")
+			updatedFormula = replaceFormulaIdentifier(updatedFormula, deletedRecord.GetString("alias"), "#REF!")
+			if isSibling(deletedRecord, direct) {
+				updatedFormula = replaceFormulaIdentifier(updatedFormula, selfIdentifier+"."+deletedRecord.GetString("owner_field"), "#REF!")
+			}
 
 			// Rimuovi il riferimento dal depends_on
 			newDepends := []string{}
@@ -101,72 +154,162 @@ func OnCalculatedFieldsDelete(e *core.RecordEvent) error {
 					newDepends = append(newDepends, dep)
 				}
 			}
+			if updatedFormula == formula {
+				direct.Set("depends_on", newDepends)
+				if err := saveNodeWithoutHooks(txApp, direct); err != nil {
+					return fmt.Errorf("failed to detach %s from %s: %w", deletedRecord.Id, direct.Id, err)
+				}
+				if !slices.ContainsFunc(columnDependents, func(r *core.Record) bool { return r.Id == direct.Id }) {
+					columnDependents = append(columnDependents, direct)
+				}
+				continue
+			}
+
+			direct.Set("formula", updatedFormula)
+			setErrorSource(txApp, direct, "")
 			if err := applyResultAndSave(txApp, direct, "#REF!", "Reference to deleted node", map[string]any{}, newDepends); err != nil {
 				return err
 			}
-			if err := evaluateFormulaGraph(txApp, direct, map[string]any{}); err != nil {
+			if err := recalculateFormulaChange(txApp, direct, map[string]any{}); err != nil {
 				return err
 			}
 		}
-		return e.Next()
+		if err := e.Next(); err != nil {
+			return err
+		}
+		graphIndexOf(txApp).remove(txApp, deletedRecord.Id)
+		return reevaluateCalculatedFields(txApp, columnDependents)
 	})
 
 	e.App = originalApp
 	return txErr
 }
 
-var formulaReservedRegex = regexp.MustCompile(`(?i)\b(true|false|null|if|else|in)\b|#(NAME\?|REF!|VALUE!|NUM!|DIV/0!|N/A|NULL!)`)
+// recalculateFormulaChange ricalcola il nodo la cui formula è cambiata e i suoi dipendenti:
+// in coda al worker con Config.AsyncMode, nel change set dentro Deferred, altrimenti subito
+func recalculateFormulaChange(txApp core.App, node *core.Record, env map[string]any) error {
+	if GetConfig(txApp).AsyncMode {
+		// modalità asincrona: il ricalcolo del sottografo lo fa il worker
+		return enqueueRecalculation(txApp, node)
+	}
+	if deferRecalculation(txApp, node) {
+		return nil
+	}
+	return evaluateFormulaGraph(txApp, node, env)
+}
+
+// campi che, se modificati, cambiano il risultato del nodo
+var recalculationFields = []string{"formula", "number_mode", "result_type"}
+
+func needsRecalculation(orig, rec *core.Record) bool {
+	for _, name := range recalculationFields {
+		if rec.GetString(name) != orig.GetString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyword expr (in qualsiasi maiuscolo/minuscolo) e codici di errore
+var formulaReservedRegex = regexp.MustCompile(`(?i)\b(true|false|nil|null|if|else|in)\b|#(NAME\?|REF!|VALUE!|NUM!|DIV/0!|N/A|NULL!)`)
+
+// maskReservedWords sostituisce keyword e codici di errore con 0, così non vengono presi per identificatori.
+// Una keyword non minuscola seguita da "(" è invece una chiamata di funzione (IF, ... della libreria standard).
+func maskReservedWords(formula string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range formulaReservedRegex.FindAllStringSubmatchIndex(formula, -1) {
+		word := formula[m[0]:m[1]]
+		if m[2] >= 0 && word != strings.ToLower(word) && strings.HasPrefix(strings.TrimLeft(formula[m[1]:], " \t\r\n"), "(") {
+			continue
+		}
+		b.WriteString(formula[last:m[0]])
+		b.WriteString("0")
+		last = m[1]
+	}
+	b.WriteString(formula[last:])
+	return b.String()
+}
 
 // risolve le dipendenze fa un salvataggio intermedio e restituisce l'env per il calcolo
 func ResolveDepsAndTxSave(app core.App, rec *core.Record) (map[string]any, error) {
+	return resolveDepsAndTxSave(app, rec, true)
+}
+
+// resolveDepsAndTxSave: con checkCycles false il controllo dei cicli è demandato al chiamante
+// (batch: va fatto sul grafo combinato, dopo aver risolto tutte le formule)
+func resolveDepsAndTxSave(app core.App, rec *core.Record, checkCycles bool) (map[string]any, error) {
+	if err := checkFormulaLength(app, rec); err != nil {
+		return nil, err
+	}
+
 	// 1️⃣ Estrazione delle variabili dalla formula
-	formula := formulaReservedRegex.ReplaceAllString(rec.GetString("formula"), "0")
+	formula := maskReservedWords(rec.GetString("formula"))
 	identifiers, err := extractIdentifiersFromFormula(formula)
 	if err != nil {
 		return nil, err
 	}
 
+	// dipendenze da intere collection (SUMWHERE & co.) e funzioni volatili
+	// (sulla formula originale: il parser di expr deve vedere le chiamate di funzione intatte)
+	externalDeps, err := extractCollectionDependencies(app, rec, rec.GetString("formula"))
+	if err != nil {
+		return nil, err
+	}
+	if callsVolatileFunction(rec.GetString("formula")) {
+		externalDeps = append(externalDeps, volatileDep)
+	}
+	if len(prevReferencedFields(rec.GetString("formula"))) > 0 && rec.GetString("owner_collection") != "" {
+		externalDeps = append(externalDeps, prevDepPrefix+rec.GetString("owner_collection"))
+	}
+
+	// COLUMN: il nodo dipende da tutte le celle della colonna tramite external_deps (indice del grafo),
+	// senza elencarle in depends_on; gli id servono solo al controllo dei cicli
+	columns, err := extractColumnReferences(app, rec, rec.GetString("formula"))
+	if err != nil {
+		return nil, err
+	}
+	externalDeps = append(externalDeps, columnExternalDeps(columns)...)
+	columnIds, err := columnMemberIds(app, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasCalculatedFieldsField(app, "external_deps") {
+		rec.Set("external_deps", externalDeps)
+	}
+
 	//se non ci sono identificatori non serve proseguire e si può restituire la mappa vuota
 	if len(identifiers) == 0 {
+		if checkCycles {
+			if err := checkDependencyCycle(app, rec, columnIds); err != nil {
+				return nil, err
+			}
+		}
+		rec.Set("depends_on", []string{})
+		if err := saveNodeWithoutHooks(app, rec); err != nil {
+			return map[string]any{}, fmt.Errorf("failed to save updated record: %w", err)
+		}
 		return map[string]any{}, nil
 	}
 
-	parentIds := make([]string, 0, len(identifiers))
+	alias := rec.GetString("alias")
 	for _, id := range identifiers {
-		if id == rec.Id {
-			return nil, apis.NewBadRequestError(
-				"Formula dependency error: self-reference",
-				validation.Errors{
-					rec.Id: validation.NewError("1002", fmt.Sprintf("Self-reference detected on %s with formula %s", rec.Id, formula)),
-				},
-			)
+		if id == rec.Id || (alias != "" && id == alias) {
+			return nil, selfReferenceError(rec, formula)
 		}
-		parentIds = append(parentIds, id)
 	}
 
-	// 2️⃣ Verifica che i record referenziati esistano
-	env_init_list, err := app.FindRecordsByIds("calculated_fields", parentIds)
+	// 2️⃣ Verifica che i record referenziati esistano (per id o per alias)
+	env_init_list, missing, err := findReferencedRecords(app, rec, identifiers)
 	if err != nil {
 		return nil, apis.NewBadRequestError(
-			fmt.Sprintf("Failed to find referenced records %v", parentIds),
+			fmt.Sprintf("Failed to find referenced records %v", identifiers),
 			validation.Errors{
 				rec.Id: validation.NewError("1005", fmt.Sprintf("Reference in formula %s not found", rec.Id))},
 		)
 	}
-	if len(env_init_list) != len(parentIds) {
-
-		found := make(map[string]bool, len(env_init_list))
-		for _, r := range env_init_list {
-			found[r.Id] = true
-		}
-
-		var missing []string
-		for _, pid := range parentIds {
-			if !found[pid] {
-				missing = append(missing, pid)
-			}
-		}
-
+	if len(missing) > 0 {
 		return nil, apis.NewBadRequestError(
 			fmt.Sprintf("Formula evaluation error: referenced variable not found: %v", missing),
 			validation.Errors{
@@ -178,21 +321,233 @@ func ResolveDepsAndTxSave(app core.App, rec *core.Record) (map[string]any, error
 		)
 	}
 
+	parentIds := make([]string, 0, len(env_init_list))
+	for _, parent := range env_init_list {
+		if parent.Id == rec.Id {
+			return nil, selfReferenceError(rec, formula)
+		}
+		parentIds = append(parentIds, parent.Id)
+	}
+
+	// ciclo di qualsiasi lunghezza (anche attraverso le colonne lette): rifiutato prima di salvare
+	if checkCycles {
+		if err := checkDependencyCycle(app, rec, append(slices.Clone(parentIds), columnIds...)); err != nil {
+			return nil, err
+		}
+	}
+
 	// 3️⃣ Salva le dipendenze aggiornate
 	rec.Set("depends_on", parentIds)
-	if err := app.UnsafeWithoutHooks().Save(rec); err != nil {
+	if err := saveNodeWithoutHooks(app, rec); err != nil {
 		return map[string]any{}, fmt.Errorf("failed to save updated record: %w", err)
 	}
 
 	env_init := map[string]any{}
-	if _, err = populateEnvAndCheckRef(env_init, env_init_list); err != nil {
+	if _, err = populateEnvAndCheckRef(app, env_init, env_init_list); err != nil {
 		return nil, err
 	}
 
 	return env_init, nil
 }
 
+func selfReferenceError(rec *core.Record, formula string) error {
+	return apis.NewBadRequestError(
+		"Formula dependency error: self-reference",
+		validation.Errors{
+			rec.Id: validation.NewError("1002", fmt.Sprintf("Self-reference detected on %s with formula %s", rec.Id, formula)),
+		},
+	)
+}
+
+// findReferencedRecords risolve gli identificatori di una formula in record calculated_fields:
+// self.<owner_field> tramite il triplet owner di rec, gli altri prima per id e poi per alias.
+// owner.<field> non è un nodo: viene solo verificato che il campo esista nella collection owner e sia leggibile.
+// prev.<field> si risolve nel calculated_field della riga precedente (nessun nodo sulla prima riga).
+// Restituisce i record (senza duplicati, nell'ordine degli identificatori) e gli
+// identificatori che non corrispondono a nessun nodo.
+func findReferencedRecords(app core.App, rec *core.Record, identifiers []string) ([]*core.Record, []string, error) {
+	found := make(map[string]*core.Record, len(identifiers))
+	ownerRefs := map[string]struct{}{}
+
+	plain := make([]string, 0, len(identifiers))
+	for _, id := range identifiers {
+		if field, ok := ownerReferenceField(id); ok {
+			exists, err := hasOwnerField(app, rec, field)
+			if err != nil {
+				return nil, nil, err
+			}
+			if exists {
+				ownerRefs[id] = struct{}{}
+			}
+			continue
+		}
+		if field, ok := prevReferenceField(id); ok {
+			if rec.GetString("owner_collection") == "" {
+				continue
+			}
+			col, err := app.FindCachedCollectionByNameOrId(rec.GetString("owner_collection"))
+			if err != nil {
+				return nil, nil, err
+			}
+			if !isCalculatedFieldsRelation(app, col, field) {
+				continue
+			}
+			cell, err := findPreviousCell(app, rec, field)
+			if err != nil {
+				return nil, nil, err
+			}
+			if cell != nil {
+				found[id] = cell
+			} else {
+				ownerRefs[id] = struct{}{}
+			}
+			continue
+		}
+
+		field, ok := selfReferenceField(id)
+		if !ok {
+			plain = append(plain, id)
+			continue
+		}
+		sibling, err := findSiblingRecord(app, rec, field)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sibling != nil {
+			found[id] = sibling
+		}
+	}
+
+	byId, err := app.FindRecordsByIds("calculated_fields", plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, r := range byId {
+		found[r.Id] = r
+	}
+
+	unresolved := make([]any, 0, len(plain))
+	for _, id := range plain {
+		if _, ok := found[id]; !ok {
+			unresolved = append(unresolved, id)
+		}
+	}
+
+	if len(unresolved) > 0 && hasCalculatedFieldsField(app, "alias") {
+		aliased, err := app.FindAllRecords("calculated_fields", dbx.In("alias", unresolved...))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range aliased {
+			found[r.GetString("alias")] = r
+		}
+	}
+
+	records := make([]*core.Record, 0, len(identifiers))
+	seen := make(map[string]struct{}, len(identifiers))
+	var missing []string
+	for _, id := range identifiers {
+		if _, ok := ownerRefs[id]; ok {
+			continue
+		}
+		r, ok := found[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		if _, dup := seen[r.Id]; dup {
+			continue
+		}
+		seen[r.Id] = struct{}{}
+		records = append(records, r)
+	}
+
+	return records, missing, nil
+}
+
+// hasCalculatedFieldsField evita query su colonne (alias, external_deps, ...)
+// se lo schema non è ancora stato aggiornato da EnsureCalculatedFieldsSystemSchema
+func hasCalculatedFieldsField(app core.App, name string) bool {
+	col, err := app.FindCachedCollectionByNameOrId("calculated_fields")
+	return err == nil && col.Fields.GetByName(name) != nil
+}
+
+// buildEvalEnv prepara l'env specifico del nodo: una copia dell'env del grafo
+// più le variabili relative all'owner del nodo (self.<owner_field>, owner.<field>).
+// Le query di aggregati, COLUMN e LOOKUP usano ctx (la scadenza della propagazione).
+func buildEvalEnv(ctx context.Context, app core.App, node *core.Record, env map[string]any) map[string]any {
+	decimal := decimalMode(app, node)
+	evalEnv := make(map[string]any, len(env)+2)
+	for k, v := range env {
+		evalEnv[k] = normalizeNumbers(v, decimal)
+	}
+
+	// genitori in errore: il codice diventa un valore di errore che si propaga (o viene intercettato da IFERROR)
+	inherited := upstreamErrors(node, env)
+	for _, dep := range node.ExpandedAll("depends_on") {
+		if fe, ok := inherited[dep.Id]; ok {
+			evalEnv[dep.Id] = fe
+			if alias := dep.GetString("alias"); alias != "" {
+				evalEnv[alias] = fe
+			}
+		}
+	}
+
+	self := map[string]any{}
+	for _, dep := range node.ExpandedAll("depends_on") {
+		if isSibling(dep, node) {
+			self[dep.GetString("owner_field")] = evalEnv[dep.Id]
+		}
+	}
+	evalEnv[selfIdentifier] = self
+	evalEnv[ownerIdentifier] = normalizeNumbers(buildOwnerEnv(app, node, ownerReferencedFields(node.GetString("formula"))), decimal)
+	evalEnv[prevIdentifier] = buildPrevEnv(app, node, evalEnv)
+	bindAggregateFunctions(ctx, app, node, evalEnv)
+	bindColumnFunction(ctx, app, node, evalEnv)
+	bindLookupFunction(ctx, app, node, evalEnv)
+	bindDateFunctions(app, evalEnv)
+	for name := range aggregateFunctions {
+		evalEnv[name] = errorValueFunction(name, evalEnv[name].(func(args ...any) (any, error)))
+	}
+	for _, name := range []string{columnFunctionName, lookupFunctionName} {
+		evalEnv[name] = errorValueFunction(name, evalEnv[name].(func(args ...any) (any, error)))
+	}
+	for name := range dateFunctions {
+		evalEnv[name] = errorValueFunction(name, evalEnv[name].(func(args ...any) (any, error)))
+	}
+
+	return evalEnv
+}
+
+// setEnvValue rende disponibile il valore di un nodo nell'env sia per id che per alias
+// (i risultati dei nodi decimali, salvati come testo, tornano numeri esatti)
+func setEnvValue(app core.App, env map[string]any, rec *core.Record, value any) {
+	value = envValue(app, rec, value)
+	env[rec.Id] = value
+	if alias := rec.GetString("alias"); alias != "" {
+		env[alias] = value
+	}
+}
+
+// envValue: il valore salvato di rec così come lo vedono le formule
+func envValue(app core.App, rec *core.Record, value any) any {
+	if decimalMode(app, rec) && isNumericResultType(rec.GetString("result_type")) {
+		return decimalEnvValue(value)
+	}
+	return value
+}
+
 func applyResultAndSave(txApp core.App, node *core.Record, value any, errMsg string, env map[string]any, newDepends []string) error {
+	if err := saveResult(txApp, node, value, errMsg, env, newDepends); err != nil {
+		return err
+	}
+	touched := ownerTouches{}
+	touched.add(node)
+	return touched.apply(txApp)
+}
+
+// saveResult salva valore ed errore del nodo (senza hook) e lo rende disponibile nell'env
+func saveResult(txApp core.App, node *core.Record, value any, errMsg string, env map[string]any, newDepends []string) error {
 	b, err := json.Marshal(value)
 	if err != nil {
 		return apis.NewBadRequestError("Failed to serialize calculated value", validation.Errors{
@@ -204,47 +559,69 @@ func applyResultAndSave(txApp core.App, node *core.Record, value any, errMsg str
 
 	node.Set("value", jsonValue)
 	node.Set("error", errMsg)
+	setErrorCode(txApp, node, errorCodeOf(value, errMsg))
+	if hasCalculatedFieldsField(txApp, "calc_status") {
+		node.Set("calc_status", calcStatusOf(errMsg))
+	}
 	if newDepends != nil {
 		node.Set("depends_on", newDepends)
 	}
-	env[node.Id] = value
+	setEnvValue(txApp, env, node, value)
 
-	if err := txApp.UnsafeWithoutHooks().Save(node); err != nil {
+	if err := saveNodeWithoutHooks(txApp, node); err != nil {
 		return fmt.Errorf("errore salvataggio queue %s: %v", node.Id, err)
 	}
-	//---UPDATE OWNER UPDATED FIELD IF PRESENT
-	// --- TOUCH OWNER.updated (deterministic, strict)
+	return nil
+}
+
+// ownerTouches raccoglie le righe owner (collection -> row -> nodo) da toccare una volta sola
+type ownerTouches map[string]map[string]*core.Record
+
+func (t ownerTouches) add(node *core.Record) {
 	ownerCol := node.GetString("owner_collection")
 	ownerRow := node.GetString("owner_row")
-
 	// se non c'è owner, non tocchiamo nulla (ma puoi decidere di renderlo errore)
 	if ownerCol == "" || ownerRow == "" {
-		return nil
+		return
 	}
-
-	ownerRec, err := txApp.FindRecordById(ownerCol, ownerRow)
-	if err != nil {
-		return apis.NewBadRequestError("owner record not found", validation.Errors{
-			node.Id: validation.NewError("1008",
-				fmt.Sprintf("Invalid owner reference: record %s/%s not found.", ownerCol, ownerRow)),
-		})
+	if t[ownerCol] == nil {
+		t[ownerCol] = map[string]*core.Record{}
 	}
+	if _, ok := t[ownerCol][ownerRow]; !ok {
+		t[ownerCol][ownerRow] = node
+	}
+}
 
-	// Aggiornamento deterministico
-	ownerRec.Set("updated", types.NowDateTime())
+//---UPDATE OWNER UPDATED FIELD IF PRESENT
+// --- TOUCH OWNER.updated (deterministic, strict)
+func (t ownerTouches) apply(txApp core.App) error {
+	for _, ownerCol := range sortedKeys(t) {
+		for _, ownerRow := range sortedKeys(t[ownerCol]) {
+			node := t[ownerCol][ownerRow]
+			ownerRec, err := txApp.FindRecordById(ownerCol, ownerRow)
+			if err != nil {
+				return apis.NewBadRequestError("owner record not found", validation.Errors{
+					node.Id: validation.NewError("1008",
+						fmt.Sprintf("Invalid owner reference: record %s/%s not found.", ownerCol, ownerRow)),
+				})
+			}
 
-	if err := txApp.Save(ownerRec); err != nil {
-		return apis.NewBadRequestError("Failed to update owner 'updated' field", validation.Errors{
-			node.Id: validation.NewError("1008",
-				fmt.Sprintf("Failed to touch owner %s/%s.updated: %v", ownerCol, ownerRow, err)),
-		})
-	}
+			// Aggiornamento deterministico
+			ownerRec.Set("updated", types.NowDateTime())
 
+			if err := txApp.Save(ownerRec); err != nil {
+				return apis.NewBadRequestError("Failed to update owner 'updated' field", validation.Errors{
+					node.Id: validation.NewError("1008",
+						fmt.Sprintf("Failed to touch owner %s/%s.updated: %v", ownerCol, ownerRow, err)),
+				})
+			}
+		}
+	}
 	return nil
 }
 
 func extractIdentifiersFromFormula(formula string) ([]string, error) {
-	formula = formulaReservedRegex.ReplaceAllString(formula, "0")
+	formula = maskReservedWords(formula)
 	scanner := fexpr.NewScanner([]byte(formula))
 	identifiersMap := map[string]struct{}{}
 	tokens := []fexpr.Token{}
@@ -256,7 +633,14 @@ func extractIdentifiersFromFormula(formula string) ([]string, error) {
 	for i := 0; i < len(tokens); i++ {
 		t := tokens[i]
 		if t.Type == fexpr.TokenIdentifier {
-			id := strings.SplitN(t.Literal, ".", 2)[0]
+			parts := strings.SplitN(t.Literal, ".", 3)
+			id := parts[0]
+			// self.<owner_field> è un riferimento al calculated_field fratello, non un id
+			// owner.<field> è un campo normale della riga owner
+			// prev.<owner_field> è il calculated_field della riga precedente
+			if (id == selfIdentifier || id == ownerIdentifier || id == prevIdentifier) && len(parts) > 1 {
+				id = parts[0] + "." + parts[1]
+			}
 			identifiersMap[id] = struct{}{}
 		}
 		if nested, ok := t.Meta.([]fexpr.Token); ok {
@@ -272,13 +656,17 @@ func extractIdentifiersFromFormula(formula string) ([]string, error) {
 	return result, nil
 }
 
+// evaluateFormulaGraph ricalcola node e, se il valore cambia, tutto il sottografo dei dipendenti:
+// prima raccoglie i nodi coinvolti, poi li valuta una sola volta ciascuno in ordine topologico
+// (ogni nodo vede i genitori già aggiornati) e alla fine tocca una sola volta ogni owner modificato.
 func evaluateFormulaGraph(txApp core.App, node *core.Record, env map[string]any) error {
 	//make sure the rec is expanded
 	if err := expandFormulaDependencies(txApp, node); err != nil {
 		return err
 	}
+	deadline := propagationDeadline(txApp)
 	//calcola il nodo imputato
-	rootResult, rootErrMsg, rootEvalErr := evalFormula(txApp, node, env)
+	rootResult, rootErrMsg, rootEvalErr := evalFormula(txApp, node, env, deadline)
 	if rootEvalErr != nil {
 		return rootEvalErr
 	}
@@ -286,32 +674,62 @@ func evaluateFormulaGraph(txApp core.App, node *core.Record, env map[string]any)
 	if !isDirty(node, rootResult, rootErrMsg) {
 		return nil
 	}
-	if err := applyResultAndSave(txApp, node, rootResult, rootErrMsg, env, nil); err != nil {
+	touched := ownerTouches{}
+	if err := saveResult(txApp, node, rootResult, rootErrMsg, env, nil); err != nil {
 		return err
 	}
-	// ---------
-	children := node.ExpandedAll("calculated_fields_via_depends_on")
-	//------------
-	for i := 0; i < len(children); i++ {
-		child := children[i]
-		if child.Id == node.Id {
-			return apis.NewBadRequestError(
-				fmt.Sprintf("Formula dependency error: circular reference found (%s → %s)", child.Id, node.Id),
-				validation.Errors{
-					child.Id: validation.NewError("1003", fmt.Sprintf("Detected circular dependency between %s and %s", child.Id, node.Id)),
-				},
-			)
-		}
+	touched.add(node)
 
-		if err := expandFormulaDependencies(txApp, child); err != nil {
+	order, err := affectedSubgraph(txApp, []*core.Record{node}, false)
+	if err != nil {
+		return err
+	}
+	if err := evaluateInOrderUntil(txApp, order, env, touched, deadline); err != nil {
+		return err
+	}
+	return touched.apply(txApp)
+}
+
+// evaluateInOrder valuta i nodi nell'ordine dato (topologico), una volta ciascuno,
+// salvando quelli il cui risultato cambia e registrando gli owner da toccare
+func evaluateInOrder(txApp core.App, order []*core.Record, env map[string]any, touched ownerTouches) error {
+	return evaluateInOrderUntil(txApp, order, env, touched, propagationDeadline(txApp))
+}
+
+// evaluateInOrderUntil è evaluateInOrder con una scadenza esplicita (zero = nessun timeout, es. RepairGraph)
+func evaluateInOrderUntil(txApp core.App, order []*core.Record, env map[string]any, touched ownerTouches, deadline time.Time) error {
+	// genitori: i nodi del sottografo sono le istanze in ordine (con i valori appena salvati),
+	// gli altri vengono caricati tutti insieme con una sola query
+	pool := make(map[string]*core.Record, len(order))
+	parentIds := []string{}
+	for _, n := range order {
+		pool[n.Id] = n
+		parentIds = append(parentIds, n.GetStringSlice("depends_on")...)
+	}
+	if err := findNodesByIds(txApp, pool, parentIds); err != nil {
+		return err
+	}
+
+	for _, child := range order {
+		if err := checkDeadline(txApp, deadline, child.Id); err != nil {
 			return err
 		}
+		// copie senza espansioni: l'albero dei dipendenti resta aciclico (anche nel JSON della risposta)
+		parents := []*core.Record{}
+		for _, id := range child.GetStringSlice("depends_on") {
+			if p, ok := pool[id]; ok {
+				parents = append(parents, p.Fresh())
+			}
+		}
+		expand := child.Expand()
+		expand["depends_on"] = parents
+		child.SetExpand(expand)
 		//espando i dipendenti
 		dependOnRecords := child.ExpandedAll("depends_on")
 		var childResult any
 		var childEvalError string
 		var childErr error
-		hasRefErrVal, err := populateEnvAndCheckRef(env, dependOnRecords)
+		hasRefErrVal, err := populateEnvAndCheckRef(txApp, env, dependOnRecords)
 		if err != nil {
 			return err
 		}
@@ -319,34 +737,186 @@ func evaluateFormulaGraph(txApp core.App, node *core.Record, env map[string]any)
 		if hasRefErrVal {
 			childResult = "#REF!"
 			childEvalError = "Reference to deleted node"
+			setErrorSource(txApp, child, "")
 		} else {
-			if childResult, childEvalError, childErr = evalFormula(txApp, child, env); childErr != nil {
+			if childResult, childEvalError, childErr = evalFormula(txApp, child, env, deadline); childErr != nil {
 				return childErr
 			}
 		}
 
 		if isDirty(child, childResult, childEvalError) {
-			if err := applyResultAndSave(txApp, child, childResult, childEvalError, env, nil); err != nil {
+			if err := saveResult(txApp, child, childResult, childEvalError, env, nil); err != nil {
 				return err
 			}
+			touched.add(child)
 		}
+	}
+	return nil
+}
 
-		// 🔹 3️⃣ Espansione BFS verso i figli
-		grandChildren := child.ExpandedAll("calculated_fields_via_depends_on")
-		for _, grandChild := range grandChildren {
+// affectedSubgraph restituisce i dipendenti (diretti e transitivi) dei nodi roots in ordine topologico,
+// compresi i roots stessi se includeRoots (ricalcolo di più nodi insieme, es. batch).
+// Un ciclo che passa da un root (se escluso) o tra i dipendenti viene segnalato con 1003.
+func affectedSubgraph(txApp core.App, roots []*core.Record, includeRoots bool) ([]*core.Record, error) {
+	index := graphIndexOf(txApp)
+	limits := getPropagationLimits(txApp)
+	rootIds := make(map[string]struct{}, len(roots))
 
-			children = append(children, grandChild)
+	// istanze già in memoria (radici e dipendenti espansi, es. nella risposta dell'hook): riusate
+	pool := map[string]*core.Record{}
+	for _, root := range roots {
+		pool[root.Id] = root
+		for _, child := range root.ExpandedAll("calculated_fields_via_depends_on") {
+			pool[child.Id] = child
 		}
 	}
-	return nil
+
+	// 1️⃣ raccolta del sottografo (BFS con visited) sull'indice in memoria, senza query per nodo
+	inGraph := map[string]struct{}{}
+	discovered := []string{}
+	queue := []string{}
+	for _, root := range roots {
+		rootIds[root.Id] = struct{}{}
+		if includeRoots {
+			inGraph[root.Id] = struct{}{}
+			discovered = append(discovered, root.Id)
+		}
+		queue = append(queue, index.childrenOf(txApp, root.Id)...)
+	}
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = queue[1:]
+		if _, isRoot := rootIds[child]; isRoot && !includeRoots {
+			return nil, apis.NewBadRequestError(
+				fmt.Sprintf("Formula dependency error: circular reference found (%s → %s)", child, roots[0].Id),
+				validation.Errors{
+					child: validation.NewError("1003", fmt.Sprintf("Detected circular dependency between %s and %s", child, roots[0].Id)),
+				},
+			)
+		}
+		if _, seen := inGraph[child]; seen {
+			continue
+		}
+		inGraph[child] = struct{}{}
+		discovered = append(discovered, child)
+		if err := limits.checkNodes(roots[0].Id, len(inGraph)); err != nil {
+			return nil, err
+		}
+		queue = append(queue, index.childrenOf(txApp, child)...)
+	}
+
+	// una sola query per i nodi non ancora in memoria (quelli non più esistenti vengono saltati)
+	if err := findNodesByIds(txApp, pool, discovered); err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]*core.Record, len(discovered))
+	present := make([]*core.Record, 0, len(discovered))
+	for _, id := range discovered {
+		if n, ok := pool[id]; ok {
+			nodes[id] = n
+			present = append(present, n)
+		}
+	}
+	// espansione dei dipendenti in memoria, come farebbe ExpandRecord (l'albero resta nella risposta)
+	for _, n := range present {
+		children := []*core.Record{}
+		for _, childId := range index.childrenOf(txApp, n.Id) {
+			if child, ok := nodes[childId]; ok {
+				children = append(children, child)
+			}
+		}
+		expand := n.Expand()
+		expand["calculated_fields_via_depends_on"] = children
+		n.SetExpand(expand)
+	}
+
+	// 2️⃣ ordinamento topologico (Kahn) sugli archi interni al sottografo (colonne lette comprese)
+	pending := make(map[string]int, len(nodes))
+	for _, n := range present {
+		for _, dep := range index.parentsOf(txApp, n.Id) {
+			if _, ok := nodes[dep]; ok {
+				pending[n.Id]++
+			}
+		}
+	}
+
+	order := make([]*core.Record, 0, len(present))
+	ready := []*core.Record{}
+	// profondità: livelli di dipendenti sotto le radici (le radici escluse valgono 0)
+	depth := make(map[string]int, len(nodes))
+	for _, n := range present {
+		if pending[n.Id] == 0 {
+			ready = append(ready, n)
+			if !includeRoots {
+				depth[n.Id] = 1
+			}
+		}
+	}
+	for len(ready) > 0 {
+		n := ready[0]
+		ready = ready[1:]
+		order = append(order, n)
+		if err := limits.checkDepth(n.Id, depth[n.Id]); err != nil {
+			return nil, err
+		}
+		for _, childId := range index.childrenOf(txApp, n.Id) {
+			if _, ok := nodes[childId]; !ok {
+				continue
+			}
+			depth[childId] = max(depth[childId], depth[n.Id]+1)
+			pending[childId]--
+			if pending[childId] == 0 {
+				ready = append(ready, nodes[childId])
+			}
+		}
+	}
+
+	if len(order) < len(present) {
+		cyclic := []string{}
+		for _, n := range present {
+			if pending[n.Id] > 0 {
+				cyclic = append(cyclic, n.Id)
+			}
+		}
+		return nil, apis.NewBadRequestError(
+			fmt.Sprintf("Formula dependency error: circular reference found (%s)", strings.Join(cyclic, ", ")),
+			validation.Errors{
+				cyclic[0]: validation.NewError("1003", fmt.Sprintf("Detected circular dependency among %s", strings.Join(cyclic, ", "))),
+			},
+		)
+	}
+	return order, nil
 }
-func populateEnvAndCheckRef(env map[string]any, records []*core.Record) (hasRef bool, err error) {
+
+// reevaluateCalculatedFields ricalcola i nodi indicati (con i valori attuali delle dipendenze)
+// e propaga ai dipendenti: usato dai trigger esterni (owner, collection aggregate, volatili).
+// Un solo ricalcolo topologico sull'unione dei sottografi: un dipendente comune è valutato una volta.
+func reevaluateCalculatedFields(txApp core.App, cfs []*core.Record) error {
+	if len(cfs) == 0 {
+		return nil
+	}
+	if deferRecalculation(txApp, cfs...) {
+		// dentro Deferred: ricalcolo unico prima del commit
+		return nil
+	}
+	order, err := affectedSubgraph(txApp, cfs, true)
+	if err != nil {
+		return err
+	}
+	touched := ownerTouches{}
+	if err := evaluateInOrder(txApp, order, map[string]any{}, touched); err != nil {
+		return err
+	}
+	return touched.apply(txApp)
+}
+
+func populateEnvAndCheckRef(app core.App, env map[string]any, records []*core.Record) (hasRef bool, err error) {
 	for _, rec := range records {
 		var v any
 		if err = json.Unmarshal([]byte(rec.GetString("value")), &v); err != nil {
 			return false, fmt.Errorf("invalid JSON in value of %s: %v", rec.Id, err)
 		}
-		env[rec.Id] = v
+		setEnvValue(app, env, rec, v)
 		if s, ok := v.(string); ok && s == "#REF!" {
 			return true, nil
 		}
@@ -354,36 +924,78 @@ func populateEnvAndCheckRef(env map[string]any, records []*core.Record) (hasRef
 	return false, nil
 }
 
-func evalFormula(txApp core.App, node *core.Record, env map[string]any) (any, string, error) {
+// compileNodeFormula compila la formula del nodo nella sua modalità numerica (1004 se non è valida)
+func compileNodeFormula(app core.App, node *core.Record) (*vm.Program, error) {
+	program, err := compileFormula(node.GetString("formula"), decimalMode(app, node), GetConfig(app).MaxFormulaNodes)
+	if err != nil {
+		if isNodeBudgetError(err) {
+			return nil, limitExceededError(node.Id, "Formula has more than %d syntax nodes", GetConfig(app).MaxFormulaNodes)
+		}
+		return nil, apis.NewBadRequestError(
+			fmt.Sprintf("Syntax error in formula %s", node.Id),
+			validation.Errors{
+				node.Id: validation.NewError("1004", fmt.Sprintf("Syntax error in formula: %v", err))})
+	}
+	return program, nil
+}
+
+// evalFormula valuta la formula del nodo entro deadline (zero = nessun timeout)
+func evalFormula(txApp core.App, node *core.Record, env map[string]any, deadline time.Time) (any, string, error) {
 	formula := node.GetString("formula")
+	setErrorSource(txApp, node, "")
 
 	if strings.Contains(formula, "#REF!") {
 		return "#REF!", "Formula contains reference to missing node (#REF!)", nil
 	}
-	//compila in modo da evidenziare errori di sintassi
-	program, err := expr.Compile(node.GetString("formula"))
+	// funzione non registrata (né builtin expr, né libreria standard, né custom)
+	if name, unknown := unknownFunction(formula); unknown {
+		return "#NAME?", fmt.Sprintf("Unknown or undefined function: %s", name), nil
+	}
+	decimal := decimalMode(txApp, node)
+	//compila in modo da evidenziare errori di sintassi (o riusa il programma in cache)
+	program, err := compileNodeFormula(txApp, node)
 	if err != nil {
-		return "", "", apis.NewBadRequestError(
-			fmt.Sprintf("Syntax error in formula %s", node.Id),
-			validation.Errors{
-				node.Id: validation.NewError("1004", fmt.Sprintf("Syntax error in formula: %v", err))})
+		return "", "", err
 	}
 	// 🔹 Esegui la formula
-	result, err := expr.Run(program, env)
+	ctx, cancel := deadlineContext(deadline)
+	defer cancel()
+	result, err := runProgram(txApp, program, buildEvalEnv(ctx, txApp, node, env), deadline)
 	if err != nil {
+		// timer della VM o query annullata dalla scadenza
+		if deadlineErr := checkDeadline(txApp, deadline, node.Id); deadlineErr != nil {
+			return "", "", deadlineErr
+		}
+		if isMemoryBudgetError(err) {
+			return "", "", limitExceededError(node.Id, "Evaluation exceeded the memory budget of %d", GetConfig(txApp).MaxMemoryBudget)
+		}
 		return translateFormulaError(txApp, node, err)
 	}
+	// errore come valore: operando o argomento in errore, proprio o ereditato da un genitore
+	if fe := findErrorValue(result); fe != nil {
+		setErrorSource(txApp, node, fe.Source)
+		return fe.Code, fe.Message, nil
+	}
 	//gestire il risultato infinito ad esempio divisione per zero
 	if f, ok := result.(float64); ok {
 		// Divisione per zero → #DIV/0!
 		if math.IsInf(f, 0) {
-			return "#DIV/0!", "Divisione per zero o risultato infinito", nil
+			return "#DIV/0!", "Division by zero or infinite result", nil
 		}
 		// Risultato numerico non valido → #NUM!
 		if math.IsNaN(f) {
-			return "#NUM!", "Risultato numerico non valido (NaN)", nil
+			return "#NUM!", "Invalid numeric result (NaN)", nil
 		}
 	}
+	cfg := GetConfig(txApp)
+	resultType := node.GetString("result_type")
+	result, coerceErr := coerceResult(resultType, result, decimal, cfg.location())
+	if coerceErr != "" {
+		return result, coerceErr, nil
+	}
+	if decimal && isNumericResultType(resultType) {
+		return decimalResult(result, cfg.DecimalScale, cfg.DecimalRounding), "", nil
+	}
 	return result, "", nil
 }
 
@@ -401,6 +1013,13 @@ func evalFormula(txApp core.App, node *core.Record, env map[string]any) (any, st
 ╚════════════╩══════════════════════════════════════════╝
 */
 func translateFormulaError(txApp core.App, node *core.Record, err error) (any, string, error) {
+	// errori "da foglio di calcolo" restituiti dalle funzioni (libreria standard, aggregati)
+	var formulaErr *FormulaError
+	if errors.As(err, &formulaErr) {
+		setErrorSource(txApp, node, formulaErr.Source)
+		return formulaErr.Code, formulaErr.Message, nil
+	}
+
 	ferr, ok := err.(*file.Error)
 	if !ok {
 		return "", "", apis.NewBadRequestError(
@@ -411,16 +1030,16 @@ func translateFormulaError(txApp core.App, node *core.Record, err error) (any, s
 
 	switch {
 	case strings.Contains(ferr.Message, "invalid operation: cannot call nil"):
-		return "#NAME?", "Funzione non riconosciuta o non definita", nil
+		return "#NAME?", "Unknown or undefined function", nil
 
 	case strings.Contains(ferr.Message, "invalid operation") && strings.Contains(ferr.Message, "<nil>"):
 		if _, dep_err := ResolveDepsAndTxSave(txApp, node); dep_err != nil {
 			return "", "", dep_err
 		}
-		return "#N/A", "Valore non disponibile (null) in operazione", nil
+		return "#N/A", "Value not available (null) in operation", nil
 
 	case strings.Contains(ferr.Message, "invalid operation"):
-		return "#VALUE!", "Tipo non compatibile nell'operazione", nil
+		return "#VALUE!", "Incompatible type in operation", nil
 
 	default:
 		return "#VALUE!", ferr.Message, nil
@@ -442,5 +1061,6 @@ func isDirty(node *core.Record, value any, errMsg string) bool {
 		return true
 	}
 	return string(b) != node.Original().GetString("value") ||
-		errMsg != node.Original().GetString("error")
+		errMsg != node.Original().GetString("error") ||
+		node.GetString("error_source") != node.Original().GetString("error_source")
 }
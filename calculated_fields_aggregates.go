@@ -0,0 +1,443 @@
+package calculatedfields
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/search"
+)
+
+// collectionDepPrefix marca in external_deps le dipendenze da un'intera collection
+// (es. "collection:orders" per SUMWHERE("orders", ...)).
+const collectionDepPrefix = "collection:"
+
+// funzioni di aggregazione su collection: nome -> numero di argomenti
+var aggregateFunctions = map[string]int{
+	"SUMWHERE":   3, // SUMWHERE(collection, filter, field)
+	"COUNTWHERE": 2, // COUNTWHERE(collection, filter)
+	"AVGWHERE":   3, // AVGWHERE(collection, filter, field)
+}
+
+// extractCollectionDependencies trova le chiamate alle funzioni di aggregazione e
+// restituisce le collection da cui la formula dipende (già nel formato di external_deps).
+// La collection deve essere una stringa letterale, altrimenti non si saprebbe cosa osservare.
+func extractCollectionDependencies(app core.App, rec *core.Record, formula string) ([]string, error) {
+	tree, err := parser.Parse(formula)
+	if err != nil {
+		// gli errori di sintassi vengono segnalati in fase di compilazione (1004)
+		return nil, nil
+	}
+
+	v := &aggregateCallVisitor{}
+	ast.Walk(&tree.Node, v)
+
+	deps := make([]string, 0, len(v.calls))
+	seen := map[string]struct{}{}
+	for _, call := range v.calls {
+		name := call.Callee.(*ast.IdentifierNode).Value
+
+		if len(call.Arguments) != aggregateFunctions[name] {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s expects %d arguments, got %d", name, aggregateFunctions[name], len(call.Arguments)))
+		}
+
+		colArg, ok := call.Arguments[0].(*ast.StringNode)
+		if !ok {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s: the collection must be a string literal", name))
+		}
+
+		col, err := app.FindCachedCollectionByNameOrId(colArg.Value)
+		if err != nil {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s: collection %q not found", name, colArg.Value))
+		}
+		if col.System || col.Name == "calculated_fields" {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s: collection %q cannot be aggregated", name, col.Name))
+		}
+
+		if len(call.Arguments) == 3 {
+			// i campi protetti (hidden, password, ...) valgono come inesistenti
+			if fieldArg, ok := call.Arguments[2].(*ast.StringNode); ok && !isReadableField(col, fieldArg.Value) {
+				return nil, invalidAggregateError(rec, fmt.Sprintf("%s: field %q not found in collection %q", name, fieldArg.Value, col.Name))
+			}
+		}
+
+		dep := collectionDepPrefix + col.Name
+		if _, ok := seen[dep]; !ok {
+			seen[dep] = struct{}{}
+			deps = append(deps, dep)
+		}
+	}
+
+	return deps, nil
+}
+
+type aggregateCallVisitor struct {
+	calls []*ast.CallNode
+}
+
+func (v *aggregateCallVisitor) Visit(node *ast.Node) {
+	call, ok := (*node).(*ast.CallNode)
+	if !ok {
+		return
+	}
+	if ident, ok := call.Callee.(*ast.IdentifierNode); ok {
+		if _, isAggregate := aggregateFunctions[ident.Value]; isAggregate {
+			v.calls = append(v.calls, call)
+		}
+	}
+}
+
+// collectionRead è una lettura diretta dei record di una collection fatta da una formula
+type collectionRead struct {
+	collection string
+	filter     string // "" = tutti i record (anche quando il filtro non è letterale)
+	dynamic    bool   // filtro non letterale: non verificabile al salvataggio
+	view       bool   // LOOKUP: vale la ViewRule invece della ListRule
+}
+
+// rule restituisce la regola della collection che protegge la lettura
+func (r collectionRead) rule(col *core.Collection) *string {
+	if r.view {
+		return col.ViewRule
+	}
+	return col.ListRule
+}
+
+func (r collectionRead) access() string {
+	if r.view {
+		return "view"
+	}
+	return "list"
+}
+
+// collectionReadsOf restituisce le collection (e i filtri) lette dalle aggregazioni della formula,
+// dai filtri sulle righe owner di COLUMN e da LOOKUP (la chiave è nota solo in valutazione: tutte le righe)
+func collectionReadsOf(formula string) []collectionRead {
+	tree, err := parser.Parse(formula)
+	if err != nil {
+		return nil
+	}
+
+	aggregates := &aggregateCallVisitor{}
+	ast.Walk(&tree.Node, aggregates)
+	columns := &columnCallVisitor{}
+	ast.Walk(&tree.Node, columns)
+
+	reads := []collectionRead{}
+	add := func(call *ast.CallNode, filterPos int) {
+		colArg, ok := call.Arguments[0].(*ast.StringNode)
+		if !ok {
+			return
+		}
+		read := collectionRead{collection: colArg.Value}
+		if filterArg, ok := call.Arguments[filterPos].(*ast.StringNode); ok {
+			read.filter = filterArg.Value
+		} else {
+			read.dynamic = true
+		}
+		reads = append(reads, read)
+	}
+	for _, call := range aggregates.calls {
+		if len(call.Arguments) >= 2 {
+			add(call, 1)
+		}
+	}
+	for _, call := range columns.calls {
+		switch name := call.Callee.(*ast.IdentifierNode).Value; {
+		case name == columnFunctionName && len(call.Arguments) == 3:
+			add(call, 2)
+		case name == lookupFunctionName && len(call.Arguments) == 4:
+			if colArg, ok := call.Arguments[0].(*ast.StringNode); ok {
+				reads = append(reads, collectionRead{collection: colArg.Value, view: true})
+			}
+		}
+	}
+	return reads
+}
+
+// canReadCollectionRows indica se l'utente della richiesta può leggere, secondo la ListRule
+// (ViewRule per LOOKUP) della collection, tutti i record che la lettura aggrega
+func canReadCollectionRows(app core.App, reqInfo *core.RequestInfo, read collectionRead) (bool, error) {
+	if reqInfo != nil && reqInfo.HasSuperuserAuth() {
+		return true, nil
+	}
+
+	// un filtro calcolato in valutazione potrebbe usare campi hidden: solo per i superuser
+	if read.dynamic {
+		return false, nil
+	}
+
+	col, err := app.FindCachedCollectionByNameOrId(read.collection)
+	if err != nil {
+		return false, err
+	}
+	// il filtro dell'utente non può leggere campi hidden (anche con una regola pubblica)
+	if read.filter != "" {
+		resolver := core.NewRecordFieldResolver(app, col, reqInfo, false)
+		if _, err := search.FilterData(read.filter).BuildExpr(resolver); err != nil {
+			return false, err
+		}
+	}
+	rule := read.rule(col)
+	if rule == nil {
+		return false, nil
+	}
+	if *rule == "" {
+		return true, nil
+	}
+
+	total, err := countCollectionRows(app, col, reqInfo, read.filter, "")
+	if err != nil {
+		return false, err
+	}
+	allowed, err := countCollectionRows(app, col, reqInfo, read.filter, *rule)
+	if err != nil {
+		return false, err
+	}
+	return allowed == total, nil
+}
+
+// countCollectionRows conta i record della collection che soddisfano filter e rule (se non vuoti).
+// Solo la regola può leggere i campi hidden; il filtro solo se l'utente è superuser.
+func countCollectionRows(app core.App, col *core.Collection, reqInfo *core.RequestInfo, filter, rule string) (int, error) {
+	query := app.RecordQuery(col).Select("COUNT(DISTINCT [[" + col.Name + ".id]])")
+	resolver := core.NewRecordFieldResolver(app, col, reqInfo, false)
+	for _, f := range []struct {
+		expr     string
+		hiddenOk bool
+	}{{filter, reqInfo != nil && reqInfo.HasSuperuserAuth()}, {rule, true}} {
+		if f.expr == "" {
+			continue
+		}
+		resolver.SetAllowHiddenFields(f.hiddenOk)
+		expr, err := search.FilterData(f.expr).BuildExpr(resolver)
+		if err != nil {
+			return 0, err
+		}
+		query.AndWhere(expr)
+	}
+	if err := resolver.UpdateQuery(query); err != nil {
+		return 0, err
+	}
+
+	var count int
+	if err := query.Row(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// collectionReadsAllowed indica se l'utente può leggere tutti i record letti dalla formula del nodo
+// (blockedAt = lettura non permessa)
+func collectionReadsAllowed(app core.App, reqInfo *core.RequestInfo, formula string) (ok bool, blockedAt collectionRead, err error) {
+	for _, read := range collectionReadsOf(formula) {
+		ok, err := canReadCollectionRows(app, reqInfo, read)
+		if err != nil || !ok {
+			return false, read, err
+		}
+	}
+	return true, collectionRead{}, nil
+}
+
+// assertCollectionReadsAllowed rifiuta (403) una formula che aggrega record che l'utente non può elencare
+func assertCollectionReadsAllowed(app core.App, reqInfo *core.RequestInfo, cf *core.Record, formula string, auth *core.Record) error {
+	ok, blockedAt, err := collectionReadsAllowed(app, reqInfo, formula)
+	if err != nil {
+		return invalidAggregateError(cf, fmt.Sprintf("cannot check access to collection %q: %v", blockedAt.collection, err))
+	}
+	if ok {
+		return nil
+	}
+
+	authCol, authId := "", ""
+	if auth != nil {
+		authId = auth.Id
+		if auth.Collection() != nil {
+			authCol = auth.Collection().Name
+		}
+	}
+	return apis.NewForbiddenError(
+		fmt.Sprintf(
+			"Forbidden: user %s/%s has no %s access to all the records of %s read by calculated_fields/%s",
+			authCol, authId, blockedAt.access(), blockedAt.collection, cf.Id,
+		),
+		nil,
+	)
+}
+
+func invalidAggregateError(rec *core.Record, msg string) error {
+	return apis.NewBadRequestError("Invalid collection aggregate in formula", validation.Errors{
+		"formula": validation.NewError("1014", fmt.Sprintf("Invalid aggregate in formula of %s: %s", rec.Id, msg)),
+	})
+}
+
+// bindAggregateFunctions aggiunge all'env le funzioni di aggregazione legate all'app (transazione) corrente.
+// In modalità decimale SUMWHERE e AVGWHERE leggono i valori come testo e sommano *big.Rat esatti.
+func bindAggregateFunctions(ctx context.Context, app core.App, node *core.Record, env map[string]any) {
+	decimal := decimalMode(app, node)
+
+	sum := func(records []*core.Record, field string) any {
+		if decimal {
+			total := new(big.Rat)
+			for _, r := range records {
+				total.Add(total, recordRat(r, field))
+			}
+			return total
+		}
+		total := 0.0
+		for _, r := range records {
+			total += r.GetFloat(field)
+		}
+		return total
+	}
+
+	env["SUMWHERE"] = func(args ...any) (any, error) {
+		records, field, err := aggregateRecords(ctx, app, "SUMWHERE", args)
+		if err != nil {
+			return nil, err
+		}
+		return sum(records, field), nil
+	}
+
+	env["COUNTWHERE"] = func(args ...any) (any, error) {
+		records, _, err := aggregateRecords(ctx, app, "COUNTWHERE", args)
+		if err != nil {
+			return nil, err
+		}
+		return len(records), nil
+	}
+
+	env["AVGWHERE"] = func(args ...any) (any, error) {
+		records, field, err := aggregateRecords(ctx, app, "AVGWHERE", args)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			// come AVERAGEIF di Excel: #DIV/0! è un errore di formula, quindi IFERROR lo intercetta
+			return nil, newFormulaError("#DIV/0!", "AVGWHERE: no record matches the filter")
+		}
+		total := sum(records, field)
+		if r, ok := total.(*big.Rat); ok {
+			return r.Quo(r, new(big.Rat).SetInt64(int64(len(records)))), nil
+		}
+		return total.(float64) / float64(len(records)), nil
+	}
+}
+
+// recordRat legge il campo come *big.Rat dal suo testo (0 se non numerico, come GetFloat)
+func recordRat(r *core.Record, field string) *big.Rat {
+	if v, ok := new(big.Rat).SetString(r.GetString(field)); ok {
+		return v
+	}
+	return new(big.Rat)
+}
+
+// aggregateRecords valida gli argomenti (collection, filter[, field]) e carica i record che soddisfano il filtro
+func aggregateRecords(ctx context.Context, app core.App, name string, args []any) ([]*core.Record, string, error) {
+	if len(args) != aggregateFunctions[name] {
+		return nil, "", fmt.Errorf("%s expects %d arguments, got %d", name, aggregateFunctions[name], len(args))
+	}
+
+	strArgs := make([]string, len(args))
+	for i, a := range args {
+		s, ok := a.(string)
+		if !ok {
+			return nil, "", fmt.Errorf("%s: argument %d must be a string, got %T", name, i+1, a)
+		}
+		strArgs[i] = s
+	}
+
+	field := ""
+	if len(strArgs) == 3 {
+		field = strArgs[2]
+	}
+
+	records, err := findRecordsByFilterContext(ctx, app, strArgs[0], strArgs[1])
+	if err != nil {
+		return nil, "", fmt.Errorf("%s(%q, %q): %w", name, strArgs[0], strArgs[1], err)
+	}
+	return records, field, nil
+}
+
+// findRecordsByFilterContext è app.FindRecordsByFilter (senza ordinamento né paginazione)
+// con la query legata a ctx, così la scadenza della propagazione la annulla
+func findRecordsByFilterContext(ctx context.Context, app core.App, collection, filter string) ([]*core.Record, error) {
+	col, err := app.FindCachedCollectionByNameOrId(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	query := app.RecordQuery(col).WithContext(ctx)
+	resolver := core.NewRecordFieldResolver(app, col, nil, true)
+	if filter != "" {
+		expr, err := search.FilterData(filter).BuildExpr(resolver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter expression: %w", err)
+		}
+		query.AndWhere(expr)
+	}
+	if err := resolver.UpdateQuery(query); err != nil {
+		return nil, err
+	}
+
+	records := []*core.Record{}
+	if err := query.All(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// OnRecordChange_RecalculateCollectionAggregates:
+// - intercetta create/update/delete di QUALSIASI record
+// - ricalcola (nella stessa transazione) i CF che aggregano la collection del record
+func OnRecordChange_RecalculateCollectionAggregates(e *core.RecordEvent) error {
+	col := e.Record.Collection()
+	if col == nil || col.System || col.Name == "calculated_fields" || !hasCalculatedFieldsField(e.App, "external_deps") {
+		return e.Next()
+	}
+
+	// nessun CF aggrega la collection (dall'indice in memoria): niente transazione né query
+	if !graphIndexOf(e.App).hasExternalDependents(e.App, collectionDepPrefix+col.Name) {
+		return e.Next()
+	}
+
+	// update che tocca solo campi autodate (es. il touch di owner.updated): niente da ricalcolare
+	if e.Type == core.ModelEventTypeUpdate && len(changedOwnerFields(e.Record)) == 0 {
+		return e.Next()
+	}
+
+	originalApp := e.App
+	txErr := originalApp.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		cfs, err := findCalculatedFieldsByExternalDep(txApp, collectionDepPrefix+col.Name)
+		if err != nil {
+			return err
+		}
+		return reevaluateCalculatedFields(txApp, cfs)
+	})
+	e.App = originalApp
+	return txErr
+}
+
+// findCalculatedFieldsByExternalDep restituisce i CF che hanno dep tra le external_deps
+func findCalculatedFieldsByExternalDep(app core.App, dep string) ([]*core.Record, error) {
+	cfs, err := app.FindAllRecords("calculated_fields", dbx.NewExp(
+		"EXISTS (SELECT 1 FROM json_each(CASE WHEN json_valid([[external_deps]]) THEN [[external_deps]] ELSE '[]' END) WHERE json_each.value = {:dep})",
+		dbx.Params{"dep": dep},
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load calculated_fields depending on %s: %w", dep, err)
+	}
+	return cfs, nil
+}
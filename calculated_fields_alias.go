@@ -0,0 +1,195 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// aliasPattern è il formato ammesso per calculated_fields.alias:
+// deve essere un identificatore valido per expr (es. vat_rate, net_total).
+const aliasPattern = `^[A-Za-z_][A-Za-z0-9_]*$`
+
+var aliasRegex = regexp.MustCompile(aliasPattern)
+
+// nomi che non possono essere usati come alias perché hanno già un significato nelle formule
+var reservedFormulaNames = map[string]struct{}{
+	"true": {}, "false": {}, "nil": {}, "null": {},
+	"if": {}, "else": {}, "in": {}, "not": {}, "and": {}, "or": {}, "let": {},
+	"matches": {}, "contains": {}, "startsWith": {}, "endsWith": {},
+	selfIdentifier: {}, ownerIdentifier: {}, prevIdentifier: {},
+}
+
+// validateAlias verifica che l'alias (se presente) sia un identificatore valido,
+// non riservato, e che non sia già usato come alias o come id da un altro calculated_field.
+func validateAlias(app core.App, rec *core.Record) error {
+	alias := rec.GetString("alias")
+	if alias == "" {
+		return nil
+	}
+
+	if !aliasRegex.MatchString(alias) {
+		return apis.NewBadRequestError("Invalid calculated_field alias", validation.Errors{
+			"alias": validation.NewError("1013", fmt.Sprintf("Alias %q must be a valid identifier (%s)", alias, aliasPattern)),
+		})
+	}
+
+	if _, reserved := reservedFormulaNames[alias]; reserved || isFormulaFunctionName(alias) {
+		return apis.NewBadRequestError("Invalid calculated_field alias", validation.Errors{
+			"alias": validation.NewError("1013", fmt.Sprintf("Alias %q is a reserved formula keyword", alias)),
+		})
+	}
+
+	// un alias non può coincidere con l'id di un altro nodo, altrimenti il riferimento è ambiguo
+	if other, err := app.FindRecordById("calculated_fields", alias); err == nil && other.Id != rec.Id {
+		return apis.NewBadRequestError("Invalid calculated_field alias", validation.Errors{
+			"alias": validation.NewError("1013", fmt.Sprintf("Alias %q collides with the id of calculated_fields/%s", alias, other.Id)),
+		})
+	}
+
+	if other, err := app.FindFirstRecordByData("calculated_fields", "alias", alias); err == nil && other.Id != rec.Id {
+		return apis.NewBadRequestError("Invalid calculated_field alias", validation.Errors{
+			"alias": validation.NewError("1013", fmt.Sprintf("Alias %q is already used by calculated_fields/%s", alias, other.Id)),
+		})
+	}
+
+	return nil
+}
+
+// renameAliasInDependents riscrive le formule dei nodi che dipendono da rec
+// quando il suo alias cambia. Se il nuovo alias è vuoto, il riferimento torna all'id.
+func renameAliasInDependents(txApp core.App, rec *core.Record, oldAlias, newAlias string) error {
+	if oldAlias == "" || oldAlias == newAlias {
+		return nil
+	}
+
+	replacement := newAlias
+	if replacement == "" {
+		replacement = rec.Id
+	}
+
+	if err := expandFormulaDependencies(txApp, rec); err != nil {
+		return err
+	}
+
+	for _, dependent := range rec.ExpandedAll("calculated_fields_via_depends_on") {
+		formula := dependent.GetString("formula")
+		updatedFormula := replaceFormulaIdentifier(formula, oldAlias, replacement)
+		if updatedFormula == formula {
+			continue
+		}
+
+		// value/error non cambiano: cambia solo il testo con cui ci si riferisce al nodo
+		dependent.Set("formula", updatedFormula)
+		if err := saveNodeWithoutHooks(txApp, dependent); err != nil {
+			return fmt.Errorf("failed to rename alias %q in calculated_fields/%s: %w", oldAlias, dependent.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// replaceFormulaIdentifier sostituisce nella formula i riferimenti "from" con "to",
+// ignorando stringhe letterali, accessi a membri (x.from) e chiamate di funzione (from(...)).
+// "from" può essere anche un percorso puntato: viene sostituito solo il prefisso che combacia.
+func replaceFormulaIdentifier(formula, from, to string) string {
+	if from == "" || from == to {
+		return formula
+	}
+
+	var b strings.Builder
+	b.Grow(len(formula))
+
+	for i := 0; i < len(formula); {
+		c := formula[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			j := skipStringLiteral(formula, i)
+			b.WriteString(formula[i:j])
+			i = j
+
+		case isIdentifierChar(c):
+			j := scanIdentifierPath(formula, i)
+			path := formula[i:j]
+
+			if (path == from || strings.HasPrefix(path, from+".")) &&
+				!isMemberAccess(formula, i) &&
+				!isFunctionCall(formula, j) {
+				b.WriteString(to)
+				b.WriteString(path[len(from):])
+			} else {
+				b.WriteString(path)
+			}
+			i = j
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	return b.String()
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
+}
+
+// scanIdentifierPath restituisce la fine del percorso identificatore (a.b.c) che inizia in start
+func scanIdentifierPath(s string, start int) int {
+	j := start
+	for j < len(s) {
+		if isIdentifierChar(s[j]) {
+			j++
+			continue
+		}
+		if s[j] == '.' && j+1 < len(s) && isIdentifierChar(s[j+1]) {
+			j++
+			continue
+		}
+		break
+	}
+	return j
+}
+
+// skipStringLiteral restituisce l'indice successivo alla chiusura della stringa che inizia in start
+func skipStringLiteral(s string, start int) int {
+	quote := s[start]
+	for j := start + 1; j < len(s); j++ {
+		if s[j] == '\\' && quote != '`' {
+			j++
+			continue
+		}
+		if s[j] == quote {
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+func isMemberAccess(s string, start int) bool {
+	for k := start - 1; k >= 0; k-- {
+		if s[k] == ' ' || s[k] == '\t' || s[k] == '\n' {
+			continue
+		}
+		return s[k] == '.'
+	}
+	return false
+}
+
+func isFunctionCall(s string, end int) bool {
+	for k := end; k < len(s); k++ {
+		if s[k] == ' ' || s[k] == '\t' || s[k] == '\n' {
+			continue
+		}
+		return s[k] == '('
+	}
+	return false
+}
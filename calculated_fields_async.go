@@ -0,0 +1,288 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// recalculationJobsCollection è la coda persistente dei ricalcoli asincroni (un job per nodo radice)
+const recalculationJobsCollection = "calculated_fields_jobs"
+
+// recalculationBatchSize è il numero massimo di job lavorati in una transazione
+const recalculationBatchSize = 100
+
+// valori di calc_status: pending e computing indicano un valore non ancora aggiornato
+const (
+	CalcStatusPending   = "pending"
+	CalcStatusComputing = "computing"
+	CalcStatusOk        = "ok"
+	CalcStatusError     = "error"
+)
+
+var calcStatuses = []string{CalcStatusPending, CalcStatusComputing, CalcStatusOk, CalcStatusError}
+
+// calcStatusOf restituisce lo stato di un nodo appena calcolato
+func calcStatusOf(errMsg string) string {
+	if errMsg != "" {
+		return CalcStatusError
+	}
+	return CalcStatusOk
+}
+
+// enqueueRecalculation (Config.AsyncMode) verifica subito la sintassi della formula,
+// segna pending il nodo e tutti i suoi dipendenti e mette il nodo nella coda del worker.
+// Un job già in coda per lo stesso nodo basta: il worker legge la formula attuale.
+func enqueueRecalculation(txApp core.App, node *core.Record) error {
+	formula := node.GetString("formula")
+	if !strings.Contains(formula, "#REF!") {
+		if _, unknown := unknownFunction(formula); !unknown {
+			if _, err := compileNodeFormula(txApp, node); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := expandFormulaDependencies(txApp, node); err != nil {
+		return err
+	}
+	order, err := affectedSubgraph(txApp, []*core.Record{node}, false)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(order)+1)
+	ids = append(ids, node.Id)
+	for _, n := range order {
+		ids = append(ids, n.Id)
+	}
+	if err := setCalcStatus(txApp, CalcStatusPending, ids); err != nil {
+		return err
+	}
+	node.Set("calc_status", CalcStatusPending)
+
+	if existing, _ := txApp.FindFirstRecordByData(recalculationJobsCollection, "node", node.Id); existing != nil {
+		return nil
+	}
+	jobs, err := txApp.FindCachedCollectionByNameOrId(recalculationJobsCollection)
+	if err != nil {
+		return fmt.Errorf("calculatedfields: missing %s collection: %w", recalculationJobsCollection, err)
+	}
+	job := core.NewRecord(jobs)
+	job.Set("node", node.Id)
+	if err := txApp.Save(job); err != nil {
+		return fmt.Errorf("failed to enqueue recalculation of %s: %w", node.Id, err)
+	}
+	return nil
+}
+
+// setCalcStatus aggiorna calc_status dei nodi indicati direttamente a db (senza hook né touch degli owner)
+func setCalcStatus(app core.App, status string, ids []string) error {
+	if len(ids) == 0 || !hasCalculatedFieldsField(app, "calc_status") {
+		return nil
+	}
+	values := make([]any, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	_, err := app.DB().Update("calculated_fields", dbx.Params{"calc_status": status}, dbx.In("id", values...)).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to set calc_status %s: %w", status, err)
+	}
+	return nil
+}
+
+// ProcessRecalculationQueue svuota la coda dei ricalcoli asincroni a blocchi di recalculationBatchSize job.
+// Ogni blocco è ricalcolato una sola volta in ordine topologico (radici e dipendenti), come UpdateFormulas.
+// Restituisce il numero di job lavorati.
+func ProcessRecalculationQueue(app core.App) (int, error) {
+	if _, err := app.FindCachedCollectionByNameOrId(recalculationJobsCollection); err != nil {
+		return 0, nil
+	}
+
+	processed := 0
+	for {
+		jobs, err := app.FindRecordsByFilter(recalculationJobsCollection, "", "created", recalculationBatchSize, 0)
+		if err != nil {
+			return processed, err
+		}
+		if len(jobs) == 0 {
+			return processed, nil
+		}
+		if err := processRecalculationBatch(app, jobs); err != nil {
+			return processed, err
+		}
+		processed += len(jobs)
+	}
+}
+
+// processRecalculationBatch ricalcola il blocco di job in una sola passata; se fallisce riprova job per job,
+// così un nodo non ricalcolabile non blocca la coda né lascia in errore gli altri job del blocco.
+func processRecalculationBatch(app core.App, jobs []*core.Record) error {
+	err := recalculateJobs(app, jobs)
+	if err == nil {
+		return nil
+	}
+	if len(jobs) == 1 {
+		return failRecalculationJob(app, jobs[0], err)
+	}
+
+	app.Logger().Warn("calculatedfields: async batch failed, retrying job by job", "jobs", len(jobs), "error", err)
+	for _, job := range jobs {
+		if err := recalculateJobs(app, []*core.Record{job}); err != nil {
+			if err := failRecalculationJob(app, job, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recalculateJobs segna computing il sottografo dei job e lo ricalcola in una transazione,
+// con stato finale e rimozione dei job (in caso di errore i job restano in coda)
+func recalculateJobs(app core.App, jobs []*core.Record) error {
+	jobIds := make([]any, len(jobs))
+	nodeIds := make([]string, 0, len(jobs))
+	for i, job := range jobs {
+		jobIds[i] = job.Id
+		nodeIds = append(nodeIds, job.GetString("node"))
+	}
+
+	// 1️⃣ computing: visibile ai client mentre il blocco viene ricalcolato
+	err := app.RunInTransaction(func(txApp core.App) error {
+		order, err := recalculationOrder(txApp, nodeIds)
+		if err != nil {
+			return err
+		}
+		affected := make([]string, 0, len(order))
+		for _, n := range order {
+			affected = append(affected, n.Id)
+		}
+		return setCalcStatus(txApp, CalcStatusComputing, affected)
+	})
+	if err != nil {
+		return err
+	}
+
+	// 2️⃣ ricalcolo topologico, stato finale e rimozione dei job in un'unica transazione
+	return app.RunInTransaction(func(txApp core.App) error {
+		order, err := recalculationOrder(txApp, nodeIds)
+		if err != nil {
+			return err
+		}
+		touched := ownerTouches{}
+		if err := evaluateInOrder(txApp, order, map[string]any{}, touched); err != nil {
+			return err
+		}
+		if err := touched.apply(txApp); err != nil {
+			return err
+		}
+		okIds, errorIds := []string{}, []string{}
+		for _, n := range order {
+			if n.GetString("error") != "" {
+				errorIds = append(errorIds, n.Id)
+			} else {
+				okIds = append(okIds, n.Id)
+			}
+		}
+		if err := setCalcStatus(txApp, CalcStatusOk, okIds); err != nil {
+			return err
+		}
+		if err := setCalcStatus(txApp, CalcStatusError, errorIds); err != nil {
+			return err
+		}
+		_, err = txApp.DB().Delete(recalculationJobsCollection, dbx.In("id", jobIds...)).Execute()
+		return err
+	})
+}
+
+// failRecalculationJob segna error il nodo del job e tutti i suoi dipendenti (letti dall'indice, senza limiti,
+// così nessuno resta pending anche se il sottografo non è calcolabile) e rimuove il job
+func failRecalculationJob(app core.App, job *core.Record, cause error) error {
+	nodeId := job.GetString("node")
+	app.Logger().Error("calculatedfields: async recalculation failed", "node", nodeId, "error", cause)
+
+	return app.RunInTransaction(func(txApp core.App) error {
+		ids := append([]string{nodeId}, graphIndexOf(txApp).descendantsOf(txApp, nodeId)...)
+		if err := setCalcStatus(txApp, CalcStatusError, ids); err != nil {
+			return err
+		}
+		_, err := txApp.DB().Delete(recalculationJobsCollection, dbx.HashExp{"id": job.Id}).Execute()
+		return err
+	})
+}
+
+// recalculationOrder restituisce in ordine topologico i nodi ancora esistenti tra ids e tutti i loro dipendenti
+func recalculationOrder(txApp core.App, ids []string) ([]*core.Record, error) {
+	roots, err := txApp.FindRecordsByIds("calculated_fields", ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	return affectedSubgraph(txApp, roots, true)
+}
+
+// recalculationWorker lavora periodicamente la coda dei ricalcoli asincroni
+type recalculationWorker struct {
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// bindRecalculationWorker avvia il worker all'avvio del server (se Config.AsyncMode) e lo ferma alla chiusura
+func bindRecalculationWorker(app core.App) {
+	w := &recalculationWorker{}
+
+	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
+		cfg := GetConfig(e.App)
+		if cfg.AsyncMode {
+			w.start(e.App, cfg.asyncInterval())
+		}
+		return e.Next()
+	})
+
+	app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		w.halt()
+		return e.Next()
+	})
+}
+
+func (w *recalculationWorker) start(app core.App, interval time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	w.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := ProcessRecalculationQueue(app); err != nil {
+					app.Logger().Error("calculatedfields: recalculation queue failed", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+func (w *recalculationWorker) halt() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
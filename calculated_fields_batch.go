@@ -0,0 +1,80 @@
+package calculatedfields
+
+import (
+	"fmt"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// FormulaUpdate è una modifica di formula applicata da UpdateFormulas
+type FormulaUpdate struct {
+	Id      string `json:"id"`
+	Formula string `json:"formula"`
+}
+
+// UpdateFormulas applica più formule in un'unica transazione (es. import di un modello):
+//  1. risolve le dipendenze di tutte le formule;
+//  2. verifica i cicli sul grafo combinato (una formula può rompere un ciclo che un'altra creerebbe);
+//  3. ricalcola una sola volta, in ordine topologico, l'unione dei nodi modificati e dei loro dipendenti.
+//
+// Gli hook dei singoli calculated_fields non vengono eseguiti. Restituisce i nodi aggiornati,
+// nell'ordine delle modifiche; in caso di errore non viene applicato nulla.
+func UpdateFormulas(app core.App, updates []FormulaUpdate) ([]*core.Record, error) {
+	records := make([]*core.Record, 0, len(updates))
+	if len(updates) == 0 {
+		return records, nil
+	}
+
+	txErr := app.RunInTransaction(func(txApp core.App) error {
+		seen := make(map[string]struct{}, len(updates))
+		for i, u := range updates {
+			key := fmt.Sprintf("updates.%d", i)
+			if _, dup := seen[u.Id]; dup {
+				return apis.NewBadRequestError("Invalid formula batch", validation.Errors{
+					key: validation.NewError("1015", fmt.Sprintf("Duplicate update for calculated_field %s", u.Id)),
+				})
+			}
+			seen[u.Id] = struct{}{}
+
+			rec, err := txApp.FindRecordById("calculated_fields", u.Id)
+			if err != nil {
+				return apis.NewBadRequestError("Invalid formula batch", validation.Errors{
+					key: validation.NewError("1005", fmt.Sprintf("calculated_field %s not found", u.Id)),
+				})
+			}
+			rec.Set("formula", u.Formula)
+			records = append(records, rec)
+		}
+
+		// 1️⃣ dipendenze di tutte le formule, senza controllo dei cicli sul grafo parziale
+		for _, rec := range records {
+			if _, err := resolveDepsAndTxSave(txApp, rec, false); err != nil {
+				return err
+			}
+		}
+
+		// 2️⃣ cicli sul grafo combinato
+		for _, rec := range records {
+			if err := checkDependencyCycle(txApp, rec, rec.GetStringSlice("depends_on")); err != nil {
+				return err
+			}
+		}
+
+		// 3️⃣ un solo ricalcolo topologico sull'unione dei nodi coinvolti
+		order, err := affectedSubgraph(txApp, records, true)
+		if err != nil {
+			return err
+		}
+		touched := ownerTouches{}
+		if err := evaluateInOrder(txApp, order, map[string]any{}, touched); err != nil {
+			return err
+		}
+		return touched.apply(txApp)
+	})
+	if txErr != nil {
+		return nil, txErr
+	}
+	return records, nil
+}
@@ -0,0 +1,326 @@
+package calculatedfields
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/inflector"
+)
+
+// columnFunctionName: COLUMN(collection, field[, ownerFilter]) restituisce i valori di tutti i
+// calculated_fields collegati a <collection>.<field>, cioè una "colonna" del foglio.
+const columnFunctionName = "COLUMN"
+
+// lookupFunctionName: LOOKUP(collection, keyField, key, field) restituisce il valore del calculated_field
+// <field> della riga di <collection> con <keyField> = key.
+const lookupFunctionName = "LOOKUP"
+
+// columnDepPrefix marca in external_deps le colonne usate (es. "column:booking_queue.act_fx"):
+// serve a trovare gli aggregatori quando nasce una nuova riga owner.
+const columnDepPrefix = "column:"
+
+// columnRef è una chiamata COLUMN con argomenti letterali già validati
+type columnRef struct {
+	collection string
+	field      string
+	filtered   bool
+}
+
+func (c columnRef) dep() string {
+	return columnDepPrefix + c.collection + "." + c.field
+}
+
+// extractColumnReferences trova le chiamate COLUMN e LOOKUP e ne valida collection e campo (devono essere letterali,
+// il campo deve essere una relation verso calculated_fields, e il nodo non può far parte della colonna).
+func extractColumnReferences(app core.App, rec *core.Record, formula string) ([]columnRef, error) {
+	tree, err := parser.Parse(formula)
+	if err != nil {
+		// gli errori di sintassi vengono segnalati in fase di compilazione (1004)
+		return nil, nil
+	}
+
+	v := &columnCallVisitor{}
+	ast.Walk(&tree.Node, v)
+
+	refs := make([]columnRef, 0, len(v.calls))
+	for _, call := range v.calls {
+		name := call.Callee.(*ast.IdentifierNode).Value
+		var colArg, fieldArg, keyArg *ast.StringNode
+		okCol, okField, okKey := false, false, true
+		switch name {
+		case columnFunctionName:
+			if len(call.Arguments) < 2 || len(call.Arguments) > 3 {
+				return nil, invalidAggregateError(rec, fmt.Sprintf("COLUMN expects 2 or 3 arguments, got %d", len(call.Arguments)))
+			}
+			colArg, okCol = call.Arguments[0].(*ast.StringNode)
+			fieldArg, okField = call.Arguments[1].(*ast.StringNode)
+		case lookupFunctionName:
+			if len(call.Arguments) != 4 {
+				return nil, invalidAggregateError(rec, fmt.Sprintf("LOOKUP expects 4 arguments, got %d", len(call.Arguments)))
+			}
+			colArg, okCol = call.Arguments[0].(*ast.StringNode)
+			keyArg, okKey = call.Arguments[1].(*ast.StringNode)
+			fieldArg, okField = call.Arguments[3].(*ast.StringNode)
+		}
+		if !okCol || !okField || !okKey {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s: collection and field names must be string literals", name))
+		}
+
+		col, err := app.FindCachedCollectionByNameOrId(colArg.Value)
+		if err != nil || col.System || col.Name == "calculated_fields" {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s: collection %q not found", name, colArg.Value))
+		}
+		// i campi protetti (hidden, password, tokenKey, email) valgono come inesistenti:
+		// la chiave rivelerebbe il loro contenuto a chi vede il risultato
+		if keyArg != nil && !isReadableField(col, keyArg.Value) {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s: field %q not found in %s", name, keyArg.Value, col.Name))
+		}
+		if col.Fields.GetByName(fieldArg.Value) != nil && !isReadableField(col, fieldArg.Value) {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s: field %q not found in %s", name, fieldArg.Value, col.Name))
+		}
+		if !isCalculatedFieldsRelation(app, col, fieldArg.Value) {
+			return nil, invalidAggregateError(rec, fmt.Sprintf("%s: %s.%s is not a relation to calculated_fields", name, col.Name, fieldArg.Value))
+		}
+
+		if rec.GetString("owner_collection") == col.Name && rec.GetString("owner_field") == fieldArg.Value {
+			return nil, apis.NewBadRequestError("Formula dependency error: circular reference found", validation.Errors{
+				rec.Id: validation.NewError("1003", fmt.Sprintf("%s over %s.%s includes %s itself", name, col.Name, fieldArg.Value, rec.Id)),
+			})
+		}
+
+		// LOOKUP dipende dall'intera colonna (la chiave può cambiare) e dalla collection (cambio chiave, cancellazioni)
+		refs = append(refs, columnRef{
+			collection: col.Name,
+			field:      fieldArg.Value,
+			filtered:   name == lookupFunctionName || len(call.Arguments) == 3,
+		})
+	}
+
+	return refs, nil
+}
+
+type columnCallVisitor struct {
+	calls []*ast.CallNode
+}
+
+func (v *columnCallVisitor) Visit(node *ast.Node) {
+	call, ok := (*node).(*ast.CallNode)
+	if !ok {
+		return
+	}
+	if ident, ok := call.Callee.(*ast.IdentifierNode); ok && (ident.Value == columnFunctionName || ident.Value == lookupFunctionName) {
+		v.calls = append(v.calls, call)
+	}
+}
+
+// isCalculatedFieldsRelation indica se col.field è una relation verso calculated_fields
+func isCalculatedFieldsRelation(app core.App, col *core.Collection, field string) bool {
+	cfCol, err := app.FindCachedCollectionByNameOrId("calculated_fields")
+	if err != nil {
+		return false
+	}
+	rel, ok := col.Fields.GetByName(field).(*core.RelationField)
+	return ok && rel.CollectionId == cfCol.Id
+}
+
+// columnExternalDeps: "column:<c>.<f>" per ogni colonna, più "collection:<c>" se c'è un filtro sulle righe owner
+// (il filtro può cambiare esito quando cambiano i campi owner)
+func columnExternalDeps(refs []columnRef) []string {
+	deps := []string{}
+	for _, ref := range refs {
+		deps = append(deps, ref.dep())
+		if ref.filtered {
+			deps = append(deps, collectionDepPrefix+ref.collection)
+		}
+	}
+	return deps
+}
+
+// findColumnMembers restituisce i calculated_fields della colonna collection.field (ordinati per owner_row)
+func findColumnMembers(ctx context.Context, app core.App, collection, field string) ([]*core.Record, error) {
+	members := []*core.Record{}
+	err := app.RecordQuery("calculated_fields").WithContext(ctx).
+		AndWhere(dbx.HashExp{"owner_collection": collection, "owner_field": field}).
+		OrderBy("owner_row ASC").
+		All(&members)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load column %s.%s: %w", collection, field, err)
+	}
+	return members, nil
+}
+
+// columnMemberIds: gli id di tutte le celle delle colonne usate, per il controllo dei cicli
+// (gli archi cella -> lettore stanno nell'indice del grafo, non in depends_on)
+func columnMemberIds(app core.App, refs []columnRef) ([]string, error) {
+	ids := []string{}
+	for _, ref := range refs {
+		members, err := findColumnMembers(context.Background(), app, ref.collection, ref.field)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			ids = append(ids, m.Id)
+		}
+	}
+	return ids, nil
+}
+
+// bindColumnFunction aggiunge COLUMN all'env del nodo: i valori vengono letti dal DB della transazione
+// (le celle sono già salvate quando l'aggregatore viene valutato) e portati nella modalità numerica del nodo.
+func bindColumnFunction(ctx context.Context, app core.App, node *core.Record, env map[string]any) {
+	decimal := decimalMode(app, node)
+
+	env[columnFunctionName] = func(args ...any) (any, error) {
+		if err := expectArgs(columnFunctionName, args, 2, 3); err != nil {
+			return nil, err
+		}
+		collection, err := toText(columnFunctionName, 1, args[0])
+		if err != nil {
+			return nil, err
+		}
+		field, err := toText(columnFunctionName, 2, args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		members, err := findColumnMembers(ctx, app, collection, field)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(args) == 3 {
+			filter, err := toText(columnFunctionName, 3, args[2])
+			if err != nil {
+				return nil, err
+			}
+			owners, err := findRecordsByFilterContext(ctx, app, collection, filter)
+			if err != nil {
+				return nil, newFormulaError("#VALUE!", "COLUMN: invalid filter on %s: %v", collection, err)
+			}
+			matching := make(map[string]struct{}, len(owners))
+			for _, o := range owners {
+				matching[o.Id] = struct{}{}
+			}
+			filtered := members[:0]
+			for _, m := range members {
+				if _, ok := matching[m.GetString("owner_row")]; ok {
+					filtered = append(filtered, m)
+				}
+			}
+			members = filtered
+		}
+
+		values := make([]any, len(members))
+		for i, m := range members {
+			if values[i], err = cellValue(app, m, decimal); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+}
+
+// bindLookupFunction aggiunge LOOKUP all'env del nodo: cerca la riga di collection con keyField = key
+// e restituisce il valore del suo calculated_field field (#N/A se la riga non esiste).
+func bindLookupFunction(ctx context.Context, app core.App, node *core.Record, env map[string]any) {
+	decimal := decimalMode(app, node)
+
+	env[lookupFunctionName] = func(args ...any) (any, error) {
+		if err := expectArgs(lookupFunctionName, args, 4, 4); err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, 3)
+		for _, pos := range []int{0, 1, 3} {
+			name, err := toText(lookupFunctionName, pos+1, args[pos])
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+		}
+		collection, keyField, field := names[0], names[1], names[2]
+		key := normalizeNumbers(args[2], false)
+		if key == nil {
+			return nil, newFormulaError("#N/A", "LOOKUP: key not available (null)")
+		}
+		// 5.0 -> 5: confrontato con una colonna testo diventerebbe "5.0"
+		if f, ok := key.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			key = int64(f)
+		}
+
+		col, err := app.FindCachedCollectionByNameOrId(collection)
+		if err != nil {
+			return nil, fmt.Errorf("LOOKUP on %s failed: %w", collection, err)
+		}
+		row := &core.Record{}
+		err = app.RecordQuery(col).WithContext(ctx).
+			AndWhere(dbx.HashExp{inflector.Columnify(keyField): key}).
+			Limit(1).
+			One(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, newFormulaError("#N/A", "LOOKUP: no record of %s with %s = %v", collection, keyField, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("LOOKUP on %s failed: %w", collection, err)
+		}
+
+		cell, err := findOwnerCell(app, collection, row.Id, field)
+		if err != nil {
+			return nil, err
+		}
+		if cell == nil {
+			return nil, newFormulaError("#N/A", "LOOKUP: %s/%s has no calculated field %s", collection, row.Id, field)
+		}
+		return cellValue(app, cell, decimal)
+	}
+}
+
+// cellValue: il valore salvato di una cella così come lo vede il nodo che la legge
+// (codici di errore come errori ereditati, numeri nella modalità del nodo)
+func cellValue(app core.App, cell *core.Record, decimal bool) (any, error) {
+	var v any
+	if err := json.Unmarshal([]byte(cell.GetString("value")), &v); err != nil {
+		return nil, fmt.Errorf("invalid JSON in value of %s: %v", cell.Id, err)
+	}
+	if code, ok := v.(string); ok && formulaErrorCodes[code] {
+		return inheritedError(cell, code), nil
+	}
+	return normalizeNumbers(envValue(app, cell, v), decimal), nil
+}
+
+// findColumnReaders restituisce i nodi che leggono (COLUMN, LOOKUP) la colonna della cella
+func findColumnReaders(txApp core.App, cf *core.Record) ([]*core.Record, error) {
+	column := columnKey(cf.GetString("owner_collection"), cf.GetString("owner_field"))
+	if column == "" || !hasCalculatedFieldsField(txApp, "external_deps") {
+		return []*core.Record{}, nil
+	}
+	if !graphIndexOf(txApp).hasExternalDependents(txApp, column) {
+		return []*core.Record{}, nil
+	}
+	return findCalculatedFieldsByExternalDep(txApp, column)
+}
+
+// attachToColumnDependents ricalcola gli aggregatori della colonna di un nuovo calculated_field
+// (la nuova riga owner entra nel COLUMN): l'arco cella -> aggregatore lo ricava l'indice del grafo.
+func attachToColumnDependents(txApp core.App, cf *core.Record) error {
+	dependents, err := findColumnReaders(txApp, cf)
+	if err != nil {
+		return err
+	}
+
+	for _, dep := range dependents {
+		if err := checkDependencyCycle(txApp, dep, []string{cf.Id}); err != nil {
+			return err
+		}
+	}
+	return reevaluateCalculatedFields(txApp, dependents)
+}
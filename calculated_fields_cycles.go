@@ -0,0 +1,65 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// findDependencyCycle percorre la chiusura di depends_on (dall'indice del grafo) a partire dai nuovi
+// genitori di rec e restituisce il ciclo (rec → ... → rec) se uno di essi dipende, anche indirettamente, da rec.
+func findDependencyCycle(app core.App, rec *core.Record, parentIds []string) ([]string, error) {
+	index := graphIndexOf(app)
+	visited := map[string]struct{}{}
+
+	var visit func(id string, path []string) ([]string, error)
+	visit = func(id string, path []string) ([]string, error) {
+		path = append(slices.Clip(path), id)
+		if id == rec.Id {
+			return path, nil
+		}
+		if _, ok := visited[id]; ok {
+			return nil, nil
+		}
+		visited[id] = struct{}{}
+
+		// nodo non più esistente: nessun arco uscente
+		for _, dep := range index.parentsOf(app, id) {
+			cycle, err := visit(dep, path)
+			if cycle != nil || err != nil {
+				return cycle, err
+			}
+		}
+		return nil, nil
+	}
+
+	for _, parent := range parentIds {
+		cycle, err := visit(parent, []string{rec.Id})
+		if cycle != nil || err != nil {
+			return cycle, err
+		}
+	}
+	return nil, nil
+}
+
+// checkDependencyCycle rifiuta (1003) i nuovi depends_on di rec se chiudono un ciclo,
+// riportando il percorso completo nel messaggio e in params.cycle.
+func checkDependencyCycle(app core.App, rec *core.Record, parentIds []string) error {
+	cycle, err := findDependencyCycle(app, rec, parentIds)
+	if err != nil || cycle == nil {
+		return err
+	}
+
+	path := strings.Join(cycle, " → ")
+	return apis.NewBadRequestError(
+		fmt.Sprintf("Formula dependency error: circular reference found (%s)", path),
+		validation.Errors{
+			rec.Id: validation.NewError("1003", fmt.Sprintf("Circular dependency: %s", path)).
+				SetParams(map[string]any{"cycle": cycle}),
+		},
+	)
+}
@@ -0,0 +1,212 @@
+package calculatedfields
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// funzioni data: nome -> volatile (il risultato cambia col passare del tempo)
+var dateFunctions = map[string]bool{
+	"NOW":     true,
+	"TODAY":   true,
+	"DATE":    false,
+	"DATEDIF": false,
+	"EDATE":   false,
+	"WEEKDAY": false,
+}
+
+// layout accettati per le date passate come testo (es. valori JSON di altri nodi, campi owner)
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	types.DefaultDateLayout,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// bindDateFunctions aggiunge all'env le funzioni data, legate alla timezone configurata per l'app
+func bindDateFunctions(app core.App, env map[string]any) {
+	loc := GetConfig(app).location()
+
+	env["NOW"] = func(args ...any) (any, error) {
+		if err := expectArgs("NOW", args, 0, 0); err != nil {
+			return nil, err
+		}
+		return time.Now().In(loc), nil
+	}
+
+	env["TODAY"] = func(args ...any) (any, error) {
+		if err := expectArgs("TODAY", args, 0, 0); err != nil {
+			return nil, err
+		}
+		return startOfDay(time.Now(), loc), nil
+	}
+
+	env["DATE"] = func(args ...any) (any, error) {
+		if err := expectArgs("DATE", args, 3, 3); err != nil {
+			return nil, err
+		}
+		parts := make([]int, 3)
+		for i, a := range args {
+			n, err := toInteger("DATE", i+1, a)
+			if err != nil {
+				return nil, err
+			}
+			parts[i] = n
+		}
+		// come Excel: mesi/giorni fuori range vengono normalizzati (DATE(2024, 13, 1) = 2025-01-01)
+		return time.Date(parts[0], time.Month(parts[1]), parts[2], 0, 0, 0, 0, loc), nil
+	}
+
+	env["DATEDIF"] = func(args ...any) (any, error) {
+		if err := expectArgs("DATEDIF", args, 3, 3); err != nil {
+			return nil, err
+		}
+		start, err := toTime("DATEDIF", 1, args[0], loc)
+		if err != nil {
+			return nil, err
+		}
+		end, err := toTime("DATEDIF", 2, args[1], loc)
+		if err != nil {
+			return nil, err
+		}
+		unit, err := toText("DATEDIF", 3, args[2])
+		if err != nil {
+			return nil, err
+		}
+		return dateDif(start.In(loc), end.In(loc), strings.ToUpper(unit))
+	}
+
+	env["EDATE"] = func(args ...any) (any, error) {
+		if err := expectArgs("EDATE", args, 2, 2); err != nil {
+			return nil, err
+		}
+		start, err := toTime("EDATE", 1, args[0], loc)
+		if err != nil {
+			return nil, err
+		}
+		months, err := toInteger("EDATE", 2, args[1])
+		if err != nil {
+			return nil, err
+		}
+		return addMonthsClamped(start.In(loc), months), nil
+	}
+
+	env["WEEKDAY"] = func(args ...any) (any, error) {
+		if err := expectArgs("WEEKDAY", args, 1, 2); err != nil {
+			return nil, err
+		}
+		d, err := toTime("WEEKDAY", 1, args[0], loc)
+		if err != nil {
+			return nil, err
+		}
+		returnType := 1
+		if len(args) == 2 {
+			if returnType, err = toInteger("WEEKDAY", 2, args[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		wd := int(d.In(loc).Weekday()) // domenica = 0
+		switch returnType {
+		case 1: // domenica = 1 ... sabato = 7
+			return wd + 1, nil
+		case 2: // lunedì = 1 ... domenica = 7
+			return (wd+6)%7 + 1, nil
+		case 3: // lunedì = 0 ... domenica = 6
+			return (wd + 6) % 7, nil
+		default:
+			return nil, newFormulaError("#NUM!", "WEEKDAY: type %d is not supported (1, 2 or 3)", returnType)
+		}
+	}
+}
+
+// toTime accetta time.Time o testo in uno dei dateLayouts (le date senza fuso sono nella timezone configurata)
+func toTime(name string, pos int, v any, loc *time.Location) (time.Time, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return val, nil
+	case types.DateTime:
+		return val.Time(), nil
+	case string:
+		for _, layout := range dateLayouts {
+			if t, err := time.ParseInLocation(layout, val, loc); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, newFormulaError("#VALUE!", "%s: argument %d is not a valid date (%q)", name, pos, val)
+	case nil:
+		return time.Time{}, newFormulaError("#N/A", "%s: argument %d is not available (null)", name, pos)
+	default:
+		return time.Time{}, newFormulaError("#VALUE!", "%s: argument %d must be a date, got %T", name, pos, v)
+	}
+}
+
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+func daysInMonth(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// calendarDays conta i giorni di calendario tra due date (indipendente da ora legale e orario)
+func calendarDays(start, end time.Time) int {
+	s := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	e := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+	return int(e.Sub(s).Hours() / 24)
+}
+
+// addMonthsClamped come EDATE di Excel: il 31 gennaio + 1 mese è l'ultimo giorno di febbraio
+func addMonthsClamped(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, 0, 0, 0, 0, t.Location())
+	day := t.Day()
+	if max := daysInMonth(first.Year(), first.Month()); day > max {
+		day = max
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, t.Location())
+}
+
+// dateDif implementa DATEDIF di Excel (unità Y, M, D, MD, YM, YD)
+func dateDif(start, end time.Time, unit string) (any, error) {
+	if calendarDays(start, end) < 0 {
+		return nil, newFormulaError("#NUM!", "DATEDIF: the start date is after the end date")
+	}
+
+	months := (end.Year()-start.Year())*12 + int(end.Month()-start.Month())
+	if end.Day() < start.Day() {
+		months--
+	}
+
+	switch unit {
+	case "D":
+		return calendarDays(start, end), nil
+	case "M":
+		return months, nil
+	case "Y":
+		return months / 12, nil
+	case "YM":
+		return months % 12, nil
+	case "MD":
+		if end.Day() >= start.Day() {
+			return end.Day() - start.Day(), nil
+		}
+		prev := time.Date(end.Year(), end.Month(), 0, 0, 0, 0, 0, time.UTC)
+		return prev.Day() - start.Day() + end.Day(), nil
+	case "YD":
+		shifted := addYearsClamped(start, end.Year()-start.Year())
+		if calendarDays(shifted, end) < 0 {
+			shifted = addYearsClamped(start, end.Year()-start.Year()-1)
+		}
+		return calendarDays(shifted, end), nil
+	default:
+		return nil, newFormulaError("#NUM!", "DATEDIF: unit %q is not supported (Y, M, D, MD, YM, YD)", unit)
+	}
+}
+
+func addYearsClamped(t time.Time, years int) time.Time {
+	return addMonthsClamped(t, years*12)
+}
@@ -0,0 +1,338 @@
+package calculatedfields
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// valori del campo number_mode (vuoto = Config.DecimalMode)
+const (
+	numberModeFloat   = "float"
+	numberModeDecimal = "decimal"
+)
+
+// modalità di arrotondamento del risultato in modalità decimale
+const (
+	RoundHalfUp   = "half_up"   // 0.125 -> 0.13, -0.125 -> -0.13
+	RoundHalfEven = "half_even" // 0.125 -> 0.12 (arrotondamento bancario)
+	RoundDown     = "down"      // verso lo zero
+	RoundUp       = "up"        // lontano dallo zero
+	RoundFloor    = "floor"     // verso -inf
+	RoundCeiling  = "ceiling"   // verso +inf
+)
+
+var roundingModes = map[string]struct{}{
+	RoundHalfUp: {}, RoundHalfEven: {}, RoundDown: {}, RoundUp: {}, RoundFloor: {}, RoundCeiling: {},
+}
+
+// cifre decimali usate per rappresentare come testo un numero razionale non finito (es. 1/3)
+const maxDecimalTextDigits = 30
+
+// limite all'esponente intero calcolato in modo esatto (oltre si passa a float64)
+const maxExactExponent = 1000
+
+// decimalMode indica se il nodo va valutato in aritmetica decimale esatta
+func decimalMode(app core.App, node *core.Record) bool {
+	switch node.GetString("number_mode") {
+	case numberModeDecimal:
+		return true
+	case numberModeFloat:
+		return false
+	default:
+		return GetConfig(app).DecimalMode
+	}
+}
+
+func ratDiv(a, b *big.Rat) (*big.Rat, error) {
+	if b.Sign() == 0 {
+		return nil, newFormulaError("#DIV/0!", "Division by zero")
+	}
+	return new(big.Rat).Quo(a, b), nil
+}
+
+// ratMod: resto con il segno del dividendo, come l'operatore % di expr
+func ratMod(a, b *big.Rat) (*big.Rat, error) {
+	if b.Sign() == 0 {
+		return nil, newFormulaError("#DIV/0!", "Division by zero")
+	}
+	q := new(big.Rat).Quo(a, b)
+	trunc := new(big.Int).Quo(q.Num(), q.Denom())
+	return new(big.Rat).Sub(a, new(big.Rat).Mul(b, new(big.Rat).SetInt(trunc))), nil
+}
+
+// ratPow: esatto per esponenti interi, altrimenti float64
+func ratPow(a, b *big.Rat) (*big.Rat, error) {
+	if b.IsInt() && b.Num().IsInt64() {
+		exp := b.Num().Int64()
+		if exp < 0 {
+			exp = -exp
+		}
+		if exp <= maxExactExponent {
+			if a.Sign() == 0 && b.Sign() < 0 {
+				return nil, newFormulaError("#DIV/0!", "Division by zero")
+			}
+			num := new(big.Int).Exp(a.Num(), big.NewInt(exp), nil)
+			den := new(big.Int).Exp(a.Denom(), big.NewInt(exp), nil)
+			if b.Sign() < 0 {
+				num, den = den, num
+			}
+			return new(big.Rat).SetFrac(num, den), nil
+		}
+	}
+
+	fa, _ := a.Float64()
+	fb, _ := b.Float64()
+	f := math.Pow(fa, fb)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, newFormulaError("#NUM!", "Invalid numeric result (%v)", f)
+	}
+	r, _ := toRat(f)
+	return r, nil
+}
+
+// precisione (bit) delle operazioni non esatte in modalità decimale (SQRT): ~150 cifre significative
+const decimalFloatPrec = 512
+
+// roundRat arrotonda r a digits cifre decimali (negative: decine, centinaia, ...) con la modalità indicata
+func roundRat(r *big.Rat, digits int, mode string) *big.Rat {
+	exp := digits
+	if exp < 0 {
+		exp = -exp
+	}
+	factor := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+	scaled := new(big.Rat).Set(r)
+	if digits >= 0 {
+		scaled.Mul(scaled, factor)
+	} else {
+		scaled.Quo(scaled, factor)
+	}
+	rounded, _ := new(big.Rat).SetString(formatDecimal(scaled, 0, mode))
+	if digits >= 0 {
+		return rounded.Quo(rounded, factor)
+	}
+	return rounded.Mul(rounded, factor)
+}
+
+// ratFloor: intero più grande <= r
+func ratFloor(r *big.Rat) *big.Rat {
+	return roundRat(r, 0, RoundFloor)
+}
+
+// ratSqrt: radice quadrata con decimalFloatPrec bit di precisione (r >= 0)
+func ratSqrt(r *big.Rat) *big.Rat {
+	f := new(big.Float).SetPrec(decimalFloatPrec).SetRat(r)
+	out, _ := new(big.Float).SetPrec(decimalFloatPrec).Sqrt(f).Rat(nil)
+	return out
+}
+
+// toRat converte un numero in *big.Rat; i float64 passano dalla rappresentazione decimale
+// più corta (0.1 -> 1/10, non 0.1000000000000000055...), come li ha scritti l'utente.
+func toRat(v any) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case *big.Rat:
+		return n, true
+	case json.Number:
+		return new(big.Rat).SetString(n.String())
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, false
+		}
+		return new(big.Rat).SetString(strconv.FormatFloat(n, 'g', -1, 64))
+	case float32:
+		return toRat(float64(n))
+	case int:
+		return new(big.Rat).SetInt64(int64(n)), true
+	case int8:
+		return new(big.Rat).SetInt64(int64(n)), true
+	case int16:
+		return new(big.Rat).SetInt64(int64(n)), true
+	case int32:
+		return new(big.Rat).SetInt64(int64(n)), true
+	case int64:
+		return new(big.Rat).SetInt64(n), true
+	case uint:
+		return new(big.Rat).SetUint64(uint64(n)), true
+	case uint8:
+		return new(big.Rat).SetUint64(uint64(n)), true
+	case uint16:
+		return new(big.Rat).SetUint64(uint64(n)), true
+	case uint32:
+		return new(big.Rat).SetUint64(uint64(n)), true
+	case uint64:
+		return new(big.Rat).SetUint64(n), true
+	default:
+		return nil, false
+	}
+}
+
+// normalizeNumbers porta i numeri dell'env nella rappresentazione della modalità del nodo:
+// *big.Rat in modalità decimale, float64 altrimenti (anche dentro array e oggetti).
+func normalizeNumbers(v any, decimal bool) any {
+	switch val := v.(type) {
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = normalizeNumbers(item, decimal)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[k] = normalizeNumbers(item, decimal)
+		}
+		return out
+	case *big.Rat:
+		if decimal {
+			return val
+		}
+		f, _ := val.Float64()
+		return f
+	case json.Number:
+		if decimal {
+			if r, ok := toRat(val); ok {
+				return r
+			}
+		}
+		f, err := val.Float64()
+		if err != nil {
+			return val.String()
+		}
+		return f
+	case float64:
+		if decimal {
+			if r, ok := toRat(val); ok {
+				return r
+			}
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+// decimalArgument porta a *big.Rat ogni numero (anche interi e dentro array) passato alla libreria
+// standard in modalità decimale, così le funzioni numeriche calcolano in modo esatto
+func decimalArgument(v any) any {
+	switch val := v.(type) {
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = decimalArgument(item)
+		}
+		return out
+	case bool, string, nil:
+		return v
+	}
+	if r, ok := toRat(v); ok {
+		return r
+	}
+	return v
+}
+
+// decimalTextRegex riconosce il testo prodotto da formatDecimal
+var decimalTextRegex = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// decimalResult arrotonda i numeri del risultato a scale cifre e li restituisce come testo ("0.30"):
+// value conserva esattamente le cifre e il dirty check di isDirty confronta stringhe stabili.
+func decimalResult(v any, scale int, mode string) any {
+	switch val := v.(type) {
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = decimalResult(item, scale, mode)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[k] = decimalResult(item, scale, mode)
+		}
+		return out
+	}
+	if r, ok := toRat(v); ok {
+		return formatDecimal(r, scale, mode)
+	}
+	return v
+}
+
+// decimalEnvValue riporta a numero (json.Number) il testo decimale salvato da un nodo decimale
+func decimalEnvValue(v any) any {
+	switch val := v.(type) {
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = decimalEnvValue(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[k] = decimalEnvValue(item)
+		}
+		return out
+	case string:
+		if decimalTextRegex.MatchString(val) {
+			return json.Number(val)
+		}
+	}
+	return v
+}
+
+// formatDecimal arrotonda r a scale cifre decimali con la modalità indicata
+func formatDecimal(r *big.Rat, scale int, mode string) string {
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow))
+
+	q, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		sign := big.NewInt(int64(scaled.Sign()))
+		// confronto 2*|resto| con il denominatore per capire se siamo oltre/sotto/esattamente a metà
+		half := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(scaled.Denom())
+
+		awayFromZero := false
+		switch mode {
+		case RoundDown:
+		case RoundUp:
+			awayFromZero = true
+		case RoundFloor:
+			awayFromZero = scaled.Sign() < 0
+		case RoundCeiling:
+			awayFromZero = scaled.Sign() > 0
+		case RoundHalfEven:
+			awayFromZero = half > 0 || (half == 0 && q.Bit(0) == 1)
+		default: // RoundHalfUp
+			awayFromZero = half >= 0
+		}
+		if awayFromZero {
+			q.Add(q, sign)
+		}
+	}
+
+	digits := new(big.Int).Abs(q).String()
+	neg := q.Sign() < 0
+	if scale > 0 {
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if neg {
+		digits = "-" + digits
+	}
+	return digits
+}
+
+// ratText: testo decimale di un *big.Rat senza zeri finali (es. per CONCAT)
+func ratText(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	s := strings.TrimRight(r.FloatString(maxDecimalTextDigits), "0")
+	return strings.TrimSuffix(s, ".")
+}
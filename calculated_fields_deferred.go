@@ -0,0 +1,94 @@
+package calculatedfields
+
+import (
+	"sync"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// changeSet raccoglie i nodi da ricalcolare di una transazione aperta con Deferred
+type changeSet struct {
+	roots []string
+	seen  map[string]struct{}
+}
+
+var (
+	changeSetsMu sync.Mutex
+	changeSets   = map[*core.TxAppInfo]*changeSet{}
+)
+
+// Deferred esegue fn in una transazione in cui i salvataggi di calculated_fields (e i ricalcoli
+// innescati da owner e aggregati) non propagano subito: i nodi modificati vengono raccolti e,
+// prima del commit, ricalcolati insieme a tutti i loro dipendenti una sola volta, in ordine topologico.
+//
+// Dentro fn i dipendenti hanno ancora i valori precedenti. Se fn o il ricalcolo falliscono non viene
+// applicato nulla. Un Deferred annidato si unisce a quello esterno; con Config.AsyncMode le formule
+// modificate restano affidate al worker.
+func Deferred(app core.App, fn func(txApp core.App) error) error {
+	return app.RunInTransaction(func(txApp core.App) error {
+		info := txApp.TxInfo()
+
+		changeSetsMu.Lock()
+		if _, active := changeSets[info]; active {
+			changeSetsMu.Unlock()
+			return fn(txApp)
+		}
+		cs := &changeSet{seen: map[string]struct{}{}}
+		changeSets[info] = cs
+		changeSetsMu.Unlock()
+		defer detachChangeSet(info)
+
+		if err := fn(txApp); err != nil {
+			return err
+		}
+
+		// i salvataggi del ricalcolo (es. owner toccati) propagano subito, come fuori da Deferred
+		detachChangeSet(info)
+		return cs.flush(txApp)
+	})
+}
+
+func detachChangeSet(info *core.TxAppInfo) {
+	changeSetsMu.Lock()
+	defer changeSetsMu.Unlock()
+	delete(changeSets, info)
+}
+
+// deferRecalculation registra i nodi nel change set della transazione, se c'è (false = ricalcolare subito)
+func deferRecalculation(txApp core.App, nodes ...*core.Record) bool {
+	info := txApp.TxInfo()
+	if info == nil {
+		return false
+	}
+
+	changeSetsMu.Lock()
+	defer changeSetsMu.Unlock()
+
+	cs, ok := changeSets[info]
+	if !ok {
+		return false
+	}
+	for _, n := range nodes {
+		if _, seen := cs.seen[n.Id]; !seen {
+			cs.seen[n.Id] = struct{}{}
+			cs.roots = append(cs.roots, n.Id)
+		}
+	}
+	return true
+}
+
+// flush ricalcola una volta sola, in ordine topologico, i nodi raccolti e i loro dipendenti
+func (cs *changeSet) flush(txApp core.App) error {
+	if len(cs.roots) == 0 {
+		return nil
+	}
+	order, err := recalculationOrder(txApp, cs.roots)
+	if err != nil {
+		return err
+	}
+	touched := ownerTouches{}
+	if err := evaluateInOrder(txApp, order, map[string]any{}, touched); err != nil {
+		return err
+	}
+	return touched.apply(txApp)
+}
@@ -0,0 +1,107 @@
+package calculatedfields
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// errDryRunRollback annulla la transazione della simulazione
+var errDryRunRollback = errors.New("calculatedfields: dry run rollback")
+
+// DryRunNode è un nodo toccato dalla modifica simulata, con valore ed errore prima e dopo
+type DryRunNode struct {
+	Id              string `json:"id"`
+	Alias           string `json:"alias"`
+	OwnerCollection string `json:"owner_collection"`
+	OwnerRow        string `json:"owner_row"`
+	OwnerField      string `json:"owner_field"`
+	OldValue        any    `json:"old_value"`
+	NewValue        any    `json:"new_value"`
+	OldError        string `json:"old_error"`
+	NewError        string `json:"new_error"`
+	OldErrorCode    string `json:"old_error_code"`
+	NewErrorCode    string `json:"new_error_code"`
+	Changed         bool   `json:"changed"`
+}
+
+// DryRunFormula simula la modifica della formula del calculated_field id: esegue risoluzione delle
+// dipendenze e ricalcolo del grafo (ResolveDepsAndTxSave + evaluateFormulaGraph) in una transazione
+// che viene sempre annullata. Restituisce il nodo e i suoi dipendenti, in ordine topologico,
+// con valore ed errore prima e dopo. Gli errori della formula (1003, 1004, 1007, 1016, ...) sono
+// gli stessi di un salvataggio reale; il ricalcolo è sempre sincrono, anche con Config.AsyncMode.
+func DryRunFormula(app core.App, id string, formula string) ([]DryRunNode, error) {
+	var nodes []DryRunNode
+
+	txErr := app.RunInTransaction(func(txApp core.App) error {
+		rec, err := txApp.FindRecordById("calculated_fields", id)
+		if err != nil {
+			return apis.NewBadRequestError("Invalid dry run", validation.Errors{
+				"id": validation.NewError("1005", fmt.Sprintf("calculated_field %s not found", id)),
+			})
+		}
+
+		// 1️⃣ stato attuale del nodo e dei suoi dipendenti
+		dependents, err := affectedSubgraph(txApp, []*core.Record{rec}, false)
+		if err != nil {
+			return err
+		}
+		before := append([]*core.Record{rec}, dependents...)
+		nodes = make([]DryRunNode, 0, len(before))
+		// copia del valore prima della pipeline, che modifica rec (before[0]) sul posto
+		oldValues := make([]string, 0, len(before))
+		for _, n := range before {
+			oldValues = append(oldValues, n.GetString("value"))
+			nodes = append(nodes, DryRunNode{
+				Id:              n.Id,
+				Alias:           n.GetString("alias"),
+				OwnerCollection: n.GetString("owner_collection"),
+				OwnerRow:        n.GetString("owner_row"),
+				OwnerField:      n.GetString("owner_field"),
+				OldValue:        decodeNodeValue(n),
+				OldError:        n.GetString("error"),
+				OldErrorCode:    n.GetString("error_code"),
+			})
+		}
+
+		// 2️⃣ la pipeline di un salvataggio reale
+		rec.Set("formula", formula)
+		env, err := ResolveDepsAndTxSave(txApp, rec)
+		if err != nil {
+			return err
+		}
+		if err := evaluateFormulaGraph(txApp, rec, env); err != nil {
+			return err
+		}
+
+		// 3️⃣ nuovi valori, letti nella stessa transazione
+		for i := range nodes {
+			after, err := txApp.FindRecordById("calculated_fields", nodes[i].Id)
+			if err != nil {
+				return err
+			}
+			nodes[i].NewValue = decodeNodeValue(after)
+			nodes[i].NewError = after.GetString("error")
+			nodes[i].NewErrorCode = after.GetString("error_code")
+			nodes[i].Changed = after.GetString("value") != oldValues[i] || nodes[i].NewError != nodes[i].OldError
+		}
+		return errDryRunRollback
+	})
+	if !errors.Is(txErr, errDryRunRollback) {
+		return nil, txErr
+	}
+	return nodes, nil
+}
+
+// decodeNodeValue restituisce il valore JSON del nodo (nil se vuoto o non valido)
+func decodeNodeValue(n *core.Record) any {
+	var v any
+	if err := json.Unmarshal([]byte(n.GetString("value")), &v); err != nil {
+		return nil
+	}
+	return v
+}
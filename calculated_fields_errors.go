@@ -0,0 +1,105 @@
+package calculatedfields
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// funzioni che ricevono i valori di errore senza propagarli automaticamente
+var errorAwareFunctions = map[string]bool{
+	"IF":      true, // propaga solo se la condizione è in errore, il ramo scelto passa com'è
+	"IFERROR": true,
+	"IFNA":    true,
+	"ISERROR": true,
+	"ISNA":    true,
+}
+
+// errorValueFunction adatta una funzione di formula alla propagazione "da foglio di calcolo":
+// un argomento in errore viene restituito così com'è (il primo, anche dentro un array) e un
+// *FormulaError restituito dalla funzione diventa un valore, intercettabile da IFERROR/IFNA.
+func errorValueFunction(name string, fn func(args ...any) (any, error)) func(args ...any) (any, error) {
+	return func(args ...any) (any, error) {
+		if !errorAwareFunctions[name] {
+			if fe := firstErrorValue(flattenArgs(args)); fe != nil {
+				return fe, nil
+			}
+		}
+		return errorAsValue(fn(args...))
+	}
+}
+
+// errorAsValue trasforma un *FormulaError restituito come errore in un valore di errore
+func errorAsValue(v any, err error) (any, error) {
+	var fe *FormulaError
+	if errors.As(err, &fe) {
+		return fe, nil
+	}
+	return v, err
+}
+
+func firstErrorValue(args []any) *FormulaError {
+	for _, a := range args {
+		if fe, ok := a.(*FormulaError); ok {
+			return fe
+		}
+	}
+	return nil
+}
+
+// findErrorValue cerca un valore di errore nel risultato (anche dentro array e oggetti)
+func findErrorValue(v any) *FormulaError {
+	switch val := v.(type) {
+	case *FormulaError:
+		return val
+	case []any:
+		for _, item := range val {
+			if fe := findErrorValue(item); fe != nil {
+				return fe
+			}
+		}
+	case map[string]any:
+		for _, k := range sortedKeys(val) {
+			if fe := findErrorValue(val[k]); fe != nil {
+				return fe
+			}
+		}
+	}
+	return nil
+}
+
+// upstreamErrors restituisce, per ogni dipendenza che vale un codice di errore, l'errore da ereditare.
+// La sorgente è il nodo in cui l'errore è nato (non l'ultimo intermedio della catena).
+func upstreamErrors(node *core.Record, env map[string]any) map[string]*FormulaError {
+	var result map[string]*FormulaError
+	for _, dep := range node.ExpandedAll("depends_on") {
+		code, ok := env[dep.Id].(string)
+		if !ok || !formulaErrorCodes[code] {
+			continue
+		}
+
+		if result == nil {
+			result = map[string]*FormulaError{}
+		}
+		result[dep.Id] = inheritedError(dep, code)
+	}
+	return result
+}
+
+// inheritedError: l'errore del nodo dep visto da un suo dipendente
+func inheritedError(dep *core.Record, code string) *FormulaError {
+	fe := &FormulaError{Code: code, Message: dep.GetString("error"), Source: dep.GetString("error_source")}
+	if fe.Source == "" {
+		fe.Source = dep.Id
+		fe.Message = fmt.Sprintf("Inherited error from %s: %s", dep.Id, dep.GetString("error"))
+	}
+	return fe
+}
+
+// setErrorSource registra il nodo da cui proviene l'errore ereditato (vuoto = nessun errore o errore proprio)
+func setErrorSource(app core.App, node *core.Record, source string) {
+	if hasCalculatedFieldsField(app, "error_source") {
+		node.Set("error_source", source)
+	}
+}
@@ -0,0 +1,707 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FormulaError è l'errore "da foglio di calcolo" che una funzione di formula può restituire:
+// Code diventa il value del nodo (es. #VALUE!) e Message il campo error.
+// Durante la valutazione circola anche come valore, così IFERROR/IFNA possono intercettarlo.
+type FormulaError struct {
+	Code    string
+	Message string
+	// Source è l'id del nodo da cui l'errore è stato ereditato (vuoto se nasce nel nodo stesso)
+	Source string
+}
+
+func (e *FormulaError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newFormulaError(code, format string, args ...any) *FormulaError {
+	return &FormulaError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// formulaFunction è la firma delle funzioni della libreria standard (argomenti variadici, validati a runtime)
+type formulaFunction func(args ...any) (any, error)
+
+// standardFunctions è la libreria "Excel-compatibile" disponibile in ogni formula.
+// I nomi sono MAIUSCOLI per non collidere con i builtin di expr (sum, max, len, ...).
+var standardFunctions = map[string]formulaFunction{
+	// logiche
+	"IF":       fnIf,
+	"IFERROR":  fnIfError,
+	"IFNA":     fnIfNA,
+	"ISERROR":  fnIsError,
+	"ISNA":     fnIsNA,
+	"AND":      fnAnd,
+	"OR":       fnOr,
+	"NOT":      fnNot,
+	"COALESCE": fnCoalesce,
+
+	// numeriche
+	"ABS":       fnAbs,
+	"ROUND":     roundWith("ROUND", math.Round, RoundHalfUp),
+	"ROUNDUP":   roundWith("ROUNDUP", roundAwayFromZero, RoundUp),
+	"ROUNDDOWN": roundWith("ROUNDDOWN", math.Trunc, RoundDown),
+	"INT":       fnInt,
+	"MOD":       fnMod,
+	"POWER":     fnPower,
+	"SQRT":      fnSqrt,
+	"SUM":       fnSum,
+	"AVERAGE":   fnAverage,
+	"MIN":       fnMin,
+	"MAX":       fnMax,
+
+	// testo
+	"CONCAT": fnConcat,
+	"LEFT":   fnLeft,
+	"RIGHT":  fnRight,
+	"MID":    fnMid,
+	"LEN":    fnLen,
+	"UPPER":  stringWith("UPPER", strings.ToUpper),
+	"LOWER":  stringWith("LOWER", strings.ToLower),
+	"TRIM":   stringWith("TRIM", strings.TrimSpace),
+}
+
+// ----- validazione argomenti -----
+
+func expectArgs(name string, args []any, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		switch {
+		case max < 0:
+			return newFormulaError("#VALUE!", "%s requires at least %d arguments, got %d", name, min, len(args))
+		case min == max:
+			return newFormulaError("#VALUE!", "%s requires %d arguments, got %d", name, min, len(args))
+		default:
+			return newFormulaError("#VALUE!", "%s requires %d to %d arguments, got %d", name, min, max, len(args))
+		}
+	}
+	return nil
+}
+
+// toNumber converte un argomento in float64: solo numeri, niente conversioni implicite da stringa
+func toNumber(name string, pos int, v any) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int8:
+		return float64(n), nil
+	case int16:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint:
+		return float64(n), nil
+	case uint8:
+		return float64(n), nil
+	case uint16:
+		return float64(n), nil
+	case uint32:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case *big.Rat: // modalità decimale
+		f, _ := n.Float64()
+		return f, nil
+	case nil:
+		return 0, newFormulaError("#N/A", "%s: argument %d is not available (null)", name, pos)
+	default:
+		return 0, newFormulaError("#VALUE!", "%s: argument %d must be a number, got %T", name, pos, v)
+	}
+}
+
+func toInteger(name string, pos int, v any) (int, error) {
+	f, err := toNumber(name, pos, v)
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) {
+		return 0, newFormulaError("#VALUE!", "%s: argument %d must be an integer, got %v", name, pos, f)
+	}
+	return int(f), nil
+}
+
+func toText(name string, pos int, v any) (string, error) {
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case nil:
+		return "", newFormulaError("#N/A", "%s: argument %d is not available (null)", name, pos)
+	default:
+		return "", newFormulaError("#VALUE!", "%s: argument %d must be a text, got %T", name, pos, v)
+	}
+}
+
+// toBool: booleani, oppure numeri (0 = falso) come in Excel
+func toBool(name string, pos int, v any) (bool, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	f, err := toNumber(name, pos, v)
+	if err != nil {
+		return false, newFormulaError("#VALUE!", "%s: argument %d must be a boolean, got %T", name, pos, v)
+	}
+	return f != 0, nil
+}
+
+// flattenArgs espande gli array (es. SUM([a, b], c)) in una lista piatta di valori
+func flattenArgs(args []any) []any {
+	flat := make([]any, 0, len(args))
+	for _, a := range args {
+		rv := reflect.ValueOf(a)
+		if a != nil && (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) {
+			items := make([]any, rv.Len())
+			for i := range items {
+				items[i] = rv.Index(i).Interface()
+			}
+			flat = append(flat, flattenArgs(items)...)
+			continue
+		}
+		flat = append(flat, a)
+	}
+	return flat
+}
+
+func numbers(name string, args []any) ([]float64, error) {
+	flat := flattenArgs(args)
+	nums := make([]float64, 0, len(flat))
+	for i, v := range flat {
+		f, err := toNumber(name, i+1, v)
+		if err != nil {
+			return nil, err
+		}
+		nums = append(nums, f)
+	}
+	return nums, nil
+}
+
+// ratNumbers: come numbers, ma esatti; ok è false se nessun argomento è *big.Rat (modalità float)
+func ratNumbers(name string, args []any) (nums []*big.Rat, ok bool, err error) {
+	flat := flattenArgs(args)
+	for _, v := range flat {
+		if _, isRat := v.(*big.Rat); isRat {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	nums = make([]*big.Rat, 0, len(flat))
+	for i, v := range flat {
+		r, isNum := toRat(v)
+		if !isNum {
+			_, err := toNumber(name, i+1, v)
+			return nil, true, err
+		}
+		nums = append(nums, r)
+	}
+	return nums, true, nil
+}
+
+// isErrorValue riconosce i valori di errore (#DIV/0!, #REF!, ...) e i float non finiti
+func isErrorValue(v any) bool {
+	switch val := v.(type) {
+	case *FormulaError:
+		return true
+	case string:
+		return formulaErrorCodes[val]
+	case float64:
+		return math.IsInf(val, 0) || math.IsNaN(val)
+	}
+	return false
+}
+
+var formulaErrorCodes = map[string]bool{
+	"#NAME?": true, "#REF!": true, "#VALUE!": true, "#NUM!": true,
+	"#DIV/0!": true, "#N/A": true, "#NULL!": true,
+}
+
+// ----- logiche -----
+
+func fnIf(args ...any) (any, error) {
+	if err := expectArgs("IF", args, 2, 3); err != nil {
+		return nil, err
+	}
+	if fe, ok := args[0].(*FormulaError); ok {
+		return fe, nil
+	}
+	cond, err := toBool("IF", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if cond {
+		return args[1], nil
+	}
+	if len(args) == 3 {
+		return args[2], nil
+	}
+	return false, nil
+}
+
+func fnIfError(args ...any) (any, error) {
+	if err := expectArgs("IFERROR", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if isErrorValue(args[0]) {
+		return args[1], nil
+	}
+	return args[0], nil
+}
+
+// isNAValue: #N/A come valore propagato o come testo
+func isNAValue(v any) bool {
+	switch val := v.(type) {
+	case *FormulaError:
+		return val.Code == "#N/A"
+	case string:
+		return val == "#N/A"
+	}
+	return false
+}
+
+func fnIfNA(args ...any) (any, error) {
+	if err := expectArgs("IFNA", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if isNAValue(args[0]) {
+		return args[1], nil
+	}
+	return args[0], nil
+}
+
+func fnIsError(args ...any) (any, error) {
+	if err := expectArgs("ISERROR", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return isErrorValue(args[0]), nil
+}
+
+func fnIsNA(args ...any) (any, error) {
+	if err := expectArgs("ISNA", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return isNAValue(args[0]), nil
+}
+
+func fnAnd(args ...any) (any, error) {
+	if err := expectArgs("AND", args, 1, -1); err != nil {
+		return nil, err
+	}
+	for i, a := range flattenArgs(args) {
+		b, err := toBool("AND", i+1, a)
+		if err != nil {
+			return nil, err
+		}
+		if !b {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func fnOr(args ...any) (any, error) {
+	if err := expectArgs("OR", args, 1, -1); err != nil {
+		return nil, err
+	}
+	for i, a := range flattenArgs(args) {
+		b, err := toBool("OR", i+1, a)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func fnNot(args ...any) (any, error) {
+	if err := expectArgs("NOT", args, 1, 1); err != nil {
+		return nil, err
+	}
+	b, err := toBool("NOT", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return !b, nil
+}
+
+// COALESCE restituisce il primo argomento non nullo e non vuoto
+func fnCoalesce(args ...any) (any, error) {
+	if err := expectArgs("COALESCE", args, 1, -1); err != nil {
+		return nil, err
+	}
+	for _, a := range args {
+		if a == nil {
+			continue
+		}
+		if s, ok := a.(string); ok && s == "" {
+			continue
+		}
+		return a, nil
+	}
+	return nil, nil
+}
+
+// ----- numeriche -----
+
+func fnAbs(args ...any) (any, error) {
+	if err := expectArgs("ABS", args, 1, 1); err != nil {
+		return nil, err
+	}
+	if r, ok := args[0].(*big.Rat); ok {
+		return new(big.Rat).Abs(r), nil
+	}
+	f, err := toNumber("ABS", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return math.Abs(f), nil
+}
+
+func roundAwayFromZero(f float64) float64 {
+	if f < 0 {
+		return math.Floor(f)
+	}
+	return math.Ceil(f)
+}
+
+// roundWith costruisce ROUND/ROUNDUP/ROUNDDOWN(x, [cifre]) con la funzione di arrotondamento indicata
+// (mode è la modalità equivalente per i *big.Rat della modalità decimale)
+func roundWith(name string, round func(float64) float64, mode string) formulaFunction {
+	return func(args ...any) (any, error) {
+		if err := expectArgs(name, args, 1, 2); err != nil {
+			return nil, err
+		}
+		f, err := toNumber(name, 1, args[0])
+		if err != nil {
+			return nil, err
+		}
+		digits := 0
+		if len(args) == 2 {
+			if digits, err = toInteger(name, 2, args[1]); err != nil {
+				return nil, err
+			}
+		}
+		if r, ok := args[0].(*big.Rat); ok {
+			return roundRat(r, digits, mode), nil
+		}
+		scale := math.Pow(10, float64(digits))
+		// il passaggio da stringa elimina l'errore di rappresentazione (es. 1.005 * 100 = 100.49999...)
+		scaled, _ := strconv.ParseFloat(strconv.FormatFloat(f*scale, 'g', 12, 64), 64)
+		return round(scaled) / scale, nil
+	}
+}
+
+func fnInt(args ...any) (any, error) {
+	if err := expectArgs("INT", args, 1, 1); err != nil {
+		return nil, err
+	}
+	if r, ok := args[0].(*big.Rat); ok {
+		return ratFloor(r), nil
+	}
+	f, err := toNumber("INT", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return math.Floor(f), nil
+}
+
+// MOD segue il segno del divisore, come in Excel
+func fnMod(args ...any) (any, error) {
+	if err := expectArgs("MOD", args, 2, 2); err != nil {
+		return nil, err
+	}
+	a, err := toNumber("MOD", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := toNumber("MOD", 2, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if b == 0 {
+		return nil, newFormulaError("#DIV/0!", "MOD: division by zero")
+	}
+	if nums, ok, _ := ratNumbers("MOD", args); ok {
+		q := ratFloor(new(big.Rat).Quo(nums[0], nums[1]))
+		return new(big.Rat).Sub(nums[0], q.Mul(q, nums[1])), nil
+	}
+	return a - b*math.Floor(a/b), nil
+}
+
+func fnPower(args ...any) (any, error) {
+	if err := expectArgs("POWER", args, 2, 2); err != nil {
+		return nil, err
+	}
+	a, err := toNumber("POWER", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := toNumber("POWER", 2, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if nums, ok, _ := ratNumbers("POWER", args); ok {
+		return ratPow(nums[0], nums[1])
+	}
+	r := math.Pow(a, b)
+	if math.IsNaN(r) || math.IsInf(r, 0) {
+		return nil, newFormulaError("#NUM!", "POWER: invalid result for %v^%v", a, b)
+	}
+	return r, nil
+}
+
+func fnSqrt(args ...any) (any, error) {
+	if err := expectArgs("SQRT", args, 1, 1); err != nil {
+		return nil, err
+	}
+	f, err := toNumber("SQRT", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if f < 0 {
+		return nil, newFormulaError("#NUM!", "SQRT: negative argument (%v)", f)
+	}
+	if r, ok := args[0].(*big.Rat); ok {
+		return ratSqrt(r), nil
+	}
+	return math.Sqrt(f), nil
+}
+
+func fnSum(args ...any) (any, error) {
+	if rats, ok, err := ratNumbers("SUM", args); ok {
+		if err != nil {
+			return nil, err
+		}
+		return ratSum(rats), nil
+	}
+	nums, err := numbers("SUM", args)
+	if err != nil {
+		return nil, err
+	}
+	total := 0.0
+	for _, n := range nums {
+		total += n
+	}
+	return total, nil
+}
+
+// ratSum: somma esatta
+func ratSum(nums []*big.Rat) *big.Rat {
+	total := new(big.Rat)
+	for _, n := range nums {
+		total.Add(total, n)
+	}
+	return total
+}
+
+func fnAverage(args ...any) (any, error) {
+	if rats, ok, err := ratNumbers("AVERAGE", args); ok {
+		if err != nil {
+			return nil, err
+		}
+		total := ratSum(rats)
+		return total.Quo(total, new(big.Rat).SetInt64(int64(len(rats)))), nil
+	}
+	nums, err := numbers("AVERAGE", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(nums) == 0 {
+		return nil, newFormulaError("#DIV/0!", "AVERAGE: no values")
+	}
+	total := 0.0
+	for _, n := range nums {
+		total += n
+	}
+	return total / float64(len(nums)), nil
+}
+
+// ratExtreme: il minimo (sign < 0) o il massimo (sign > 0) dei valori (almeno uno)
+func ratExtreme(nums []*big.Rat, sign int) *big.Rat {
+	m := nums[0]
+	for _, n := range nums[1:] {
+		if n.Cmp(m)*sign > 0 {
+			m = n
+		}
+	}
+	return m
+}
+
+func fnMin(args ...any) (any, error) {
+	if rats, ok, err := ratNumbers("MIN", args); ok {
+		if err != nil {
+			return nil, err
+		}
+		return ratExtreme(rats, -1), nil
+	}
+	nums, err := numbers("MIN", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(nums) == 0 {
+		return nil, newFormulaError("#VALUE!", "MIN requires at least one value")
+	}
+	m := nums[0]
+	for _, n := range nums[1:] {
+		m = math.Min(m, n)
+	}
+	return m, nil
+}
+
+func fnMax(args ...any) (any, error) {
+	if rats, ok, err := ratNumbers("MAX", args); ok {
+		if err != nil {
+			return nil, err
+		}
+		return ratExtreme(rats, 1), nil
+	}
+	nums, err := numbers("MAX", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(nums) == 0 {
+		return nil, newFormulaError("#VALUE!", "MAX requires at least one value")
+	}
+	m := nums[0]
+	for _, n := range nums[1:] {
+		m = math.Max(m, n)
+	}
+	return m, nil
+}
+
+// ----- testo -----
+
+func fnConcat(args ...any) (any, error) {
+	var b strings.Builder
+	for _, a := range flattenArgs(args) {
+		if a == nil {
+			continue
+		}
+		if f, ok := a.(float64); ok {
+			b.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
+			continue
+		}
+		if r, ok := a.(*big.Rat); ok {
+			b.WriteString(ratText(r))
+			continue
+		}
+		b.WriteString(fmt.Sprint(a))
+	}
+	return b.String(), nil
+}
+
+func fnLeft(args ...any) (any, error) {
+	s, n, err := textAndCount("LEFT", args)
+	if err != nil {
+		return nil, err
+	}
+	r := []rune(s)
+	if n > len(r) {
+		n = len(r)
+	}
+	return string(r[:n]), nil
+}
+
+func fnRight(args ...any) (any, error) {
+	s, n, err := textAndCount("RIGHT", args)
+	if err != nil {
+		return nil, err
+	}
+	r := []rune(s)
+	if n > len(r) {
+		n = len(r)
+	}
+	return string(r[len(r)-n:]), nil
+}
+
+// textAndCount valida LEFT/RIGHT(testo, [n]) con n >= 0 (default 1)
+func textAndCount(name string, args []any) (string, int, error) {
+	if err := expectArgs(name, args, 1, 2); err != nil {
+		return "", 0, err
+	}
+	s, err := toText(name, 1, args[0])
+	if err != nil {
+		return "", 0, err
+	}
+	n := 1
+	if len(args) == 2 {
+		if n, err = toInteger(name, 2, args[1]); err != nil {
+			return "", 0, err
+		}
+	}
+	if n < 0 {
+		return "", 0, newFormulaError("#VALUE!", "%s: the number of characters cannot be negative", name)
+	}
+	return s, n, nil
+}
+
+// MID(testo, inizio, n): inizio parte da 1 come in Excel
+func fnMid(args ...any) (any, error) {
+	if err := expectArgs("MID", args, 3, 3); err != nil {
+		return nil, err
+	}
+	s, err := toText("MID", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	start, err := toInteger("MID", 2, args[1])
+	if err != nil {
+		return nil, err
+	}
+	n, err := toInteger("MID", 3, args[2])
+	if err != nil {
+		return nil, err
+	}
+	if start < 1 || n < 0 {
+		return nil, newFormulaError("#VALUE!", "MID: start must be >= 1 and length >= 0")
+	}
+	r := []rune(s)
+	if start > len(r) {
+		return "", nil
+	}
+	end := start - 1 + n
+	if end > len(r) {
+		end = len(r)
+	}
+	return string(r[start-1 : end]), nil
+}
+
+func fnLen(args ...any) (any, error) {
+	if err := expectArgs("LEN", args, 1, 1); err != nil {
+		return nil, err
+	}
+	s, err := toText("LEN", 1, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return utf8.RuneCountInString(s), nil
+}
+
+func stringWith(name string, fn func(string) string) formulaFunction {
+	return func(args ...any) (any, error) {
+		if err := expectArgs(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		s, err := toText(name, 1, args[0])
+		if err != nil {
+			return nil, err
+		}
+		return fn(s), nil
+	}
+}
@@ -0,0 +1,402 @@
+package calculatedfields
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// graphIndexStoreKey è la chiave dell'app store in cui è tenuto l'indice del grafo
+const graphIndexStoreKey = "calculatedfields.graph"
+
+// graphIndex è l'indice in memoria degli archi depends_on di tutti i calculated_fields
+// (genitori e figli per id): le visite del grafo non fanno una query per nodo.
+// Tiene anche le external_deps, per sapere senza query se qualche nodo osserva una collection,
+// e le colonne (owner_collection.owner_field): chi legge una colonna con COLUMN/LOOKUP dipende da tutte
+// le sue celle senza elencarle in depends_on.
+//
+// Le modifiche fatte dentro una transazione restano in un overlay visibile solo a quella
+// transazione e vengono applicate all'indice condiviso al commit (scartate al rollback).
+type graphIndex struct {
+	mu       sync.RWMutex
+	parents  map[string][]string
+	children map[string]map[string]struct{}
+	external map[string][]string
+	watchers map[string]map[string]struct{}
+	column   map[string]string
+	members  map[string]map[string]struct{}
+	txs      map[*core.TxAppInfo]map[string]graphEdit
+}
+
+// graphEdit è una modifica non ancora committata di un nodo
+type graphEdit struct {
+	parents  []string
+	external []string
+	column   string // "column:<collection>.<field>" della cella ("" senza owner)
+	deleted  bool
+}
+
+func newGraphIndex() *graphIndex {
+	return &graphIndex{
+		parents:  map[string][]string{},
+		children: map[string]map[string]struct{}{},
+		external: map[string][]string{},
+		watchers: map[string]map[string]struct{}{},
+		column:   map[string]string{},
+		members:  map[string]map[string]struct{}{},
+		txs:      map[*core.TxAppInfo]map[string]graphEdit{},
+	}
+}
+
+// graphIndexOf restituisce l'indice dell'app, costruendolo dal database al primo uso
+func graphIndexOf(app core.App) *graphIndex {
+	if g, ok := app.Store().Get(graphIndexStoreKey).(*graphIndex); ok {
+		return g
+	}
+	g, err := loadGraphIndex(app)
+	if err != nil {
+		app.Logger().Error("calculatedfields: failed to build the graph index", "error", err)
+		return newGraphIndex()
+	}
+	app.Store().Set(graphIndexStoreKey, g)
+	return g
+}
+
+// RebuildGraphIndex ricostruisce dal database l'indice in memoria del grafo delle dipendenze
+// (ad esempio dopo modifiche di depends_on fatte direttamente a db).
+func RebuildGraphIndex(app core.App) error {
+	g, err := loadGraphIndex(app)
+	if err != nil {
+		return err
+	}
+	app.Store().Set(graphIndexStoreKey, g)
+	return nil
+}
+
+func loadGraphIndex(app core.App) (*graphIndex, error) {
+	g := newGraphIndex()
+	if _, err := app.FindCachedCollectionByNameOrId("calculated_fields"); err != nil {
+		// schema non ancora creato: grafo vuoto
+		return g, nil
+	}
+
+	columns := []string{"id", "depends_on", "owner_collection", "owner_field"}
+	if hasCalculatedFieldsField(app, "external_deps") {
+		columns = append(columns, "(CASE WHEN json_valid([[external_deps]]) THEN [[external_deps]] ELSE '[]' END) AS external_deps")
+	}
+
+	rows := []struct {
+		Id              string                  `db:"id"`
+		DependsOn       types.JSONArray[string] `db:"depends_on"`
+		OwnerCollection string                  `db:"owner_collection"`
+		OwnerField      string                  `db:"owner_field"`
+		ExternalDeps    types.JSONArray[string] `db:"external_deps"`
+	}{}
+	err := app.DB().Select(columns...).From("calculated_fields").All(&rows)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to load calculated_fields graph: %w", err)
+	}
+	for _, row := range rows {
+		g.applyLocked(row.Id, graphEdit{
+			parents:  row.DependsOn,
+			external: row.ExternalDeps,
+			column:   columnKey(row.OwnerCollection, row.OwnerField),
+		})
+	}
+	return g, nil
+}
+
+// bindGraphIndex costruisce l'indice al bootstrap (o subito, se l'app è già avviata)
+func bindGraphIndex(app core.App) {
+	if app.IsBootstrapped() {
+		if err := RebuildGraphIndex(app); err != nil {
+			app.Logger().Error("calculatedfields: failed to build the graph index", "error", err)
+		}
+	}
+
+	app.OnBootstrap().BindFunc(func(e *core.BootstrapEvent) error {
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return RebuildGraphIndex(e.App)
+	})
+}
+
+// applyLocked applica una modifica all'indice condiviso (g.mu già acquisito in scrittura)
+func (g *graphIndex) applyLocked(id string, edit graphEdit) {
+	for _, p := range g.parents[id] {
+		delete(g.children[p], id)
+		if len(g.children[p]) == 0 {
+			delete(g.children, p)
+		}
+	}
+	delete(g.parents, id)
+	for _, dep := range g.external[id] {
+		delete(g.watchers[dep], id)
+		if len(g.watchers[dep]) == 0 {
+			delete(g.watchers, dep)
+		}
+	}
+	delete(g.external, id)
+	if col, ok := g.column[id]; ok {
+		delete(g.members[col], id)
+		if len(g.members[col]) == 0 {
+			delete(g.members, col)
+		}
+		delete(g.column, id)
+	}
+	if edit.deleted {
+		return
+	}
+
+	if edit.column != "" {
+		g.column[id] = edit.column
+		if g.members[edit.column] == nil {
+			g.members[edit.column] = map[string]struct{}{}
+		}
+		g.members[edit.column][id] = struct{}{}
+	}
+
+	if len(edit.external) > 0 {
+		g.external[id] = slices.Clone(edit.external)
+		for _, dep := range edit.external {
+			if g.watchers[dep] == nil {
+				g.watchers[dep] = map[string]struct{}{}
+			}
+			g.watchers[dep][id] = struct{}{}
+		}
+	}
+
+	parents := slices.Clone(edit.parents)
+	g.parents[id] = parents
+	for _, p := range parents {
+		if g.children[p] == nil {
+			g.children[p] = map[string]struct{}{}
+		}
+		g.children[p][id] = struct{}{}
+	}
+}
+
+// record registra una modifica: subito fuori da una transazione, al commit dentro una transazione
+func (g *graphIndex) record(app core.App, id string, edit graphEdit) {
+	info := app.TxInfo()
+	if info == nil {
+		g.mu.Lock()
+		g.applyLocked(id, edit)
+		g.mu.Unlock()
+		return
+	}
+
+	g.mu.Lock()
+	overlay, ok := g.txs[info]
+	if !ok {
+		overlay = map[string]graphEdit{}
+		g.txs[info] = overlay
+	}
+	overlay[id] = edit
+	g.mu.Unlock()
+
+	if !ok {
+		info.OnComplete(func(txErr error) error {
+			g.complete(info, txErr == nil)
+			return nil
+		})
+	}
+}
+
+// complete applica (commit) o scarta (rollback) l'overlay della transazione
+func (g *graphIndex) complete(info *core.TxAppInfo, commit bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	overlay := g.txs[info]
+	delete(g.txs, info)
+	if !commit {
+		return
+	}
+	for id, edit := range overlay {
+		g.applyLocked(id, edit)
+	}
+}
+
+// setEdges registra depends_on, external_deps e colonna attuali del nodo
+func (g *graphIndex) setEdges(app core.App, id string, parents, external []string, column string) {
+	g.record(app, id, graphEdit{parents: slices.Clone(parents), external: slices.Clone(external), column: column})
+}
+
+// remove toglie il nodo (eliminato) dall'indice
+func (g *graphIndex) remove(app core.App, id string) {
+	g.record(app, id, graphEdit{deleted: true})
+}
+
+// parentsOf restituisce i genitori del nodo visti dall'app (transazione compresa):
+// i depends_on più le celle delle colonne che legge
+func (g *graphIndex) parentsOf(app core.App, id string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	overlay := g.txs[app.TxInfo()]
+	edit, ok := overlay[id]
+	if !ok {
+		edit = graphEdit{parents: g.parents[id], external: g.external[id]}
+	}
+	if edit.deleted {
+		return nil
+	}
+
+	parents := slices.Clone(edit.parents)
+	seen := make(map[string]struct{}, len(parents))
+	for _, p := range parents {
+		seen[p] = struct{}{}
+	}
+	for _, dep := range edit.external {
+		if !strings.HasPrefix(dep, columnDepPrefix) {
+			continue
+		}
+		members := g.selectLocked(overlay, g.members[dep], func(e graphEdit) bool { return e.column == dep })
+		slices.Sort(members)
+		for _, member := range members {
+			if _, dup := seen[member]; !dup && member != id {
+				seen[member] = struct{}{}
+				parents = append(parents, member)
+			}
+		}
+	}
+	return parents
+}
+
+// childrenOf restituisce, ordinati, gli id dei nodi che dipendono direttamente da id
+// (depends_on o lettura della sua colonna)
+func (g *graphIndex) childrenOf(app core.App, id string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	overlay := g.txs[app.TxInfo()]
+	children := g.selectLocked(overlay, g.children[id], func(e graphEdit) bool { return slices.Contains(e.parents, id) })
+
+	column := g.column[id]
+	if edit, ok := overlay[id]; ok {
+		column = edit.column
+	}
+	if column != "" {
+		readers := g.selectLocked(overlay, g.watchers[column], func(e graphEdit) bool { return slices.Contains(e.external, column) })
+		for _, reader := range readers {
+			if reader != id && !slices.Contains(children, reader) {
+				children = append(children, reader)
+			}
+		}
+	}
+	slices.Sort(children)
+	return children
+}
+
+// selectLocked unisce gli id dell'indice condiviso non modificati nella transazione
+// e quelli dell'overlay che soddisfano match (g.mu già acquisito)
+func (g *graphIndex) selectLocked(overlay map[string]graphEdit, shared map[string]struct{}, match func(graphEdit) bool) []string {
+	ids := []string{}
+	for id := range shared {
+		if _, edited := overlay[id]; !edited {
+			ids = append(ids, id)
+		}
+	}
+	for id, edit := range overlay {
+		if !edit.deleted && match(edit) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// hasExternalDependents indica se almeno un nodo ha dep tra le external_deps (transazione compresa)
+func (g *graphIndex) hasExternalDependents(app core.App, dep string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	overlay := g.txs[app.TxInfo()]
+	return len(g.selectLocked(overlay, g.watchers[dep], func(e graphEdit) bool { return slices.Contains(e.external, dep) })) > 0
+}
+
+// ancestorsOf restituisce tutti i nodi da cui id dipende, anche indirettamente (id escluso)
+func (g *graphIndex) ancestorsOf(app core.App, id string) []string {
+	return g.walk(app, id, g.parentsOf)
+}
+
+// descendantsOf restituisce tutti i nodi che dipendono da id, anche indirettamente (id escluso),
+// senza limiti di propagazione e anche in presenza di cicli
+func (g *graphIndex) descendantsOf(app core.App, id string) []string {
+	return g.walk(app, id, g.childrenOf)
+}
+
+// walk visita in ampiezza gli archi restituiti da next a partire da id (id escluso)
+func (g *graphIndex) walk(app core.App, id string, next func(core.App, string) []string) []string {
+	visited := map[string]struct{}{id: {}}
+	found := []string{}
+	queue := []string{id}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, n := range next(app, cur) {
+			if _, seen := visited[n]; seen {
+				continue
+			}
+			visited[n] = struct{}{}
+			found = append(found, n)
+			queue = append(queue, n)
+		}
+	}
+	return found
+}
+
+// indexDependsOn allinea l'indice a depends_on, external_deps e colonna del record appena salvato
+func indexDependsOn(app core.App, rec *core.Record) {
+	external := []string{}
+	if hasCalculatedFieldsField(app, "external_deps") {
+		_ = rec.UnmarshalJSONField("external_deps", &external)
+	}
+	column := columnKey(rec.GetString("owner_collection"), rec.GetString("owner_field"))
+	graphIndexOf(app).setEdges(app, rec.Id, rec.GetStringSlice("depends_on"), external, column)
+}
+
+// columnKey è la chiave della colonna di una cella, nel formato di external_deps ("" senza owner)
+func columnKey(collection, field string) string {
+	if collection == "" || field == "" {
+		return ""
+	}
+	return columnRef{collection: collection, field: field}.dep()
+}
+
+// saveNodeWithoutHooks salva un calculated_field senza hook e ne aggiorna gli archi nell'indice
+func saveNodeWithoutHooks(app core.App, rec *core.Record) error {
+	if err := app.UnsafeWithoutHooks().Save(rec); err != nil {
+		return err
+	}
+	indexDependsOn(app, rec)
+	return nil
+}
+
+// findNodesByIds carica in una sola query i nodi indicati, riusando quelli già in pool
+func findNodesByIds(app core.App, pool map[string]*core.Record, ids []string) error {
+	missing := []string{}
+	for _, id := range ids {
+		if _, ok := pool[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	records, err := app.FindRecordsByIds("calculated_fields", missing)
+	if err != nil {
+		return fmt.Errorf("failed to load calculated_fields %v: %w", missing, err)
+	}
+	for _, r := range records {
+		pool[r.Id] = r
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// jsFunctionTimeout limita la durata di una singola chiamata a una funzione JS:
+// la valutazione avviene dentro una transazione, un loop infinito la bloccherebbe.
+const jsFunctionTimeout = 2 * time.Second
+
+// BindJSVM espone $calculatedFields nel runtime JS di PocketBase (pb_hooks), per esempio:
+//
+//	$calculatedFields.registerFunction("margin", (price, cost) => (price - cost) / price)
+//	$calculatedFields.registerVolatileFunction("rand", () => Math.random())
+//	throw $calculatedFields.formulaError("#NUM!", "negative cost")
+//	$calculatedFields.registerErrorMessages("de", {DIV0: "Division durch Null"})
+//	$calculatedFields.registerErrorDetails("de", {"Division by zero": "Division durch Null"})
+//
+// Con un binario custom va passato a jsvm.Config.OnInit; con xpb viene chiamato da Plugin.OnJsvmInit.
+func BindJSVM(app core.App, vm *goja.Runtime) {
+	// un goja.Runtime non è thread-safe: le chiamate alle funzioni registrate da questo vm sono serializzate
+	mu := &sync.Mutex{}
+
+	register := func(volatile bool) func(call goja.FunctionCall) goja.Value {
+		return func(call goja.FunctionCall) goja.Value {
+			name := call.Argument(0).String()
+			callable, ok := goja.AssertFunction(call.Argument(1))
+			if !ok {
+				panic(vm.NewTypeError("$calculatedFields: the second argument of %q must be a function", name))
+			}
+
+			fn := jsFormulaFunction(vm, mu, name, callable)
+			if err := registerFunction(name, fn, volatile, nil); err != nil {
+				panic(vm.NewGoError(err))
+			}
+			app.Logger().Debug("calculatedfields: registered JS formula function", "name", name, "volatile", volatile)
+			return goja.Undefined()
+		}
+	}
+
+	obj := vm.NewObject()
+	obj.Set("registerFunction", register(false))
+	obj.Set("registerVolatileFunction", register(true))
+	obj.Set("formulaError", func(code, message string) *FormulaError {
+		if !formulaErrorCodes[code] {
+			panic(vm.NewTypeError("$calculatedFields.formulaError: unknown error code %q", code))
+		}
+		return &FormulaError{Code: code, Message: message}
+	})
+	obj.Set("registerErrorMessages", func(locale string, messages map[string]string) {
+		if err := RegisterErrorMessages(locale, messages); err != nil {
+			panic(vm.NewGoError(err))
+		}
+	})
+	obj.Set("registerErrorDetails", func(locale string, details map[string]string) {
+		if err := RegisterErrorDetails(locale, details); err != nil {
+			panic(vm.NewGoError(err))
+		}
+	})
+	vm.Set("$calculatedFields", obj)
+}
+
+// jsFormulaFunction adatta una funzione JS alla firma delle funzioni di formula
+func jsFormulaFunction(vm *goja.Runtime, mu *sync.Mutex, name string, callable goja.Callable) func(params ...any) (any, error) {
+	return func(params ...any) (result any, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		args := make([]goja.Value, len(params))
+		for i, p := range params {
+			args[i] = goToJSValue(vm, p)
+		}
+
+		timer := time.AfterFunc(jsFunctionTimeout, func() {
+			vm.Interrupt(fmt.Sprintf("%s: timeout after %s", name, jsFunctionTimeout))
+		})
+		defer func() {
+			timer.Stop()
+			vm.ClearInterrupt()
+			if r := recover(); r != nil {
+				result, err = nil, newFormulaError("#VALUE!", "%s: %v", name, r)
+			}
+		}()
+
+		v, callErr := callable(goja.Undefined(), args...)
+		if callErr != nil {
+			return nil, jsCallError(name, callErr)
+		}
+
+		out, convErr := jsToGoValue(v.Export())
+		if convErr != nil {
+			return nil, newFormulaError("#VALUE!", "%s: %v", name, convErr)
+		}
+		if f, ok := out.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			return nil, newFormulaError("#NUM!", "%s: invalid numeric result (%v)", name, f)
+		}
+		return out, nil
+	}
+}
+
+// jsCallError: $calculatedFields.formulaError(...) lanciato dal JS mantiene il suo codice, il resto è #VALUE!
+func jsCallError(name string, err error) error {
+	if ex, ok := err.(*goja.Exception); ok {
+		if fe, ok := ex.Value().Export().(*FormulaError); ok {
+			return fe
+		}
+		return newFormulaError("#VALUE!", "%s: %s", name, ex.Value().String())
+	}
+	return newFormulaError("#VALUE!", "%s: %v", name, err)
+}
+
+// goToJSValue passa al JS copie dei valori (mai riferimenti alle mappe/slice dell'env)
+func goToJSValue(vm *goja.Runtime, v any) goja.Value {
+	switch val := v.(type) {
+	case nil:
+		return goja.Null()
+	case time.Time:
+		d, err := vm.New(vm.Get("Date"), vm.ToValue(val.UnixMilli()))
+		if err != nil {
+			return goja.Null()
+		}
+		return d
+	case []any:
+		items := make([]any, len(val))
+		for i, item := range val {
+			items[i] = goToJSValue(vm, item)
+		}
+		return vm.NewArray(items...)
+	case map[string]any:
+		obj := vm.NewObject()
+		for k, item := range val {
+			obj.Set(k, goToJSValue(vm, item))
+		}
+		return obj
+	default:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			items := make([]any, rv.Len())
+			for i := range items {
+				items[i] = rv.Index(i).Interface()
+			}
+			return goToJSValue(vm, items)
+		}
+		return vm.ToValue(v)
+	}
+}
+
+// jsToGoValue normalizza il risultato JS nei tipi che il resto del plugin si aspetta
+// (numeri float64, stringhe, bool, nil, time.Time, []any, map[string]any).
+func jsToGoValue(v any) (any, error) {
+	switch val := v.(type) {
+	case nil, string, bool, float64, time.Time:
+		return val, nil
+	case int64:
+		return float64(val), nil
+	case int:
+		return float64(val), nil
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			conv, err := jsToGoValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = conv
+		}
+		return out, nil
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			conv, err := jsToGoValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = conv
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported return type %T", v)
+	}
+}
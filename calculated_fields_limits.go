@@ -0,0 +1,141 @@
+package calculatedfields
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/expr-lang/expr/vm"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// limitErrorCode è il codice delle violazioni dei limiti di valutazione (Config.Max*, EvalTimeout)
+const limitErrorCode = "1016"
+
+// limitExceededError rifiuta la modifica: il limite violato è riportato sul nodo che l'ha superato
+func limitExceededError(nodeId string, format string, args ...any) error {
+	message := fmt.Sprintf(format, args...)
+	return apis.NewBadRequestError(
+		fmt.Sprintf("Formula evaluation limit exceeded: %s", message),
+		validation.Errors{
+			nodeId: validation.NewError(limitErrorCode, message),
+		},
+	)
+}
+
+// checkFormulaLength applica Config.MaxFormulaLength (in caratteri)
+func checkFormulaLength(app core.App, rec *core.Record) error {
+	max := GetConfig(app).MaxFormulaLength
+	if max <= 0 {
+		return nil
+	}
+	if n := utf8.RuneCountInString(rec.GetString("formula")); n > max {
+		return limitExceededError(rec.Id, "Formula is %d characters long, the limit is %d", n, max)
+	}
+	return nil
+}
+
+// isNodeBudgetError indica un errore di compilazione per troppi nodi AST (Config.MaxFormulaNodes)
+func isNodeBudgetError(err error) bool {
+	return strings.Contains(err.Error(), "exceeds maximum allowed nodes")
+}
+
+// isMemoryBudgetError indica una valutazione interrotta dal budget di memoria di expr (Config.MaxMemoryBudget)
+func isMemoryBudgetError(err error) bool {
+	return strings.Contains(err.Error(), "memory budget exceeded")
+}
+
+// errEvalTimeout: la valutazione di un nodo non è finita entro la scadenza della propagazione
+var errEvalTimeout = errors.New("calculatedfields: evaluation timed out")
+
+// runProgram esegue il programma con il budget di memoria configurato (0 = nessun limite).
+// Il budget di expr conta anche le iterazioni di map/filter/reduce, non solo gli array allocati.
+//
+// Con una scadenza (non zero) l'esecuzione non la supera: allo scadere restituisce errEvalTimeout
+// e la VM, che non si può interrompere, finisce in background (limitata dal budget di memoria;
+// le query degli aggregati sono annullate dal context della scadenza).
+func runProgram(app core.App, program *vm.Program, env map[string]any, deadline time.Time) (any, error) {
+	budget := uint(GetConfig(app).MaxMemoryBudget)
+	if budget == 0 {
+		budget = ^uint(0)
+	}
+	machine := vm.VM{MemoryBudget: budget}
+	if deadline.IsZero() {
+		return machine.Run(program, env)
+	}
+
+	type runResult struct {
+		value any
+		err   error
+	}
+	done := make(chan runResult, 1)
+	go func() {
+		value, err := machine.Run(program, env)
+		done <- runResult{value, err}
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+		return nil, errEvalTimeout
+	}
+}
+
+// deadlineContext: il context delle query di una valutazione (senza scadenza se deadline è zero)
+func deadlineContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// propagationLimits sono i limiti di una propagazione nel sottografo dei dipendenti
+type propagationLimits struct {
+	maxNodes int
+	maxDepth int
+}
+
+func getPropagationLimits(app core.App) propagationLimits {
+	cfg := GetConfig(app)
+	return propagationLimits{maxNodes: cfg.MaxPropagationNodes, maxDepth: cfg.MaxDependencyDepth}
+}
+
+func (l propagationLimits) checkNodes(rootId string, n int) error {
+	if l.maxNodes > 0 && n > l.maxNodes {
+		return limitExceededError(rootId, "Propagation touches more than %d calculated fields", l.maxNodes)
+	}
+	return nil
+}
+
+func (l propagationLimits) checkDepth(nodeId string, depth int) error {
+	if l.maxDepth > 0 && depth > l.maxDepth {
+		return limitExceededError(nodeId, "Dependency chain is deeper than %d levels", l.maxDepth)
+	}
+	return nil
+}
+
+// propagationDeadline restituisce la scadenza della propagazione (zero = nessun timeout)
+func propagationDeadline(app core.App) time.Time {
+	timeout := GetConfig(app).evalTimeout()
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// checkDeadline interrompe la propagazione (e quindi la transazione) oltre Config.EvalTimeout:
+// è controllata prima di ogni nodo e dopo ogni valutazione fallita (timer della VM, query annullate)
+func checkDeadline(app core.App, deadline time.Time, nodeId string) error {
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return nil
+	}
+	return limitExceededError(nodeId, "Recalculation exceeded the timeout of %s", GetConfig(app).evalTimeout())
+}
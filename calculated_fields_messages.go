@@ -0,0 +1,367 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Codici di errore strutturati, salvati in error_code: stabili, pensati per le UI
+// (error è il dettaglio in inglese, error_message il testo del codice nella lingua della richiesta).
+const (
+	ErrorCodeDiv0  = "DIV0"
+	ErrorCodeValue = "VALUE"
+	ErrorCodeRef   = "REF"
+	ErrorCodeName  = "NAME"
+	ErrorCodeNA    = "NA"
+	ErrorCodeNum   = "NUM"
+	ErrorCodeNull  = "NULL"
+	ErrorCodeAuth  = "AUTH"
+)
+
+var errorCodes = []string{
+	ErrorCodeDiv0, ErrorCodeValue, ErrorCodeRef, ErrorCodeName,
+	ErrorCodeNA, ErrorCodeNum, ErrorCodeNull, ErrorCodeAuth,
+}
+
+// sheetErrorCodes: valore "da foglio di calcolo" -> error_code
+var sheetErrorCodes = map[string]string{
+	"#DIV/0!": ErrorCodeDiv0,
+	"#VALUE!": ErrorCodeValue,
+	"#REF!":   ErrorCodeRef,
+	"#NAME?":  ErrorCodeName,
+	"#N/A":    ErrorCodeNA,
+	"#NUM!":   ErrorCodeNum,
+	"#NULL!":  ErrorCodeNull,
+	"#AUTH!":  ErrorCodeAuth,
+}
+
+// DefaultLocale è la lingua dei messaggi quando la richiesta non ne chiede una disponibile
+const DefaultLocale = "en"
+
+var (
+	errorMessagesMu sync.RWMutex
+	// locale -> error_code -> messaggio
+	errorMessages = map[string]map[string]string{
+		"en": {
+			ErrorCodeDiv0:  "Division by zero",
+			ErrorCodeValue: "Wrong type of value",
+			ErrorCodeRef:   "Reference to a missing or invalid cell",
+			ErrorCodeName:  "Unknown function",
+			ErrorCodeNA:    "Value not available",
+			ErrorCodeNum:   "Invalid number",
+			ErrorCodeNull:  "Empty intersection",
+			ErrorCodeAuth:  "Not authorized to read one or more dependencies",
+		},
+		"it": {
+			ErrorCodeDiv0:  "Divisione per zero",
+			ErrorCodeValue: "Tipo di valore non compatibile",
+			ErrorCodeRef:   "Riferimento a una cella inesistente o non valida",
+			ErrorCodeName:  "Funzione non riconosciuta",
+			ErrorCodeNA:    "Valore non disponibile",
+			ErrorCodeNum:   "Numero non valido",
+			ErrorCodeNull:  "Intersezione vuota",
+			ErrorCodeAuth:  "Non autorizzato a leggere una o più dipendenze",
+		},
+	}
+)
+
+// RegisterErrorMessages aggiunge (o sostituisce) i messaggi di una lingua, per error_code.
+// Le chiavi mancanti ricadono sui messaggi di DefaultLocale.
+//
+// Va chiamata prima di servire richieste (es. in main, prima di app.Start()).
+func RegisterErrorMessages(locale string, messages map[string]string) error {
+	locale = normalizeLocale(locale)
+	if locale == "" {
+		return fmt.Errorf("calculatedfields: empty locale")
+	}
+
+	errorMessagesMu.Lock()
+	defer errorMessagesMu.Unlock()
+
+	catalog := errorMessages[locale]
+	if catalog == nil {
+		catalog = map[string]string{}
+		errorMessages[locale] = catalog
+	}
+	for code, msg := range messages {
+		catalog[code] = msg
+	}
+	return nil
+}
+
+// ErrorMessage restituisce il messaggio di error_code nella prima lingua disponibile tra locales
+// (es. "it-IT" prova anche "it"), altrimenti in DefaultLocale; il codice stesso se non ha messaggi.
+func ErrorMessage(code string, locales ...string) string {
+	if code == "" {
+		return ""
+	}
+
+	errorMessagesMu.RLock()
+	defer errorMessagesMu.RUnlock()
+
+	for _, locale := range append(slices.Clone(locales), DefaultLocale) {
+		locale = normalizeLocale(locale)
+		if msg, ok := errorMessages[locale][code]; ok {
+			return msg
+		}
+		if base, _, found := strings.Cut(locale, "-"); found {
+			if msg, ok := errorMessages[base][code]; ok {
+				return msg
+			}
+		}
+	}
+	return code
+}
+
+var (
+	// locale -> dettaglio inglese di error (formato fmt) -> formato tradotto, con gli stessi verbi nello stesso ordine
+	errorDetails = map[string]map[string]string{
+		"it": {
+			"%s requires at least %d arguments, got %d":                 "%s richiede almeno %d argomenti, ricevuti %d",
+			"%s requires %d arguments, got %d":                          "%s richiede %d argomenti, ricevuti %d",
+			"%s requires %d to %d arguments, got %d":                    "%s richiede da %d a %d argomenti, ricevuti %d",
+			"%s: argument %d is not available (null)":                   "%s: argomento %d non disponibile (null)",
+			"%s: argument %d must be a number, got %T":                  "%s: argomento %d deve essere un numero, ricevuto %T",
+			"%s: argument %d must be an integer, got %v":                "%s: argomento %d deve essere un intero, ricevuto %v",
+			"%s: argument %d must be a text, got %T":                    "%s: argomento %d deve essere un testo, ricevuto %T",
+			"%s: argument %d must be a boolean, got %T":                 "%s: argomento %d deve essere un booleano, ricevuto %T",
+			"%s: argument %d is not a valid date (%q)":                  "%s: argomento %d non è una data valida (%q)",
+			"%s: argument %d must be a date, got %T":                    "%s: argomento %d deve essere una data, ricevuto %T",
+			"MOD: division by zero":                                     "MOD: divisione per zero",
+			"POWER: invalid result for %v^%v":                           "POWER: risultato non valido per %v^%v",
+			"SQRT: negative argument (%v)":                              "SQRT: argomento negativo (%v)",
+			"AVERAGE: no values":                                        "AVERAGE: nessun valore",
+			"MIN requires at least one value":                           "MIN richiede almeno un valore",
+			"MAX requires at least one value":                           "MAX richiede almeno un valore",
+			"%s: the number of characters cannot be negative":           "%s: il numero di caratteri non può essere negativo",
+			"MID: start must be >= 1 and length >= 0":                   "MID: inizio deve essere >= 1 e lunghezza >= 0",
+			"%s: invalid numeric result (%v)":                           "%s: risultato numerico non valido (%v)",
+			"Invalid numeric result (%v)":                               "Risultato numerico non valido (%v)",
+			"Invalid numeric result (NaN)":                              "Risultato numerico non valido (NaN)",
+			"Division by zero or infinite result":                       "Divisione per zero o risultato infinito",
+			"Division by zero":                                          "Divisione per zero",
+			"WEEKDAY: type %d is not supported (1, 2 or 3)":             "WEEKDAY: tipo %d non supportato (1, 2 o 3)",
+			"DATEDIF: the start date is after the end date":             "DATEDIF: la data iniziale è successiva a quella finale",
+			"DATEDIF: unit %q is not supported (Y, M, D, MD, YM, YD)":   "DATEDIF: unità %q non supportata (Y, M, D, MD, YM, YD)",
+			"AVGWHERE: no record matches the filter":                    "AVGWHERE: nessun record soddisfa il filtro",
+			"Value not available (null) in operation":                   "Valore non disponibile (null) in operazione",
+			"Incompatible type in operation":                            "Tipo non compatibile nell'operazione",
+			"COLUMN: invalid filter on %s: %v":                          "COLUMN: filtro non valido su %s: %v",
+			"LOOKUP: key not available (null)":                          "LOOKUP: chiave non disponibile (null)",
+			"LOOKUP: no record of %s with %s = %v":                      "LOOKUP: nessun record di %s con %s = %v",
+			"LOOKUP: %s/%s has no calculated field %s":                  "LOOKUP: %s/%s non ha il campo calcolato %s",
+			"Unknown or undefined function: %s":                         "Funzione non riconosciuta o non definita: %s",
+			"Unknown or undefined function":                             "Funzione non riconosciuta o non definita",
+			"The result %s is not an integer":                           "Il risultato %s non è un numero intero",
+			"The result %s cannot be converted to the declared type %s": "Il risultato %s non è convertibile nel tipo dichiarato %s",
+			"Inherited error from %s: %s":                               "Errore ereditato da %s: %s",
+			"Reference to a missing node or invalid formula":            "Riferimento a un nodo inesistente o formula non valida",
+			"Circular dependency":                                       "Dipendenza circolare",
+			"Formula contains reference to missing node (#REF!)":        "La formula contiene un riferimento a un nodo inesistente (#REF!)",
+			"Reference to deleted node":                                 "Riferimento a un nodo eliminato",
+		},
+	}
+	// formato inglese -> *regexp.Regexp che riconosce il testo già formattato
+	detailPatterns sync.Map
+	detailVerb     = regexp.MustCompile(`%%|%[-+# 0]*[0-9]*(?:\.[0-9]+)?[a-zA-Z]`)
+)
+
+// RegisterErrorDetails aggiunge (o sostituisce) le traduzioni di una lingua per il dettaglio salvato in error.
+// Le chiavi sono i formati inglesi usati dal plugin (es. "SQRT: negative argument (%v)"), i valori
+// i formati tradotti, con gli stessi verbi nello stesso ordine.
+//
+// Va chiamata prima di servire richieste (es. in main, prima di app.Start()).
+func RegisterErrorDetails(locale string, details map[string]string) error {
+	locale = normalizeLocale(locale)
+	if locale == "" {
+		return fmt.Errorf("calculatedfields: empty locale")
+	}
+	for format, translated := range details {
+		if len(detailVerb.FindAllString(format, -1)) != len(detailVerb.FindAllString(translated, -1)) {
+			return fmt.Errorf("calculatedfields: the translation of %q must have the same verbs", format)
+		}
+	}
+
+	errorMessagesMu.Lock()
+	defer errorMessagesMu.Unlock()
+
+	catalog := errorDetails[locale]
+	if catalog == nil {
+		catalog = map[string]string{}
+		errorDetails[locale] = catalog
+	}
+	for format, translated := range details {
+		catalog[format] = translated
+	}
+	return nil
+}
+
+// ErrorDetail traduce il dettaglio inglese di error nella prima lingua tra locales che ha un catalogo
+// (es. "it-IT" prova anche "it"); il testo resta in inglese se nessun formato lo riconosce.
+func ErrorDetail(text string, locales ...string) string {
+	if text == "" {
+		return ""
+	}
+
+	errorMessagesMu.RLock()
+	defer errorMessagesMu.RUnlock()
+
+	for _, locale := range locales {
+		locale = normalizeLocale(locale)
+		candidates := []string{locale}
+		if base, _, found := strings.Cut(locale, "-"); found {
+			candidates = append(candidates, base)
+		}
+		for _, candidate := range candidates {
+			if candidate == DefaultLocale {
+				return text
+			}
+			if catalog, ok := errorDetails[candidate]; ok {
+				return translateDetail(text, catalog)
+			}
+		}
+	}
+	return text
+}
+
+// translateDetail riconosce il formato inglese di text e lo riscrive con quello tradotto;
+// gli argomenti sono tradotti a loro volta (es. il dettaglio dentro "Inherited error from %s: %s").
+func translateDetail(text string, catalog map[string]string) string {
+	for _, format := range detailFormats(catalog) {
+		match := detailPattern(format).FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		args := make([]any, len(match)-1)
+		for i, arg := range match[1:] {
+			args[i] = translateDetail(arg, catalog)
+		}
+		// gli argomenti sono già testo: ogni verbo diventa %s
+		translated := detailVerb.ReplaceAllStringFunc(catalog[format], func(verb string) string {
+			if verb == "%%" {
+				return verb
+			}
+			return "%s"
+		})
+		return fmt.Sprintf(translated, args...)
+	}
+	return text
+}
+
+// detailFormats: i formati del catalogo, i più specifici (più testo fisso) per primi.
+// Quelli senza testo fisso sono esclusi: riconoscerebbero qualunque dettaglio.
+func detailFormats(catalog map[string]string) []string {
+	formats := make([]string, 0, len(catalog))
+	for format := range catalog {
+		if detailLiteralLen(format) > 0 {
+			formats = append(formats, format)
+		}
+	}
+	sort.Slice(formats, func(i, j int) bool {
+		li, lj := detailLiteralLen(formats[i]), detailLiteralLen(formats[j])
+		if li != lj {
+			return li > lj
+		}
+		return formats[i] < formats[j]
+	})
+	return formats
+}
+
+func detailLiteralLen(format string) int {
+	return len(detailVerb.ReplaceAllStringFunc(format, func(verb string) string {
+		if verb == "%%" {
+			return "%"
+		}
+		return ""
+	}))
+}
+
+// detailPattern compila (una volta sola) il formato in una regexp con un gruppo per verbo
+func detailPattern(format string) *regexp.Regexp {
+	if re, ok := detailPatterns.Load(format); ok {
+		return re.(*regexp.Regexp)
+	}
+
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	last := 0
+	for _, loc := range detailVerb.FindAllStringIndex(format, -1) {
+		b.WriteString(regexp.QuoteMeta(format[last:loc[0]]))
+		if format[loc[0]:loc[1]] == "%%" {
+			b.WriteString("%")
+		} else {
+			b.WriteString(`(.*?)`)
+		}
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(format[last:]))
+	b.WriteString(`$`)
+
+	re, _ := detailPatterns.LoadOrStore(format, regexp.MustCompile(b.String()))
+	return re.(*regexp.Regexp)
+}
+
+// errorCodeOf: l'error_code di un risultato (vuoto se non c'è errore)
+func errorCodeOf(value any, errMsg string) string {
+	if errMsg == "" {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		if code, ok := sheetErrorCodes[s]; ok {
+			return code
+		}
+	}
+	return ErrorCodeValue
+}
+
+// setErrorCode aggiorna error_code se il campo esiste (db creati prima della sua introduzione)
+func setErrorCode(app core.App, node *core.Record, code string) {
+	if hasCalculatedFieldsField(app, "error_code") {
+		node.Set("error_code", code)
+	}
+}
+
+// requestLocales: le lingue dell'header Accept-Language, in ordine di preferenza
+// (i pesi q sono ignorati: i client elencano già le lingue in ordine).
+func requestLocales(reqInfo *core.RequestInfo) []string {
+	if reqInfo == nil {
+		return nil
+	}
+	var locales []string
+	for _, part := range strings.Split(reqInfo.Headers["accept_language"], ",") {
+		tag, _, _ := strings.Cut(part, ";")
+		if tag = strings.TrimSpace(tag); tag != "" && tag != "*" {
+			locales = append(locales, tag)
+		}
+	}
+	return locales
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// OnCalculatedFieldsEnrich aggiunge alle risposte API error_message, il messaggio di error_code
+// nella lingua della richiesta, e traduce in quella lingua il dettaglio di error
+// (anche per i calculated_fields espansi dagli owner).
+func OnCalculatedFieldsEnrich(e *core.RecordEnrichEvent) error {
+	setErrorMessage(e.Record, e.RequestInfo)
+	return e.Next()
+}
+
+// setErrorMessage imposta error_message (campo solo di risposta, non salvato) da error_code
+// e traduce error nella risposta (il valore salvato resta in inglese)
+func setErrorMessage(cf *core.Record, reqInfo *core.RequestInfo) {
+	locales := requestLocales(reqInfo)
+	cf.WithCustomData(true)
+	cf.Set("error_message", ErrorMessage(cf.GetString("error_code"), locales...))
+	if detail := cf.GetString("error"); detail != "" {
+		cf.Set("error", ErrorDetail(detail, locales...))
+	}
+}
@@ -0,0 +1,163 @@
+package calculatedfields
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm/runtime"
+)
+
+// prefisso delle funzioni interne generate dall'operatorPatcher (non chiamabili dalle formule: #NAME?)
+const operatorFunctionPrefix = "__op_"
+
+// operatori riscritti in chiamate a funzioni __op_*
+var patchedBinaryOperators = map[string]string{
+	"+":  "__op_add",
+	"-":  "__op_sub",
+	"*":  "__op_mul",
+	"/":  "__op_div",
+	"%":  "__op_mod",
+	"**": "__op_pow",
+	"^":  "__op_pow",
+	"==": "__op_eq",
+	"!=": "__op_ne",
+	"<":  "__op_lt",
+	"<=": "__op_le",
+	">":  "__op_gt",
+	">=": "__op_ge",
+}
+
+// operatorPatcher riscrive operatori aritmetici e di confronto in chiamate __op_*, così:
+//   - un operando in errore (#DIV/0!, #N/A, ... anche ereditato da un genitore) si propaga come valore
+//     e può essere intercettato da IFERROR/IFNA invece di interrompere la valutazione;
+//   - in modalità decimale i numeri sono *big.Rat e gli operatori sono esatti.
+//
+// In modalità decimale gli argomenti della libreria standard diventano *big.Rat (__op_decimal) e le funzioni
+// numeriche sono esatte, tranne SQRT (decimalFloatPrec bit) e le potenze non intere (float64).
+// Builtin expr e funzioni custom non conoscono *big.Rat: ricevono float64 (__op_float) e non sono esatti.
+type operatorPatcher struct {
+	decimal bool
+}
+
+func (p operatorPatcher) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.BinaryNode:
+		if fn, ok := patchedBinaryOperators[n.Operator]; ok {
+			ast.Patch(node, &ast.CallNode{
+				Callee:    &ast.IdentifierNode{Value: fn},
+				Arguments: []ast.Node{n.Left, n.Right},
+			})
+		}
+	case *ast.UnaryNode:
+		if n.Operator == "-" {
+			ast.Patch(node, &ast.CallNode{
+				Callee:    &ast.IdentifierNode{Value: "__op_neg"},
+				Arguments: []ast.Node{n.Node},
+			})
+		}
+	case *ast.BuiltinNode:
+		if p.decimal {
+			wrapFloatArguments(n.Arguments)
+		}
+	case *ast.CallNode:
+		ident, ok := n.Callee.(*ast.IdentifierNode)
+		if !ok || !p.decimal {
+			return
+		}
+		if _, std := standardFunctions[ident.Value]; std {
+			wrapArguments(n.Arguments, "__op_decimal")
+		} else if !isBuiltinFunctionName(ident.Value) && !strings.HasPrefix(ident.Value, operatorFunctionPrefix) {
+			wrapFloatArguments(n.Arguments)
+		}
+	}
+}
+
+func wrapFloatArguments(args []ast.Node) {
+	wrapArguments(args, "__op_float")
+}
+
+func wrapArguments(args []ast.Node, fn string) {
+	for i, a := range args {
+		args[i] = &ast.CallNode{
+			Callee:    &ast.IdentifierNode{Value: fn},
+			Arguments: []ast.Node{a},
+		}
+	}
+}
+
+// operatorCompileOptions: patcher + funzioni __op_* (aritmetica decimale se decimal)
+func operatorCompileOptions(decimal bool) []expr.Option {
+	arith := func(op func(a, b *big.Rat) (*big.Rat, error), fallback func(a, b any) any) formulaFunction {
+		return binaryOperator(decimal, func(a, b *big.Rat) (any, error) { return op(a, b) }, fallback)
+	}
+	compare := func(test func(cmp int) bool, fallback func(a, b any) any) formulaFunction {
+		return binaryOperator(decimal, func(a, b *big.Rat) (any, error) { return test(a.Cmp(b)), nil }, fallback)
+	}
+
+	return []expr.Option{
+		expr.Patch(operatorPatcher{decimal: decimal}),
+		expr.Function("__op_add", arith(func(a, b *big.Rat) (*big.Rat, error) { return new(big.Rat).Add(a, b), nil }, runtime.Add)),
+		expr.Function("__op_sub", arith(func(a, b *big.Rat) (*big.Rat, error) { return new(big.Rat).Sub(a, b), nil }, runtime.Subtract)),
+		expr.Function("__op_mul", arith(func(a, b *big.Rat) (*big.Rat, error) { return new(big.Rat).Mul(a, b), nil }, runtime.Multiply)),
+		expr.Function("__op_div", arith(ratDiv, func(a, b any) any { return runtime.Divide(a, b) })),
+		expr.Function("__op_mod", arith(ratMod, func(a, b any) any { return runtime.Modulo(a, b) })),
+		expr.Function("__op_pow", arith(ratPow, func(a, b any) any { return runtime.Exponent(a, b) })),
+		expr.Function("__op_eq", compare(func(c int) bool { return c == 0 }, func(a, b any) any { return runtime.Equal(a, b) })),
+		expr.Function("__op_ne", compare(func(c int) bool { return c != 0 }, func(a, b any) any { return !runtime.Equal(a, b) })),
+		expr.Function("__op_lt", compare(func(c int) bool { return c < 0 }, func(a, b any) any { return runtime.Less(a, b) })),
+		expr.Function("__op_le", compare(func(c int) bool { return c <= 0 }, func(a, b any) any { return runtime.LessOrEqual(a, b) })),
+		expr.Function("__op_gt", compare(func(c int) bool { return c > 0 }, func(a, b any) any { return runtime.More(a, b) })),
+		expr.Function("__op_ge", compare(func(c int) bool { return c >= 0 }, func(a, b any) any { return runtime.MoreOrEqual(a, b) })),
+		expr.Function("__op_neg", func(args ...any) (result any, err error) {
+			if fe := firstErrorValue(args); fe != nil {
+				return fe, nil
+			}
+			if r, ok := toRat(args[0]); ok && decimal {
+				return new(big.Rat).Neg(r), nil
+			}
+			defer recoverOperation(args, &result)
+			return runtime.Negate(args[0]), nil
+		}),
+		expr.Function("__op_float", func(args ...any) (any, error) {
+			return normalizeNumbers(args[0], false), nil
+		}),
+		expr.Function("__op_decimal", func(args ...any) (any, error) {
+			return decimalArgument(args[0]), nil
+		}),
+	}
+}
+
+// binaryOperator: un operando in errore si propaga; in modalità decimale due numeri usano exact,
+// altrimenti vale la semantica di expr (concatenazione di stringhe, date + durate, ...).
+func binaryOperator(decimal bool, exact func(a, b *big.Rat) (any, error), fallback func(a, b any) any) formulaFunction {
+	return func(args ...any) (result any, err error) {
+		if fe := firstErrorValue(args); fe != nil {
+			return fe, nil
+		}
+		if decimal {
+			a, okA := toRat(args[0])
+			b, okB := toRat(args[1])
+			if okA && okB {
+				return errorAsValue(exact(a, b))
+			}
+		}
+		defer recoverOperation(args, &result)
+		return fallback(args[0], args[1]), nil
+	}
+}
+
+// recoverOperation trasforma l'errore di runtime di expr ("invalid operation") in un valore di errore,
+// con gli stessi codici e messaggi di translateFormulaError
+func recoverOperation(args []any, result *any) {
+	if r := recover(); r != nil {
+		for _, a := range args {
+			if a == nil {
+				*result = newFormulaError("#N/A", "Value not available (null) in operation")
+				return
+			}
+		}
+		*result = newFormulaError("#VALUE!", "Incompatible type in operation")
+	}
+}
@@ -0,0 +1,151 @@
+package calculatedfields
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// ownerIdentifier è la radice dei riferimenti ai campi "normali" dell'owner del nodo:
+// owner.<field> legge il valore della colonna <field> della riga owner (non un calculated_field).
+const ownerIdentifier = "owner"
+
+// ownerReferenceField restituisce <field> se l'identificatore è della forma owner.<field>
+func ownerReferenceField(identifier string) (string, bool) {
+	field, ok := strings.CutPrefix(identifier, ownerIdentifier+".")
+	if !ok || field == "" {
+		return "", false
+	}
+	return field, true
+}
+
+// ownerReferencedFields restituisce i campi owner usati nella formula (owner.<field>)
+func ownerReferencedFields(formula string) map[string]struct{} {
+	fields := map[string]struct{}{}
+	if !strings.Contains(formula, ownerIdentifier) {
+		return fields
+	}
+
+	identifiers, err := extractIdentifiersFromFormula(formula)
+	if err != nil {
+		return fields
+	}
+	for _, id := range identifiers {
+		if field, ok := ownerReferenceField(id); ok {
+			fields[field] = struct{}{}
+		}
+	}
+	return fields
+}
+
+// hasOwnerField indica se la collection owner di rec ha un campo leggibile con quel nome
+// (i campi protetti valgono come inesistenti)
+func hasOwnerField(app core.App, rec *core.Record, field string) (bool, error) {
+	ownerCol := rec.GetString("owner_collection")
+	if ownerCol == "" {
+		return false, nil
+	}
+	col, err := app.FindCachedCollectionByNameOrId(ownerCol)
+	if err != nil {
+		return false, err
+	}
+	return isReadableField(col, field), nil
+}
+
+// isReadableField indica se una formula può leggere col.field: il campo deve esistere e non essere
+// protetto (campi hidden, password, tokenKey ed email delle auth collection, visibile solo con emailVisibility),
+// perché il valore calcolato finisce in value, visibile a chi vede il calculated_field.
+func isReadableField(col *core.Collection, field string) bool {
+	f := col.Fields.GetByName(field)
+	if f == nil || f.GetHidden() {
+		return false
+	}
+	if _, ok := f.(*core.PasswordField); ok {
+		return false
+	}
+	if col.IsAuth() && (field == core.FieldNameTokenKey || field == core.FieldNameEmail) {
+		return false
+	}
+	return true
+}
+
+// buildOwnerEnv carica la riga owner del nodo ed espone solo i campi citati nella formula.
+// Se l'owner non esiste (nodo orfano) i campi restano non valorizzati.
+func buildOwnerEnv(app core.App, node *core.Record, fields map[string]struct{}) map[string]any {
+	ownerEnv := make(map[string]any, len(fields))
+	if len(fields) == 0 {
+		return ownerEnv
+	}
+
+	owner, err := app.FindRecordById(node.GetString("owner_collection"), node.GetString("owner_row"))
+	if err != nil {
+		return ownerEnv
+	}
+
+	for field := range fields {
+		if !isReadableField(owner.Collection(), field) {
+			continue
+		}
+		ownerEnv[field] = ownerFieldValue(owner.Get(field))
+	}
+	return ownerEnv
+}
+
+// ownerFieldValue converte i tipi PocketBase in valori che expr sa trattare
+func ownerFieldValue(v any) any {
+	switch val := v.(type) {
+	case types.DateTime:
+		if val.IsZero() {
+			return nil
+		}
+		return val.Time()
+	case types.JSONRaw:
+		if len(val) == 0 {
+			return nil
+		}
+		var decoded any
+		if err := json.Unmarshal(val, &decoded); err != nil {
+			return val.String()
+		}
+		return decoded
+	default:
+		return v
+	}
+}
+
+// changedOwnerFields restituisce i campi dell'owner modificati rispetto al record originale.
+// I campi autodate (es. updated) sono esclusi: vengono toccati dal plugin stesso
+// e rileggerli farebbe ripartire il ricalcolo all'infinito.
+func changedOwnerFields(rec *core.Record) map[string]struct{} {
+	changed := map[string]struct{}{}
+	orig := rec.Original()
+
+	for _, f := range rec.Collection().Fields {
+		if _, ok := f.(*core.AutodateField); ok {
+			continue
+		}
+		name := f.GetName()
+		a, _ := json.Marshal(orig.Get(name))
+		b, _ := json.Marshal(rec.Get(name))
+		if string(a) != string(b) {
+			changed[name] = struct{}{}
+		}
+	}
+	return changed
+}
+
+// hasCalculatedFieldsRelation indica se la collection è owner di calculated_fields
+func hasCalculatedFieldsRelation(app core.App, col *core.Collection) bool {
+	cfCol, err := app.FindCachedCollectionByNameOrId("calculated_fields")
+	if err != nil {
+		return false
+	}
+	for _, f := range col.Fields {
+		if rel, ok := f.(*core.RelationField); ok && rel.CollectionId == cfCol.Id {
+			return true
+		}
+	}
+	return false
+}
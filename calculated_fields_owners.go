@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 )
@@ -137,6 +138,64 @@ func OnOwnerCreate_AutoCreateCalculatedFields(e *core.RecordEvent) error {
 	})
 }
 
+// OnOwnerUpdate_RecalculateCalculatedFields:
+//   - intercetta l'UPDATE di un record owner (collection con relation verso calculated_fields)
+//   - se sono cambiati campi usati come owner.<field> nelle formule dei suoi CF,
+//     ricalcola quei CF e propaga ai dipendenti nella stessa transazione.
+func OnOwnerUpdate_RecalculateCalculatedFields(e *core.RecordEvent) error {
+	if e.Record == nil || e.Record.Collection() == nil || e.Record.Collection().Name == "calculated_fields" {
+		return e.Next()
+	}
+
+	ownerCol := e.Record.Collection()
+	if !hasCalculatedFieldsRelation(e.App, ownerCol) {
+		return e.Next()
+	}
+
+	// va calcolato prima di e.Next(): dopo il save non c'è più modo di sapere cosa è cambiato
+	changed := changedOwnerFields(e.Record)
+	if len(changed) == 0 {
+		return e.Next()
+	}
+
+	originalApp := e.App
+	txErr := originalApp.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		cfs, err := txApp.FindAllRecords("calculated_fields", dbx.HashExp{
+			"owner_collection": ownerCol.Name,
+			"owner_row":        e.Record.Id,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load calculated_fields of %s/%s: %w", ownerCol.Name, e.Record.Id, err)
+		}
+
+		affected := make([]*core.Record, 0, len(cfs))
+		for _, cf := range cfs {
+			if referencesAnyField(ownerReferencedFields(cf.GetString("formula")), changed) {
+				affected = append(affected, cf)
+			}
+		}
+
+		return reevaluateCalculatedFields(txApp, affected)
+	})
+	e.App = originalApp
+	return txErr
+}
+
+func referencesAnyField(used, changed map[string]struct{}) bool {
+	for field := range used {
+		if _, ok := changed[field]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // BindCalculatedFieldsGenericCascadeDelete:
 // - intercetta la DELETE di QUALSIASI record (tutte le collection)
 // - se quel record ha campi relation verso la collection calculated_fields,
@@ -299,28 +358,15 @@ func CalculatedFieldsUpdateRequestGuard(e *core.RecordRequestEvent) error {
 		})
 	}
 	if len(startIds) > 0 {
-		startRecs, err := e.App.FindRecordsByIds("calculated_fields", startIds)
+		startRecs, missing, err := findReferencedRecords(e.App, cf, startIds)
 		if err != nil {
 			return apis.NewBadRequestError("Formula dependency error", validation.Errors{
 				"formula": validation.NewError("1007", fmt.Sprintf("Failed to load referenced calculated_fields: %v", err)),
 			})
 		}
 
-		// FindRecordsByIds può non dare errore ma restituire meno record -> trattalo come missing ref
-		if len(startRecs) != len(startIds) {
-			found := map[string]struct{}{}
-			for _, r := range startRecs {
-				if r != nil {
-					found[r.Id] = struct{}{}
-				}
-			}
-			missing := make([]string, 0, 4)
-			for _, id := range startIds {
-				if _, ok := found[id]; !ok {
-					missing = append(missing, id)
-				}
-			}
-
+		// riferimenti (id o alias) che non corrispondono a nessun record -> missing ref
+		if len(missing) > 0 {
 			return apis.NewBadRequestError("Formula evaluation error: referenced variable not found", validation.Errors{
 				"formula": validation.NewError("1007", fmt.Sprintf("Variable not found in dependency graph: %v", missing)),
 			})
@@ -331,6 +377,30 @@ func CalculatedFieldsUpdateRequestGuard(e *core.RecordRequestEvent) error {
 		}
 	}
 
+	// le celle delle colonne lette (COLUMN, LOOKUP) sono dipendenze come le altre
+	columns, err := extractColumnReferences(e.App, cf, formula)
+	if err != nil {
+		return err
+	}
+	columnIds, err := columnMemberIds(e.App, columns)
+	if err != nil {
+		return apis.NewInternalServerError(fmt.Sprintf("Failed to load the columns read by calculated_fields/%s", cf.Id), err)
+	}
+	if len(columnIds) > 0 {
+		cells, err := e.App.FindRecordsByIds("calculated_fields", columnIds)
+		if err != nil {
+			return apis.NewInternalServerError(fmt.Sprintf("Failed to load the columns read by calculated_fields/%s", cf.Id), err)
+		}
+		if err := assertDepsViewableTransitive(e.App, requestInfo, cells, e.Auth); err != nil {
+			return err
+		}
+	}
+
+	// 3) LIST permission sui record delle collection lette dalla nuova formula (aggregati, filtri di COLUMN)
+	if err := assertCollectionReadsAllowed(e.App, requestInfo, cf, formula, e.Auth); err != nil {
+		return err
+	}
+
 	return e.Next()
 }
 
@@ -355,6 +425,9 @@ func assertDepsViewableTransitive(
 	}
 
 	// queue di record (non ids)
+	index := graphIndexOf(app)
+	pool := map[string]*core.Record{}
+	ancestors := []string{}
 	queue := make([]*core.Record, 0, len(frontier))
 	for _, r := range frontier {
 		if r == nil || strings.TrimSpace(r.Id) == "" {
@@ -364,9 +437,21 @@ func assertDepsViewableTransitive(
 			continue
 		}
 		visited[r.Id] = struct{}{}
+		pool[r.Id] = r
+		ancestors = append(ancestors, index.ancestorsOf(app, r.Id)...)
 		queue = append(queue, r)
 	}
 
+	// tutti gli antenati dall'indice del grafo, caricati con una sola query
+	if err := findNodesByIds(app, pool, ancestors); err != nil {
+		return apis.NewBadRequestError(
+			"Formula dependency error: referenced record not found",
+			validation.Errors{
+				"formula": validation.NewError("1007", fmt.Sprintf("Failed to load depends_on records: %v", err)),
+			},
+		)
+	}
+
 	for len(queue) > 0 {
 		cur := queue[0]
 		queue = queue[1:]
@@ -392,24 +477,15 @@ func assertDepsViewableTransitive(
 			}
 		}
 
-		// 2) espandi parents via depends_on
-		parentIds := cur.GetStringSlice("depends_on")
-		if len(parentIds) == 0 {
-			continue
-		}
-
-		parents, err := app.FindRecordsByIds("calculated_fields", parentIds)
-		if err != nil {
-			return apis.NewBadRequestError(
-				"Formula dependency error: referenced record not found",
-				validation.Errors{
-					"formula": validation.NewError("1007", fmt.Sprintf("Failed to load depends_on records for %s", cur.Id)),
-				},
-			)
+		// 2) LIST check sulle collection aggregate dal nodo corrente
+		if err := assertCollectionReadsAllowed(app, requestInfo, cur, cur.GetString("formula"), auth); err != nil {
+			return err
 		}
 
-		for _, p := range parents {
-			if p == nil {
+		// 3) parents via depends_on (dall'indice, già caricati)
+		for _, parentId := range index.parentsOf(app, cur.Id) {
+			p, ok := pool[parentId]
+			if !ok {
 				continue
 			}
 			if _, ok := visited[p.Id]; ok {
@@ -494,6 +570,7 @@ func CalculatedFieldsViewRequestGuard(e *core.RecordRequestEvent) error {
 		// NB: value è JSON-encoded string nel tuo schema
 		cf.Set("value", "\"#AUTH!\"")
 		cf.Set("error", fmt.Sprintf("Not authorized to read one or more dependencies (first blocked: %s)", blockedAt))
+		setErrorCode(e.App, cf, ErrorCodeAuth)
 	}
 
 	return e.Next()
@@ -546,6 +623,7 @@ func CalculatedFieldsListRequestGuard(e *core.RecordsListRequestEvent) error {
 
 		if masked {
 			cf.Set("value", "\"#AUTH!\"")
+			setErrorCode(e.App, cf, ErrorCodeAuth)
 			cf.Set(
 				"error",
 				fmt.Sprintf(
@@ -553,6 +631,8 @@ func CalculatedFieldsListRequestGuard(e *core.RecordsListRequestEvent) error {
 					blockedAt,
 				),
 			)
+			// la risposta potrebbe essere già stata arricchita prima del mascheramento
+			setErrorMessage(cf, reqInfo)
 		}
 
 		filtered = append(filtered, cf)
@@ -568,6 +648,18 @@ func maskIfDepsNotViewable(
 	root *core.Record,
 ) (masked bool, blockedAt string, err error) {
 
+	// antenati dall'indice del grafo, caricati con una sola query
+	index := graphIndexOf(app)
+	pool := map[string]*core.Record{root.Id: root}
+	if err := findNodesByIds(app, pool, index.ancestorsOf(app, root.Id)); err != nil {
+		return false, "", err
+	}
+
+	// il nodo stesso aggrega record che l'utente non può elencare
+	if ok, _, err := collectionReadsAllowed(app, reqInfo, root.GetString("formula")); err != nil || !ok {
+		return true, root.Id, nil
+	}
+
 	queue := []*core.Record{root}
 	visited := map[string]struct{}{root.Id: {}}
 
@@ -575,17 +667,16 @@ func maskIfDepsNotViewable(
 		cur := queue[0]
 		queue = queue[1:]
 
-		// espandi depends_on
-		errs := app.ExpandRecord(cur, []string{"depends_on"}, nil)
-		if len(errs) != 0 {
-			return false, "", fmt.Errorf("failed to expand depends_on: %v", errs)
-		}
-
-		for _, dep := range cur.ExpandedAll("depends_on") {
-			if _, seen := visited[dep.Id]; seen {
+		for _, depId := range index.parentsOf(app, cur.Id) {
+			if _, seen := visited[depId]; seen {
+				continue
+			}
+			visited[depId] = struct{}{}
+			dep, ok := pool[depId]
+			if !ok {
+				// nodo non più esistente
 				continue
 			}
-			visited[dep.Id] = struct{}{}
 
 			ownerCol := dep.GetString("owner_collection")
 			ownerRow := dep.GetString("owner_row")
@@ -598,8 +689,11 @@ func maskIfDepsNotViewable(
 				return true, dep.Id, nil
 			}
 
-			ok, _ := app.CanAccessRecord(ownerRec, reqInfo, ownerRec.Collection().ViewRule)
-			if !ok {
+			canView, _ := app.CanAccessRecord(ownerRec, reqInfo, ownerRec.Collection().ViewRule)
+			if !canView {
+				return true, dep.Id, nil
+			}
+			if ok, _, err := collectionReadsAllowed(app, reqInfo, dep.GetString("formula")); err != nil || !ok {
 				return true, dep.Id, nil
 			}
 
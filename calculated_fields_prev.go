@@ -0,0 +1,355 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// prevIdentifier è la radice dei riferimenti alla riga precedente:
+// prev.<owner_field> indica il calculated_field <owner_field> della riga owner che precede quella del nodo
+// nell'ordinamento configurato (Config.RowOrder). Sulla prima riga vale nil.
+const prevIdentifier = "prev"
+
+// prevDepPrefix marca in external_deps le collection di cui il nodo legge la riga precedente
+// (es. "prev:ledger"): inserimenti, riordini e cancellazioni di righe ricollegano le dipendenze.
+const prevDepPrefix = "prev:"
+
+// ordinamento delle righe owner se la collection non è in Config.RowOrder
+const defaultRowOrder = "created"
+
+var rowOrderFieldRegex = regexp.MustCompile(`^[-+]?[A-Za-z_][A-Za-z0-9_]*$`)
+
+// prevReferenceField restituisce <field> se l'identificatore è della forma prev.<field>
+func prevReferenceField(identifier string) (string, bool) {
+	field, ok := strings.CutPrefix(identifier, prevIdentifier+".")
+	if !ok || field == "" {
+		return "", false
+	}
+	return field, true
+}
+
+// prevReferencedFields restituisce i campi letti sulla riga precedente (prev.<field>)
+func prevReferencedFields(formula string) map[string]struct{} {
+	fields := map[string]struct{}{}
+	if !strings.Contains(formula, prevIdentifier) {
+		return fields
+	}
+
+	identifiers, err := extractIdentifiersFromFormula(formula)
+	if err != nil {
+		return fields
+	}
+	for _, id := range identifiers {
+		if field, ok := prevReferenceField(id); ok {
+			fields[field] = struct{}{}
+		}
+	}
+	return fields
+}
+
+// rowOrderFields scompone un ordinamento ("-position,created") in campi e direzione
+func rowOrderFields(order string) ([]string, error) {
+	parts := strings.Split(order, ",")
+	fields := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if !rowOrderFieldRegex.MatchString(p) {
+			return nil, fmt.Errorf("invalid row order field %q", p)
+		}
+		fields = append(fields, p)
+	}
+	return fields, nil
+}
+
+// rowOrder restituisce l'ordinamento configurato per la collection owner
+func rowOrder(app core.App, collection string) string {
+	if order := GetConfig(app).RowOrder[collection]; order != "" {
+		return order
+	}
+	return defaultRowOrder
+}
+
+// rowOrderTerm è un campo dell'ordinamento delle righe con la sua direzione
+type rowOrderTerm struct {
+	field string
+	desc  bool
+}
+
+// rowOrderTerms valida l'ordinamento configurato per la collection owner (id come spareggio finale escluso)
+func rowOrderTerms(app core.App, col *core.Collection) ([]rowOrderTerm, error) {
+	fields, err := rowOrderFields(rowOrder(app, col.Name))
+	if err != nil {
+		return nil, fmt.Errorf("calculatedfields: %s: %w", col.Name, err)
+	}
+	terms := make([]rowOrderTerm, 0, len(fields))
+	for _, f := range fields {
+		name := strings.TrimLeft(f, "-+")
+		if col.Fields.GetByName(name) == nil {
+			return nil, fmt.Errorf("calculatedfields: row order field %q not found in %s", name, col.Name)
+		}
+		terms = append(terms, rowOrderTerm{field: name, desc: strings.HasPrefix(f, "-")})
+	}
+	return terms, nil
+}
+
+// rowPositions è l'ordinamento delle righe owner calcolato una volta sola (id -> posizione)
+type rowPositions struct {
+	ids []string
+	pos map[string]int
+}
+
+// previous restituisce la riga che precede row ("" sulla prima riga o se row non esiste)
+func (r rowPositions) previous(row string) string {
+	if p, ok := r.pos[row]; ok && p > 0 {
+		return r.ids[p-1]
+	}
+	return ""
+}
+
+// orderedRows carica in una query gli id delle righe owner nell'ordinamento configurato (id come spareggio)
+func orderedRows(app core.App, collection string) (rowPositions, error) {
+	col, err := app.FindCachedCollectionByNameOrId(collection)
+	if err != nil {
+		return rowPositions{}, err
+	}
+	terms, err := rowOrderTerms(app, col)
+	if err != nil {
+		return rowPositions{}, err
+	}
+
+	orderBy := make([]string, 0, len(terms)+1)
+	for _, t := range terms {
+		direction := "ASC"
+		if t.desc {
+			direction = "DESC"
+		}
+		orderBy = append(orderBy, "[["+t.field+"]] "+direction)
+	}
+	orderBy = append(orderBy, "[[id]] ASC")
+
+	ids := []string{}
+	err = app.DB().Select("id").From(col.Name).OrderBy(orderBy...).Column(&ids)
+	if err != nil {
+		return rowPositions{}, fmt.Errorf("failed to load %s row order: %w", collection, err)
+	}
+	pos := make(map[string]int, len(ids))
+	for i, id := range ids {
+		pos[id] = i
+	}
+	return rowPositions{ids: ids, pos: pos}, nil
+}
+
+// previousRowId cerca con una sola query la riga che precede row nell'ordinamento configurato
+// ("" sulla prima riga), senza caricare l'intero ordinamento
+func previousRowId(app core.App, collection, row string) (string, error) {
+	col, err := app.FindCachedCollectionByNameOrId(collection)
+	if err != nil {
+		return "", err
+	}
+	terms, err := rowOrderTerms(app, col)
+	if err != nil {
+		return "", err
+	}
+
+	// (f1, f2, ..., id) < riga corrente, confrontando campo per campo nella direzione di ciascuno
+	before := "[[id]] < {:row}"
+	orderBy := []string{}
+	for i := len(terms) - 1; i >= 0; i-- {
+		t := terms[i]
+		cmp, direction := "<", "DESC"
+		if t.desc {
+			cmp, direction = ">", "ASC"
+		}
+		current := "(SELECT [[" + t.field + "]] FROM {{" + col.Name + "}} WHERE [[id]] = {:row})"
+		before = fmt.Sprintf("([[%s]] %s %s OR ([[%s]] = %s AND %s))", t.field, cmp, current, t.field, current, before)
+		orderBy = append([]string{"[[" + t.field + "]] " + direction}, orderBy...)
+	}
+	orderBy = append(orderBy, "[[id]] DESC")
+
+	ids := []string{}
+	err = app.DB().Select("id").From(col.Name).
+		Where(dbx.NewExp(before, dbx.Params{"row": row})).
+		OrderBy(orderBy...).
+		Limit(1).
+		Column(&ids)
+	if err != nil {
+		return "", fmt.Errorf("failed to load the row before %s/%s: %w", collection, row, err)
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return ids[0], nil
+}
+
+// findPreviousCell cerca il calculated_field <field> della riga che precede quella di rec.
+// Restituisce nil se rec è sulla prima riga (o la riga precedente non ha ancora il calculated_field).
+func findPreviousCell(app core.App, rec *core.Record, field string) (*core.Record, error) {
+	prevRow, err := previousRowId(app, rec.GetString("owner_collection"), rec.GetString("owner_row"))
+	if err != nil || prevRow == "" {
+		return nil, err
+	}
+	return findOwnerCell(app, rec.GetString("owner_collection"), prevRow, field)
+}
+
+// buildPrevEnv espone i valori dei campi prev.<field> citati nella formula (dall'env del grafo).
+// La cella precedente è già collegata in depends_on (al salvataggio e a ogni relink), quindi di norma
+// non serve nessuna query; solo se depends_on cita più celle dello stesso campo si cerca la riga precedente.
+func buildPrevEnv(app core.App, node *core.Record, env map[string]any) map[string]any {
+	fields := prevReferencedFields(node.GetString("formula"))
+	prevEnv := make(map[string]any, len(fields))
+	for field := range fields {
+		prevEnv[field] = nil
+
+		candidates := []*core.Record{}
+		for _, dep := range node.ExpandedAll("depends_on") {
+			if dep.GetString("owner_collection") == node.GetString("owner_collection") &&
+				dep.GetString("owner_field") == field &&
+				dep.GetString("owner_row") != node.GetString("owner_row") {
+				candidates = append(candidates, dep)
+			}
+		}
+
+		var cell *core.Record
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			cell = candidates[0]
+		default:
+			var err error
+			if cell, err = findPreviousCell(app, node, field); err != nil || cell == nil {
+				continue
+			}
+		}
+		prevEnv[field] = env[cell.Id]
+	}
+	return prevEnv
+}
+
+// columnCell è una cella (riga, campo) di una collection owner
+type columnCell struct {
+	row   string
+	field string
+}
+
+// relinkPreviousRows ricollega prev.<field> per tutti i nodi che leggono la riga precedente
+// nella collection indicata e ricalcola (in ordine di riga) quelli la cui riga precedente è cambiata.
+// Ordinamento e celle della collection vengono caricati una volta sola; solo i nodi il cui
+// collegamento non corrisponde più alla riga precedente vengono risalvati.
+func relinkPreviousRows(txApp core.App, collection string) error {
+	if collection == "" || !hasCalculatedFieldsField(txApp, "external_deps") {
+		return nil
+	}
+	if !graphIndexOf(txApp).hasExternalDependents(txApp, prevDepPrefix+collection) {
+		return nil
+	}
+
+	cfs, err := findCalculatedFieldsByExternalDep(txApp, prevDepPrefix+collection)
+	if err != nil || len(cfs) == 0 {
+		return err
+	}
+
+	rows, err := orderedRows(txApp, collection)
+	if err != nil {
+		return err
+	}
+	slices.SortStableFunc(cfs, func(a, b *core.Record) int {
+		return rows.pos[a.GetString("owner_row")] - rows.pos[b.GetString("owner_row")]
+	})
+
+	cellRows := []struct {
+		Id         string `db:"id"`
+		OwnerRow   string `db:"owner_row"`
+		OwnerField string `db:"owner_field"`
+	}{}
+	err = txApp.DB().Select("id", "owner_row", "owner_field").
+		From("calculated_fields").
+		Where(dbx.HashExp{"owner_collection": collection}).
+		All(&cellRows)
+	if err != nil {
+		return fmt.Errorf("failed to load %s cells: %w", collection, err)
+	}
+	cellsById := make(map[string]columnCell, len(cellRows))
+	cellIds := make(map[columnCell]string, len(cellRows))
+	for _, c := range cellRows {
+		cell := columnCell{row: c.OwnerRow, field: c.OwnerField}
+		cellsById[c.Id] = cell
+		cellIds[cell] = c.Id
+	}
+
+	changed := []*core.Record{}
+	for _, cf := range cfs {
+		if !prevLinkChanged(cf, rows.previous(cf.GetString("owner_row")), cellsById, cellIds) {
+			continue
+		}
+		if _, err := ResolveDepsAndTxSave(txApp, cf); err != nil {
+			return err
+		}
+		changed = append(changed, cf)
+	}
+	return reevaluateCalculatedFields(txApp, changed)
+}
+
+// prevLinkChanged indica se depends_on non collega (più) le celle prev.<field> della riga prevRow:
+// manca la cella attesa o c'è la cella dello stesso campo di un'altra riga
+func prevLinkChanged(cf *core.Record, prevRow string, cellsById map[string]columnCell, cellIds map[columnCell]string) bool {
+	deps := cf.GetStringSlice("depends_on")
+	row := cf.GetString("owner_row")
+	for field := range prevReferencedFields(cf.GetString("formula")) {
+		if want, ok := cellIds[columnCell{row: prevRow, field: field}]; ok && !slices.Contains(deps, want) {
+			return true
+		}
+		for _, dep := range deps {
+			if cell, ok := cellsById[dep]; ok && cell.field == field && cell.row != prevRow && cell.row != row {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OnOwnerChange_RelinkPreviousRows: riordino (update dei campi di ordinamento) o cancellazione
+// di una riga owner cambiano la riga precedente dei vicini. Gli inserimenti sono gestiti alla
+// creazione dei calculated_fields della nuova riga.
+func OnOwnerChange_RelinkPreviousRows(e *core.RecordEvent) error {
+	col := e.Record.Collection()
+	if col == nil || col.System || col.Name == "calculated_fields" || !hasCalculatedFieldsRelation(e.App, col) {
+		return e.Next()
+	}
+
+	if e.Type == core.ModelEventTypeUpdate && !changesRowOrder(e.App, e.Record) {
+		return e.Next()
+	}
+
+	originalApp := e.App
+	txErr := originalApp.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return relinkPreviousRows(txApp, col.Name)
+	})
+	e.App = originalApp
+	return txErr
+}
+
+// changesRowOrder indica se l'update modifica uno dei campi dell'ordinamento delle righe
+func changesRowOrder(app core.App, rec *core.Record) bool {
+	fields, err := rowOrderFields(rowOrder(app, rec.Collection().Name))
+	if err != nil {
+		return false
+	}
+	changed := changedOwnerFields(rec)
+	for _, f := range fields {
+		if _, ok := changed[strings.TrimLeft(f, "-+")]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package calculatedfields
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// ProgramCacheStats sono le statistiche della cache dei programmi compilati
+type ProgramCacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+}
+
+// programCache è una LRU di *vm.Program, condivisa dal processo come il registro delle funzioni custom
+type programCache struct {
+	mu        sync.Mutex
+	capacity  int
+	items     map[string]*list.Element
+	order     *list.List // in testa il più recente
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type programCacheEntry struct {
+	key     string
+	program *vm.Program
+}
+
+var compiledPrograms = newProgramCache(DefaultConfig().ProgramCacheSize)
+
+func newProgramCache(capacity int) *programCache {
+	return &programCache{capacity: capacity, items: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *programCache) get(key string) (*vm.Program, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		c.hits++
+		return el.Value.(*programCacheEntry).program, true
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *programCache) add(key string, program *vm.Program) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.capacity <= 0 {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		el.Value.(*programCacheEntry).program = program
+		return
+	}
+	c.items[key] = c.order.PushFront(&programCacheEntry{key: key, program: program})
+	c.evictOverflow()
+}
+
+// resize cambia la capacità (0 = cache disattivata) scartando i meno recenti in eccesso
+func (c *programCache) resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	c.evictOverflow()
+}
+
+func (c *programCache) evictOverflow() {
+	for c.order.Len() > max(c.capacity, 0) {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.items, el.Value.(*programCacheEntry).key)
+		c.evictions++
+	}
+}
+
+// purge svuota la cache (le statistiche restano)
+func (c *programCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+}
+
+func (c *programCache) stats() ProgramCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ProgramCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Size:      c.order.Len(),
+		Capacity:  c.capacity,
+	}
+}
+
+// GetProgramCacheStats restituisce hit/miss della cache dei programmi compilati
+func GetProgramCacheStats() ProgramCacheStats {
+	return compiledPrograms.stats()
+}
+
+// compileFormula compila la formula (libreria standard, funzioni custom, operatori) o la prende dalla cache.
+// La chiave include la versione del set di funzioni custom, la modalità numerica e il limite di nodi
+// (0 = nessun limite), che cambiano le opzioni di compilazione; l'env non conta perché le formule
+// sono compilate senza tipi.
+// Gli errori di compilazione non vengono messi in cache.
+func compileFormula(formula string, decimal bool, maxNodes int) (*vm.Program, error) {
+	customFunctionsMu.RLock()
+	version := customFunctionsVersion
+	customFunctionsMu.RUnlock()
+
+	key := fmt.Sprintf("%d|%t|%d|%s", version, decimal, maxNodes, formula)
+	if program, ok := compiledPrograms.get(key); ok {
+		return program, nil
+	}
+
+	opts := append(formulaCompileOptions(), operatorCompileOptions(decimal)...)
+	opts = append(opts, expr.MaxNodes(uint(maxNodes)))
+	program, err := expr.Compile(formula, opts...)
+	if err != nil {
+		return nil, err
+	}
+	compiledPrograms.add(key, program)
+	return program, nil
+}
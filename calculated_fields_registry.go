@@ -0,0 +1,192 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// volatileDep marca in external_deps i nodi che chiamano funzioni volatili:
+// il loro valore può cambiare senza che cambi nessuna dipendenza (es. NOW, RAND).
+const volatileDep = "volatile"
+
+// customFunction è una funzione registrata dall'applicazione tramite RegisterFunction
+type customFunction struct {
+	fn         func(params ...any) (any, error)
+	signatures []any
+	volatile   bool
+}
+
+var (
+	customFunctionsMu sync.RWMutex
+	customFunctions   = map[string]customFunction{}
+	// customFunctionsVersion cambia a ogni registrazione: invalida i programmi compilati in cache
+	customFunctionsVersion uint64
+)
+
+// RegisterFunction rende disponibile nelle formule una funzione pura (stessi argomenti -> stesso risultato).
+//
+// signatures sono opzionali e hanno lo stesso significato di expr.Function:
+// se presenti, gli argomenti vengono verificati già alla compilazione della formula.
+// La funzione può restituire un *FormulaError per produrre un codice "da foglio di calcolo" (#VALUE!, #NUM!, ...).
+//
+// Va chiamata prima di servire richieste (es. in main, prima di app.Start()).
+func RegisterFunction(name string, fn func(params ...any) (any, error), signatures ...any) error {
+	return registerFunction(name, fn, false, signatures)
+}
+
+// RegisterVolatileFunction come RegisterFunction, ma per funzioni il cui risultato cambia
+// anche a parità di argomenti (orario corrente, numeri casuali, servizi esterni, ...).
+// I nodi che le usano vengono ricalcolati da RecalculateVolatileCalculatedFields.
+func RegisterVolatileFunction(name string, fn func(params ...any) (any, error), signatures ...any) error {
+	return registerFunction(name, fn, true, signatures)
+}
+
+func registerFunction(name string, fn func(params ...any) (any, error), volatile bool, signatures []any) error {
+	if fn == nil {
+		return fmt.Errorf("calculatedfields: function %q is nil", name)
+	}
+	if !aliasRegex.MatchString(name) {
+		return fmt.Errorf("calculatedfields: function name %q must be a valid identifier (%s)", name, aliasPattern)
+	}
+	if _, reserved := reservedFormulaNames[name]; reserved {
+		return fmt.Errorf("calculatedfields: function name %q is a reserved formula keyword", name)
+	}
+
+	customFunctionsMu.Lock()
+	defer customFunctionsMu.Unlock()
+
+	if isBuiltinFunctionName(name) {
+		return fmt.Errorf("calculatedfields: function %q is already defined by the plugin", name)
+	}
+	if _, exists := customFunctions[name]; exists {
+		return fmt.Errorf("calculatedfields: function %q is already registered", name)
+	}
+
+	customFunctions[name] = customFunction{fn: fn, signatures: signatures, volatile: volatile}
+	customFunctionsVersion++
+	compiledPrograms.purge()
+	return nil
+}
+
+// isBuiltinFunctionName: funzioni fornite dal plugin (libreria standard, aggregati, COLUMN/LOOKUP, date)
+func isBuiltinFunctionName(name string) bool {
+	if _, ok := standardFunctions[name]; ok {
+		return true
+	}
+	if name == columnFunctionName || name == lookupFunctionName {
+		return true
+	}
+	if _, ok := aggregateFunctions[name]; ok {
+		return true
+	}
+	_, ok := dateFunctions[name]
+	return ok
+}
+
+// isFormulaFunctionName indica se il nome è già usato da una funzione di formula
+func isFormulaFunctionName(name string) bool {
+	if isBuiltinFunctionName(name) {
+		return true
+	}
+	customFunctionsMu.RLock()
+	defer customFunctionsMu.RUnlock()
+	_, ok := customFunctions[name]
+	return ok
+}
+
+// formulaCompileOptions registra libreria standard e funzioni custom come expr.Function
+// (con la propagazione dei valori di errore di errorValueFunction)
+func formulaCompileOptions() []expr.Option {
+	customFunctionsMu.RLock()
+	defer customFunctionsMu.RUnlock()
+
+	opts := make([]expr.Option, 0, len(standardFunctions)+len(customFunctions))
+	for _, name := range sortedKeys(standardFunctions) {
+		opts = append(opts, expr.Function(name, errorValueFunction(name, standardFunctions[name])))
+	}
+	for _, name := range sortedKeys(customFunctions) {
+		f := customFunctions[name]
+		opts = append(opts, expr.Function(name, errorValueFunction(name, f.fn), f.signatures...))
+	}
+	return opts
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formulaFunctionCalls restituisce i nomi delle funzioni "libere" chiamate nella formula
+// (non i builtin di expr, che il parser riconosce da solo, né i metodi x.f()).
+func formulaFunctionCalls(formula string) []string {
+	tree, err := parser.Parse(formula)
+	if err != nil {
+		return nil
+	}
+	v := &functionCallVisitor{}
+	ast.Walk(&tree.Node, v)
+	return v.names
+}
+
+type functionCallVisitor struct {
+	names []string
+}
+
+func (v *functionCallVisitor) Visit(node *ast.Node) {
+	if call, ok := (*node).(*ast.CallNode); ok {
+		if ident, ok := call.Callee.(*ast.IdentifierNode); ok {
+			v.names = append(v.names, ident.Value)
+		}
+	}
+}
+
+// unknownFunction restituisce la prima funzione chiamata nella formula che non è registrata
+func unknownFunction(formula string) (string, bool) {
+	for _, name := range formulaFunctionCalls(formula) {
+		if !isFormulaFunctionName(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// callsVolatileFunction indica se la formula usa almeno una funzione volatile
+func callsVolatileFunction(formula string) bool {
+	customFunctionsMu.RLock()
+	defer customFunctionsMu.RUnlock()
+
+	for _, name := range formulaFunctionCalls(formula) {
+		if dateFunctions[name] {
+			return true
+		}
+		if f, ok := customFunctions[name]; ok && f.volatile {
+			return true
+		}
+	}
+	return false
+}
+
+// RecalculateVolatileCalculatedFields ricalcola in un'unica transazione tutti i nodi
+// che usano funzioni volatili, propagando ai dipendenti.
+func RecalculateVolatileCalculatedFields(app core.App) error {
+	if !hasCalculatedFieldsField(app, "external_deps") {
+		return nil
+	}
+	return app.RunInTransaction(func(txApp core.App) error {
+		cfs, err := findCalculatedFieldsByExternalDep(txApp, volatileDep)
+		if err != nil {
+			return err
+		}
+		return reevaluateCalculatedFields(txApp, cfs)
+	})
+}
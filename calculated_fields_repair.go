@@ -0,0 +1,256 @@
+package calculatedfields
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// RepairReport è il risultato di RepairGraph
+type RepairReport struct {
+	// Checked è il numero di calculated_fields esaminati
+	Checked int `json:"checked"`
+	// Relinked sono i nodi il cui depends_on non corrispondeva alla formula
+	Relinked []RepairRelink `json:"relinked"`
+	// Dangling sono i nodi che citano record inesistenti (1005, 1007): ora valgono #REF!
+	Dangling []RepairIssue `json:"dangling"`
+	// Invalid sono i nodi con formule non risolvibili per altri motivi: ora valgono #REF!
+	Invalid []RepairIssue `json:"invalid"`
+	// Cycles sono i cicli trovati (es. ["a", "b", "a"]): i nodi coinvolti e i loro dipendenti valgono #REF!
+	Cycles [][]string `json:"cycles"`
+	// Recomputed sono i nodi il cui valore o errore è cambiato
+	Recomputed []string `json:"recomputed"`
+}
+
+// RepairRelink è un depends_on riscritto
+type RepairRelink struct {
+	Id           string   `json:"id"`
+	OldDependsOn []string `json:"old_depends_on"`
+	NewDependsOn []string `json:"new_depends_on"`
+}
+
+// RepairIssue è un nodo la cui formula non si può risolvere
+type RepairIssue struct {
+	Id      string `json:"id"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// RepairGraph riallinea il grafo ai testi delle formule (ad esempio dopo modifiche manuali a db,
+// un restore o un bug): in un'unica transazione ricostruisce depends_on di ogni calculated_field,
+// segnala riferimenti pendenti e cicli e ricalcola tutti i nodi in ordine topologico.
+// Gli hook dei calculated_fields non vengono eseguiti e Config.EvalTimeout non si applica.
+func RepairGraph(app core.App) (*RepairReport, error) {
+	// l'indice potrebbe non corrispondere al db se depends_on è stato modificato a mano
+	if err := RebuildGraphIndex(app); err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{
+		Relinked:   []RepairRelink{},
+		Dangling:   []RepairIssue{},
+		Invalid:    []RepairIssue{},
+		Cycles:     [][]string{},
+		Recomputed: []string{},
+	}
+
+	txErr := app.RunInTransaction(func(txApp core.App) error {
+		records, err := txApp.FindAllRecords("calculated_fields")
+		if err != nil {
+			return err
+		}
+		slices.SortFunc(records, func(a, b *core.Record) int { return strings.Compare(a.Id, b.Id) })
+		report.Checked = len(records)
+
+		before := make(map[string][2]string, len(records))
+		for _, rec := range records {
+			before[rec.Id] = [2]string{rec.GetString("value"), rec.GetString("error")}
+		}
+
+		// 1️⃣ depends_on ricostruito dalla formula (i cicli si cercano dopo, sul grafo completo)
+		broken := map[string]struct{}{}
+		for _, rec := range records {
+			oldDeps := rec.GetStringSlice("depends_on")
+			_, err := resolveDepsAndTxSave(txApp, rec, false)
+			if err == nil {
+				// formula con riferimenti validi ma non compilabile (1004, 1016)
+				_, err = compileNodeFormula(txApp, rec)
+			}
+			if err != nil {
+				issue, ok := repairIssueOf(rec.Id, err)
+				if !ok {
+					return err
+				}
+				if issue.Code == "1005" || issue.Code == "1007" {
+					report.Dangling = append(report.Dangling, issue)
+				} else {
+					report.Invalid = append(report.Invalid, issue)
+				}
+				broken[rec.Id] = struct{}{}
+				continue
+			}
+			newDeps := rec.GetStringSlice("depends_on")
+			if !sameIds(oldDeps, newDeps) {
+				report.Relinked = append(report.Relinked, RepairRelink{Id: rec.Id, OldDependsOn: oldDeps, NewDependsOn: newDeps})
+			}
+		}
+
+		// 2️⃣ ordine topologico di tutto il grafo: restano fuori i nodi in un ciclo e i loro dipendenti
+		index := graphIndexOf(txApp)
+		order, blocked := topologicalOrder(records, func(id string) []string { return index.parentsOf(txApp, id) })
+		for _, rec := range blocked {
+			cycle, err := findDependencyCycle(txApp, rec, index.parentsOf(txApp, rec.Id))
+			if err != nil {
+				return err
+			}
+			if cycle != nil && !containsCycle(report.Cycles, cycle) {
+				report.Cycles = append(report.Cycles, cycle)
+			}
+		}
+
+		// 3️⃣ nodi non valutabili: #REF!, che si propaga ai dipendenti
+		env := map[string]any{}
+		touched := ownerTouches{}
+		for _, rec := range records {
+			if _, ok := broken[rec.Id]; ok {
+				// depends_on non corrisponde più alla formula (può citare id inesistenti): svuotato
+				if err := saveResult(txApp, rec, "#REF!", "Reference to a missing node or invalid formula", env, []string{}); err != nil {
+					return err
+				}
+				touched.add(rec)
+			}
+		}
+		for _, rec := range blocked {
+			if _, ok := broken[rec.Id]; ok {
+				continue
+			}
+			if err := saveResult(txApp, rec, "#REF!", "Circular dependency", env, nil); err != nil {
+				return err
+			}
+			touched.add(rec)
+		}
+
+		// 4️⃣ ricalcolo di tutti gli altri nodi, una volta ciascuno
+		valid := make([]*core.Record, 0, len(order))
+		for _, rec := range order {
+			if _, ok := broken[rec.Id]; !ok {
+				valid = append(valid, rec)
+			}
+		}
+		// nessun EvalTimeout: una riparazione interrotta annullerebbe tutto
+		if err := evaluateInOrderUntil(txApp, valid, env, touched, time.Time{}); err != nil {
+			return err
+		}
+		if err := touched.apply(txApp); err != nil {
+			return err
+		}
+
+		for _, rec := range records {
+			if before[rec.Id] != [2]string{rec.GetString("value"), rec.GetString("error")} {
+				report.Recomputed = append(report.Recomputed, rec.Id)
+			}
+		}
+		return nil
+	})
+	if txErr != nil {
+		return nil, txErr
+	}
+	return report, nil
+}
+
+// repairIssueOf estrae codice e messaggio da un errore di validazione del plugin
+func repairIssueOf(id string, err error) (RepairIssue, bool) {
+	var apiErr *router.ApiError
+	if !errors.As(err, &apiErr) {
+		return RepairIssue{}, false
+	}
+	verrs, ok := apiErr.RawData().(validation.Errors)
+	if !ok {
+		return RepairIssue{}, false
+	}
+	keys := make([]string, 0, len(verrs))
+	for k := range verrs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if verr, ok := verrs[k].(validation.Error); ok {
+			return RepairIssue{Id: id, Code: verr.Code(), Message: verr.Message()}, true
+		}
+	}
+	return RepairIssue{Id: id, Code: "", Message: fmt.Sprint(err)}, true
+}
+
+// topologicalOrder ordina i nodi (Kahn) sugli archi interni all'insieme (parentsOf: depends_on e colonne lette);
+// blocked sono i nodi mai pronti: in un ciclo o dipendenti da un ciclo.
+func topologicalOrder(records []*core.Record, parentsOf func(id string) []string) (order []*core.Record, blocked []*core.Record) {
+	byId := make(map[string]*core.Record, len(records))
+	for _, rec := range records {
+		byId[rec.Id] = rec
+	}
+	pending := make(map[string]int, len(records))
+	children := map[string][]*core.Record{}
+	for _, rec := range records {
+		for _, dep := range parentsOf(rec.Id) {
+			if _, ok := byId[dep]; ok {
+				pending[rec.Id]++
+				children[dep] = append(children[dep], rec)
+			}
+		}
+	}
+
+	ready := []*core.Record{}
+	for _, rec := range records {
+		if pending[rec.Id] == 0 {
+			ready = append(ready, rec)
+		}
+	}
+	for len(ready) > 0 {
+		n := ready[0]
+		ready = ready[1:]
+		order = append(order, n)
+		for _, child := range children[n.Id] {
+			pending[child.Id]--
+			if pending[child.Id] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+	for _, rec := range records {
+		if pending[rec.Id] > 0 {
+			blocked = append(blocked, rec)
+		}
+	}
+	return order, blocked
+}
+
+// sameIds confronta due elenchi di id ignorando l'ordine
+func sameIds(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// containsCycle indica se il ciclo (a meno della rotazione) è già nell'elenco
+func containsCycle(cycles [][]string, cycle []string) bool {
+	key := cycleKey(cycle)
+	for _, c := range cycles {
+		if cycleKey(c) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func cycleKey(cycle []string) string {
+	nodes := slices.Clone(cycle[:len(cycle)-1])
+	slices.Sort(nodes)
+	return strings.Join(nodes, ",")
+}
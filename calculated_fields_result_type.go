@@ -0,0 +1,131 @@
+package calculatedfields
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// valori del campo result_type (vuoto = nessun vincolo, come json)
+const (
+	ResultTypeNumber  = "number"
+	ResultTypeInteger = "integer"
+	ResultTypeString  = "string"
+	ResultTypeBoolean = "boolean"
+	ResultTypeDate    = "date"
+	ResultTypeJSON    = "json"
+)
+
+var resultTypes = []string{ResultTypeNumber, ResultTypeInteger, ResultTypeString, ResultTypeBoolean, ResultTypeDate, ResultTypeJSON}
+
+// isNumericResultType: risultati che in modalità decimale vengono arrotondati a DecimalScale cifre
+func isNumericResultType(resultType string) bool {
+	return resultType == "" || resultType == ResultTypeNumber
+}
+
+// coerceResult converte il risultato della formula nel tipo dichiarato.
+// nil resta nil (valore vuoto) per ogni tipo; se la conversione non è possibile
+// restituisce #VALUE! e il messaggio per il campo error.
+func coerceResult(resultType string, v any, decimal bool, loc *time.Location) (any, string) {
+	if v == nil || resultType == "" || resultType == ResultTypeJSON {
+		return v, ""
+	}
+
+	switch resultType {
+	case ResultTypeNumber:
+		if r, ok := coerceRat(v); ok {
+			if decimal {
+				return r, ""
+			}
+			f, _ := r.Float64()
+			return f, ""
+		}
+
+	case ResultTypeInteger:
+		if r, ok := coerceRat(v); ok {
+			if !r.IsInt() || !r.Num().IsInt64() {
+				return "#VALUE!", fmt.Sprintf("The result %s is not an integer", ratText(r))
+			}
+			return r.Num().Int64(), ""
+		}
+
+	case ResultTypeString:
+		switch val := v.(type) {
+		case string:
+			return val, ""
+		case bool:
+			return strconv.FormatBool(val), ""
+		case time.Time:
+			return val.Format(time.RFC3339), ""
+		}
+		if r, ok := toRat(v); ok {
+			return ratText(r), ""
+		}
+
+	case ResultTypeBoolean:
+		switch val := v.(type) {
+		case bool:
+			return val, ""
+		case string:
+			if strings.EqualFold(strings.TrimSpace(val), "true") {
+				return true, ""
+			}
+			if strings.EqualFold(strings.TrimSpace(val), "false") {
+				return false, ""
+			}
+		default:
+			if r, ok := toRat(v); ok {
+				return r.Sign() != 0, ""
+			}
+		}
+
+	case ResultTypeDate:
+		// stesso formato dei campi data di PocketBase (UTC); il testo senza fuso è nella timezone configurata
+		if t, err := toTime("", 0, v, loc); err == nil {
+			if dt, err := types.ParseDateTime(t); err == nil {
+				return dt.String(), ""
+			}
+		}
+	}
+
+	return "#VALUE!", fmt.Sprintf("The result %s cannot be converted to the declared type %s", describeValue(v), resultType)
+}
+
+// coerceRat: numeri, booleani (1/0) e testo numerico
+func coerceRat(v any) (*big.Rat, bool) {
+	switch val := v.(type) {
+	case bool:
+		if val {
+			return big.NewRat(1, 1), true
+		}
+		return new(big.Rat), true
+	case string:
+		// SetString accetterebbe anche le frazioni ("1/3")
+		if strings.Contains(val, "/") {
+			return nil, false
+		}
+		return new(big.Rat).SetString(strings.TrimSpace(val))
+	default:
+		return toRat(v)
+	}
+}
+
+// describeValue: il valore in JSON se breve, altrimenti solo il tipo
+func describeValue(v any) string {
+	if b, err := json.Marshal(v); err == nil && len(b) <= 40 {
+		return string(b)
+	}
+	switch v.(type) {
+	case []any:
+		return "(array)"
+	case map[string]any:
+		return "(object)"
+	default:
+		return fmt.Sprintf("(%T)", v)
+	}
+}
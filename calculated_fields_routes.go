@@ -0,0 +1,64 @@
+package calculatedfields
+
+import (
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// prefisso delle route HTTP del plugin
+const routesPrefix = "/api/calculated_fields"
+
+// bindRoutes registra le route del plugin (solo superuser: agiscono senza le regole delle collection owner)
+func bindRoutes(app core.App) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		g := se.Router.Group(routesPrefix)
+		g.Bind(apis.RequireSuperuserAuth())
+		g.POST("/batch", batchUpdateHandler)
+		g.POST("/repair", repairHandler)
+		g.POST("/{id}/dry-run", dryRunHandler)
+		return se.Next()
+	})
+}
+
+// POST /api/calculated_fields/batch {"updates": [{"id": "...", "formula": "..."}]}
+func batchUpdateHandler(e *core.RequestEvent) error {
+	body := struct {
+		Updates []FormulaUpdate `json:"updates"`
+	}{}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Invalid batch request body", err)
+	}
+
+	records, err := UpdateFormulas(e.App, body.Updates)
+	if err != nil {
+		return err
+	}
+	return e.JSON(http.StatusOK, map[string]any{"records": records})
+}
+
+// POST /api/calculated_fields/{id}/dry-run {"formula": "..."}
+func dryRunHandler(e *core.RequestEvent) error {
+	body := struct {
+		Formula string `json:"formula"`
+	}{}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Invalid dry run request body", err)
+	}
+
+	nodes, err := DryRunFormula(e.App, e.Request.PathValue("id"), body.Formula)
+	if err != nil {
+		return err
+	}
+	return e.JSON(http.StatusOK, map[string]any{"nodes": nodes})
+}
+
+// POST /api/calculated_fields/repair
+func repairHandler(e *core.RequestEvent) error {
+	report, err := RepairGraph(e.App)
+	if err != nil {
+		return err
+	}
+	return e.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,53 @@
+package calculatedfields
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// selfIdentifier è la radice dei riferimenti relativi all'owner del nodo:
+// self.<owner_field> indica il calculated_field fratello sulla stessa riga owner.
+const selfIdentifier = "self"
+
+// selfReferenceField restituisce <owner_field> se l'identificatore è della forma self.<owner_field>
+func selfReferenceField(identifier string) (string, bool) {
+	field, ok := strings.CutPrefix(identifier, selfIdentifier+".")
+	if !ok || field == "" {
+		return "", false
+	}
+	return field, true
+}
+
+// findSiblingRecord cerca il calculated_field con lo stesso owner (collection + row) di rec
+// e owner_field indicato. Restituisce nil se non esiste.
+func findSiblingRecord(app core.App, rec *core.Record, field string) (*core.Record, error) {
+	return findOwnerCell(app, rec.GetString("owner_collection"), rec.GetString("owner_row"), field)
+}
+
+// findOwnerCell cerca il calculated_field collegato a collection/row.field. Restituisce nil se non esiste.
+func findOwnerCell(app core.App, collection, row, field string) (*core.Record, error) {
+	cell, err := app.FindFirstRecordByFilter(
+		"calculated_fields",
+		"owner_collection = {:col} && owner_row = {:row} && owner_field = {:field}",
+		dbx.Params{
+			"col":   collection,
+			"row":   row,
+			"field": field,
+		},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return cell, err
+}
+
+// isSibling indica se a e b appartengono alla stessa riga owner
+func isSibling(a, b *core.Record) bool {
+	return a.GetString("owner_collection") != "" &&
+		a.GetString("owner_collection") == b.GetString("owner_collection") &&
+		a.GetString("owner_row") == b.GetString("owner_row")
+}
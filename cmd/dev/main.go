@@ -27,7 +27,7 @@ func main() {
 		DefaultDataDir: dataDir,
 	})
 	// init plugin (o chiami calculatedfields.Bind... se non passi da xpb)
-	if err := (&calculatedfields.Plugin{}).Init(app); err != nil {
+	if err := (&calculatedfields.Plugin{Config: calculatedfields.DefaultConfig()}).Init(app); err != nil {
 		log.Fatal(err)
 	}
 
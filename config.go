@@ -0,0 +1,234 @@
+package calculatedfields
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/cron"
+)
+
+// configStoreKey è la chiave dell'app store in cui è salvata la Config del plugin
+const configStoreKey = "calculatedfields.config"
+
+// volatileCronJobId è l'id del job app.Cron() che ricalcola i nodi volatili
+const volatileCronJobId = "calculatedfields_volatile"
+
+// Config raccoglie le opzioni del plugin. Con xpb si imposta dal file pocketbuilds.toml
+// (sezione [calculatedfields]) o dalle env XPB__CALCULATEDFIELDS__<NOME>.
+//
+// Lo zero value NON equivale a DefaultConfig: SetConfig completa solo Timezone, DecimalRounding,
+// AsyncInterval ed EvalTimeout, mentre per gli altri campi lo zero è un valore valido
+// (VolatileCron "" = nessun ricalcolo schedulato, ProgramCacheSize 0 = nessuna cache,
+// Max* 0 = nessun limite, DecimalScale 0 = interi). Partire quindi da DefaultConfig().
+type Config struct {
+	// Timezone IANA (es. "Europe/Rome") usata da NOW/TODAY e dalle funzioni data.
+	Timezone string `json:"timezone" env:"TIMEZONE"`
+
+	// VolatileCron è l'espressione cron con cui ricalcolare i nodi che usano
+	// funzioni volatili (NOW, TODAY, ...). Stringa vuota = nessun ricalcolo schedulato.
+	VolatileCron string `json:"volatile_cron" env:"VOLATILE_CRON"`
+
+	// DecimalMode attiva l'aritmetica decimale esatta per tutti i nodi
+	// (il singolo nodo può scegliere con il campo number_mode: "float" o "decimal").
+	DecimalMode bool `json:"decimal_mode" env:"DECIMAL_MODE"`
+
+	// DecimalScale è il numero di cifre decimali dei risultati in modalità decimale.
+	DecimalScale int `json:"decimal_scale" env:"DECIMAL_SCALE"`
+
+	// DecimalRounding è la modalità di arrotondamento a DecimalScale cifre
+	// (half_up, half_even, down, up, floor, ceiling).
+	DecimalRounding string `json:"decimal_rounding" env:"DECIMAL_ROUNDING"`
+
+	// RowOrder è l'ordinamento delle righe per collection owner usato da prev.<field>
+	// (es. {"ledger": "position,created"}; default "created", id come spareggio).
+	// Da env: "ledger=position,created;queue=-priority".
+	RowOrder map[string]string `json:"row_order" env:"ROW_ORDER" envSeparator:";" envKeyValSeparator:"="`
+
+	// ProgramCacheSize è il numero massimo di formule compilate tenute in cache (LRU, 0 = nessuna cache).
+	// La cache è condivisa dal processo.
+	ProgramCacheSize int `json:"program_cache_size" env:"PROGRAM_CACHE_SIZE"`
+
+	// AsyncMode rimanda il ricalcolo dopo la modifica di una formula a un worker in background:
+	// il nodo e i suoi dipendenti restano con calc_status "pending" finché la coda non viene lavorata.
+	AsyncMode bool `json:"async_mode" env:"ASYNC_MODE"`
+
+	// AsyncInterval è ogni quanto il worker svuota la coda dei ricalcoli (durata Go, es. "1s").
+	AsyncInterval string `json:"async_interval" env:"ASYNC_INTERVAL"`
+
+	// Limiti di valutazione (0 = nessun limite); le violazioni sono rifiutate con il codice 1016.
+	// MaxFormulaLength è la lunghezza massima della formula in caratteri.
+	MaxFormulaLength int `json:"max_formula_length" env:"MAX_FORMULA_LENGTH"`
+
+	// MaxFormulaNodes è il numero massimo di nodi dell'albero sintattico di una formula.
+	MaxFormulaNodes int `json:"max_formula_nodes" env:"MAX_FORMULA_NODES"`
+
+	// MaxMemoryBudget è il budget di memoria di expr per una valutazione
+	// (elementi allocati e iterazioni di map/filter/reduce).
+	MaxMemoryBudget int `json:"max_memory_budget" env:"MAX_MEMORY_BUDGET"`
+
+	// MaxPropagationNodes è il numero massimo di calculated_fields ricalcolati da una propagazione.
+	MaxPropagationNodes int `json:"max_propagation_nodes" env:"MAX_PROPAGATION_NODES"`
+
+	// MaxDependencyDepth è la profondità massima della catena di dipendenti ricalcolata da una propagazione.
+	MaxDependencyDepth int `json:"max_dependency_depth" env:"MAX_DEPENDENCY_DEPTH"`
+
+	// EvalTimeout è il tempo massimo di una propagazione (durata Go, es. "10s"; "0" = nessun timeout).
+	// È controllato prima di ogni nodo e limita anche la singola valutazione: le query degli
+	// aggregati sono annullate e la VM ancora in esecuzione alla scadenza viene abbandonata.
+	EvalTimeout string `json:"eval_timeout" env:"EVAL_TIMEOUT"`
+
+	// loc è la Timezone già risolta (da withDefaults), per non caricarla a ogni valutazione
+	loc *time.Location
+}
+
+// DefaultConfig restituisce la configurazione usata se l'app non ne imposta una
+func DefaultConfig() Config {
+	return Config{
+		Timezone:         "UTC",
+		VolatileCron:     "*/5 * * * *",
+		DecimalScale:     2,
+		DecimalRounding:  RoundHalfUp,
+		ProgramCacheSize: 1024,
+		AsyncInterval:    "1s",
+
+		MaxFormulaLength:    4096,
+		MaxFormulaNodes:     10000,
+		MaxMemoryBudget:     1000000,
+		MaxPropagationNodes: 10000,
+		MaxDependencyDepth:  256,
+		EvalTimeout:         "10s",
+
+		loc: time.UTC,
+	}
+}
+
+// withDefaults completa i campi il cui zero value non è valido (es. da toml/env parziali)
+// e risolve la timezone; gli altri campi restano come sono (vedi Config)
+func (c Config) withDefaults() Config {
+	def := DefaultConfig()
+	if c.Timezone == "" {
+		c.Timezone = def.Timezone
+	}
+	c.loc = nil
+	if loc, err := time.LoadLocation(c.Timezone); err == nil {
+		c.loc = loc
+	}
+	if c.DecimalRounding == "" {
+		c.DecimalRounding = def.DecimalRounding
+	}
+	if c.AsyncInterval == "" {
+		c.AsyncInterval = def.AsyncInterval
+	}
+	if c.EvalTimeout == "" {
+		c.EvalTimeout = def.EvalTimeout
+	}
+	return c
+}
+
+// Validate verifica timezone, espressione cron, opzioni decimali, ordinamenti delle righe,
+// dimensione della cache, intervallo del worker asincrono e limiti di valutazione
+func (c Config) Validate() error {
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("calculatedfields: invalid timezone %q: %w", c.Timezone, err)
+	}
+	if c.VolatileCron != "" {
+		if _, err := cron.NewSchedule(c.VolatileCron); err != nil {
+			return fmt.Errorf("calculatedfields: invalid volatile_cron %q: %w", c.VolatileCron, err)
+		}
+	}
+	if c.DecimalScale < 0 {
+		return fmt.Errorf("calculatedfields: invalid decimal_scale %d: must be >= 0", c.DecimalScale)
+	}
+	if _, ok := roundingModes[c.DecimalRounding]; !ok {
+		return fmt.Errorf("calculatedfields: invalid decimal_rounding %q", c.DecimalRounding)
+	}
+	if c.ProgramCacheSize < 0 {
+		return fmt.Errorf("calculatedfields: invalid program_cache_size %d: must be >= 0", c.ProgramCacheSize)
+	}
+	if d, err := time.ParseDuration(c.AsyncInterval); err != nil || d <= 0 {
+		return fmt.Errorf("calculatedfields: invalid async_interval %q: must be a positive duration", c.AsyncInterval)
+	}
+	if d, err := time.ParseDuration(c.EvalTimeout); err != nil || d < 0 {
+		return fmt.Errorf("calculatedfields: invalid eval_timeout %q: must be a duration >= 0", c.EvalTimeout)
+	}
+	limits := map[string]int{
+		"max_formula_length":    c.MaxFormulaLength,
+		"max_formula_nodes":     c.MaxFormulaNodes,
+		"max_memory_budget":     c.MaxMemoryBudget,
+		"max_propagation_nodes": c.MaxPropagationNodes,
+		"max_dependency_depth":  c.MaxDependencyDepth,
+	}
+	for name, v := range limits {
+		if v < 0 {
+			return fmt.Errorf("calculatedfields: invalid %s %d: must be >= 0", name, v)
+		}
+	}
+	for collection, order := range c.RowOrder {
+		if _, err := rowOrderFields(order); err != nil {
+			return fmt.Errorf("calculatedfields: invalid row_order for %s: %w", collection, err)
+		}
+	}
+	return nil
+}
+
+// SetConfig imposta la configurazione del plugin per l'app indicata.
+// Va chiamata prima di BindCalculatedFieldsHooks.
+func SetConfig(app core.App, cfg Config) error {
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	app.Store().Set(configStoreKey, cfg)
+	compiledPrograms.resize(cfg.ProgramCacheSize)
+	return nil
+}
+
+// GetConfig restituisce la configurazione del plugin per l'app (DefaultConfig se non impostata)
+func GetConfig(app core.App) Config {
+	if cfg, ok := app.Store().Get(configStoreKey).(Config); ok {
+		return cfg
+	}
+	return DefaultConfig()
+}
+
+// asyncInterval restituisce l'intervallo del worker asincrono (1s se non valido)
+func (c Config) asyncInterval() time.Duration {
+	d, err := time.ParseDuration(c.AsyncInterval)
+	if err != nil || d <= 0 {
+		return time.Second
+	}
+	return d
+}
+
+// evalTimeout restituisce il timeout di una propagazione (0 = nessun timeout)
+func (c Config) evalTimeout() time.Duration {
+	d, err := time.ParseDuration(c.EvalTimeout)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// location restituisce la timezone configurata, risolta una volta sola da SetConfig (UTC se non valida)
+func (c Config) location() *time.Location {
+	if c.loc == nil {
+		return time.UTC
+	}
+	return c.loc
+}
+
+// bindVolatileCron registra (o rimuove) il job che ricalcola periodicamente i nodi volatili
+func bindVolatileCron(app core.App) error {
+	cfg := GetConfig(app)
+	if cfg.VolatileCron == "" {
+		app.Cron().Remove(volatileCronJobId)
+		return nil
+	}
+
+	return app.Cron().Add(volatileCronJobId, cfg.VolatileCron, func() {
+		if err := RecalculateVolatileCalculatedFields(app); err != nil {
+			app.Logger().Error("calculatedfields: volatile recalculation failed", "error", err)
+		}
+	})
+}
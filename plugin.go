@@ -2,14 +2,19 @@ package calculatedfields
 
 import (
 	"fmt"
+
+	"github.com/dop251/goja"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbuilds/xpb"
 )
 
-type Plugin struct {}
+type Plugin struct {
+	// opzioni del plugin (sezione [calculatedfields] di pocketbuilds.toml o env XPB__CALCULATEDFIELDS__*)
+	Config
+}
 
 func init() {
-	xpb.Register(&Plugin{})
+	xpb.Register(&Plugin{Config: DefaultConfig()})
 }
 
 // Name implements xpb.Plugin.
@@ -33,6 +38,10 @@ func (p *Plugin) Description() string {
 
 // Init implements xpb.Plugin.
 func (p *Plugin) Init(app core.App) error {
+	if err := SetConfig(app, p.Config); err != nil {
+		return err
+	}
+
 	// 1) Ensure schema when DB is ready
 	app.OnBootstrap().BindFunc(func(e *core.BootstrapEvent) error {
 		// IMPORTANT: execute PB bootstrap first so DB/DAO are ready,
@@ -54,3 +63,8 @@ func (p *Plugin) Init(app core.App) error {
 	return nil
 }
 
+
+// OnJsvmInit implements the xpb jsvm plugin hook: espone $calculatedFields in pb_hooks.
+func (p *Plugin) OnJsvmInit(app core.App, vm *goja.Runtime) {
+	BindJSVM(app, vm)
+}
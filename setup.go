@@ -63,6 +63,23 @@ func EnsureCalculatedFieldsSystemSchema(app core.App) error {
 		tf.Required = true
 	}
 
+	// alias (TextField, optional): nome leggibile usabile nelle formule al posto dell'id
+	{
+		f := col.Fields.GetByName("alias")
+		if f == nil {
+			col.Fields.Add(&core.TextField{Name: "alias"})
+			f = col.Fields.GetByName("alias")
+		}
+		tf, ok := f.(*core.TextField)
+		if !ok {
+			return fmt.Errorf("field 'alias' exists but is not TextField (got %T)", f)
+		}
+		tf.Name = "alias"
+		tf.Required = false
+		tf.Pattern = aliasPattern
+		tf.Max = 64
+	}
+
 	// value (JSONField)
 	{
 		f := col.Fields.GetByName("value")
@@ -157,6 +174,104 @@ func EnsureCalculatedFieldsSystemSchema(app core.App) error {
 		rf.CascadeDelete = false
 	}
 
+	// external_deps (JSONField): dipendenze non-calculated_fields (es. "collection:orders")
+	{
+		f := col.Fields.GetByName("external_deps")
+		if f == nil {
+			col.Fields.Add(&core.JSONField{Name: "external_deps"})
+			f = col.Fields.GetByName("external_deps")
+		}
+		jf, ok := f.(*core.JSONField)
+		if !ok {
+			return fmt.Errorf("field 'external_deps' exists but is not JSONField (got %T)", f)
+		}
+		jf.Name = "external_deps"
+		jf.Required = false
+	}
+
+	// error_source (TextField): nodo da cui è stato ereditato l'errore in value/error
+	{
+		f := col.Fields.GetByName("error_source")
+		if f == nil {
+			col.Fields.Add(&core.TextField{Name: "error_source"})
+			f = col.Fields.GetByName("error_source")
+		}
+		tf, ok := f.(*core.TextField)
+		if !ok {
+			return fmt.Errorf("field 'error_source' exists but is not TextField (got %T)", f)
+		}
+		tf.Name = "error_source"
+		tf.Required = false
+	}
+
+	// number_mode (SelectField): aritmetica float64 o decimale esatta; vuoto = Config.DecimalMode
+	{
+		f := col.Fields.GetByName("number_mode")
+		if f == nil {
+			col.Fields.Add(&core.SelectField{Name: "number_mode"})
+			f = col.Fields.GetByName("number_mode")
+		}
+		sf, ok := f.(*core.SelectField)
+		if !ok {
+			return fmt.Errorf("field 'number_mode' exists but is not SelectField (got %T)", f)
+		}
+		sf.Name = "number_mode"
+		sf.Values = []string{numberModeFloat, numberModeDecimal}
+		sf.MaxSelect = 1
+		sf.Required = false
+	}
+
+	// result_type (SelectField): tipo dichiarato del risultato; vuoto = qualsiasi valore JSON
+	{
+		f := col.Fields.GetByName("result_type")
+		if f == nil {
+			col.Fields.Add(&core.SelectField{Name: "result_type"})
+			f = col.Fields.GetByName("result_type")
+		}
+		sf, ok := f.(*core.SelectField)
+		if !ok {
+			return fmt.Errorf("field 'result_type' exists but is not SelectField (got %T)", f)
+		}
+		sf.Name = "result_type"
+		sf.Values = resultTypes
+		sf.MaxSelect = 1
+		sf.Required = false
+	}
+
+	// calc_status (SelectField): stato del valore (pending/computing = non aggiornato, ok, error); vuoto = ok
+	{
+		f := col.Fields.GetByName("calc_status")
+		if f == nil {
+			col.Fields.Add(&core.SelectField{Name: "calc_status"})
+			f = col.Fields.GetByName("calc_status")
+		}
+		sf, ok := f.(*core.SelectField)
+		if !ok {
+			return fmt.Errorf("field 'calc_status' exists but is not SelectField (got %T)", f)
+		}
+		sf.Name = "calc_status"
+		sf.Values = calcStatuses
+		sf.MaxSelect = 1
+		sf.Required = false
+	}
+
+	// error_code (SelectField): codice strutturato dell'errore (DIV0, VALUE, REF, ...); vuoto = nessun errore
+	{
+		f := col.Fields.GetByName("error_code")
+		if f == nil {
+			col.Fields.Add(&core.SelectField{Name: "error_code"})
+			f = col.Fields.GetByName("error_code")
+		}
+		sf, ok := f.(*core.SelectField)
+		if !ok {
+			return fmt.Errorf("field 'error_code' exists but is not SelectField (got %T)", f)
+		}
+		sf.Name = "error_code"
+		sf.Values = errorCodes
+		sf.MaxSelect = 1
+		sf.Required = false
+	}
+
 	// 4) Indexes: reset + apply known set (safe to overwrite)
 	//    NOTE: table name equals collection name for base collections.
 	//    If PocketBase ever changes table naming, you'll need to adjust.
@@ -165,6 +280,7 @@ func EnsureCalculatedFieldsSystemSchema(app core.App) error {
 		"CREATE INDEX IF NOT EXISTS `idx_cf_owner_row` ON `calculated_fields` (`owner_row`)",
 		"CREATE INDEX IF NOT EXISTS `idx_cf_owner_collection` ON `calculated_fields` (`owner_collection`)",
 		"CREATE INDEX IF NOT EXISTS `idx_cf_owner_field` ON `calculated_fields` (`owner_field`)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `idx_cf_alias_unique` ON `calculated_fields` (`alias`) WHERE `alias` != ''",
 	}
 
 	// 5) Save final schema
@@ -172,5 +288,60 @@ func EnsureCalculatedFieldsSystemSchema(app core.App) error {
 		return fmt.Errorf("cannot save %s schema: %w", name, err)
 	}
 
+	return ensureRecalculationJobsSchema(app)
+}
+
+// ensureRecalculationJobsSchema crea la coda dei ricalcoli asincroni (Config.AsyncMode).
+// È una collection di sistema: non ha regole API e gli hook del plugin la ignorano.
+func ensureRecalculationJobsSchema(app core.App) error {
+	col, _ := app.FindCollectionByNameOrId(recalculationJobsCollection)
+	if col == nil {
+		col = core.NewBaseCollection(recalculationJobsCollection)
+	}
+	col.System = true
+	col.ListRule = nil
+	col.ViewRule = nil
+	col.CreateRule = nil
+	col.UpdateRule = nil
+	col.DeleteRule = nil
+
+	// node (TextField, required): id del calculated_field da ricalcolare con i suoi dipendenti.
+	// Non è una relation, così la coda non diventa una collection owner.
+	{
+		f := col.Fields.GetByName("node")
+		if f == nil {
+			col.Fields.Add(&core.TextField{Name: "node"})
+			f = col.Fields.GetByName("node")
+		}
+		tf, ok := f.(*core.TextField)
+		if !ok {
+			return fmt.Errorf("field 'node' exists but is not TextField (got %T)", f)
+		}
+		tf.Name = "node"
+		tf.Required = true
+	}
+
+	// created (AutodateField): ordine di lavorazione
+	{
+		f := col.Fields.GetByName("created")
+		if f == nil {
+			col.Fields.Add(&core.AutodateField{Name: "created", OnCreate: true})
+			f = col.Fields.GetByName("created")
+		}
+		af, ok := f.(*core.AutodateField)
+		if !ok {
+			return fmt.Errorf("field 'created' exists but is not AutodateField (got %T)", f)
+		}
+		af.Name = "created"
+		af.OnCreate = true
+	}
+
+	col.Indexes = types.JSONArray[string]{
+		"CREATE UNIQUE INDEX IF NOT EXISTS `idx_cf_jobs_node_unique` ON `" + recalculationJobsCollection + "` (`node`)",
+	}
+
+	if err := app.Save(col); err != nil {
+		return fmt.Errorf("cannot save %s schema: %w", recalculationJobsCollection, err)
+	}
 	return nil
 }
@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// createOrdersCollection crea una collection "orders" (customer, total) da aggregare
+func createOrdersCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	col := core.NewBaseCollection("orders")
+	col.Fields.Add(&core.TextField{Name: "customer"})
+	col.Fields.Add(&core.NumberField{Name: "total"})
+	col.Fields.Add(&core.NumberField{Name: "margin", Hidden: true})
+	if err := app.Save(col); err != nil {
+		t.Fatalf("failed to create orders collection: %v", err)
+	}
+	return col
+}
+
+func saveOrder(t testing.TB, app *tests.TestApp, col *core.Collection, customer string, total float64) *core.Record {
+	t.Helper()
+
+	rec := core.NewRecord(col)
+	rec.Set("customer", customer)
+	rec.Set("total", total)
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("failed to save order: %v", err)
+	}
+	return rec
+}
+
+func TestCalculatedFields_Aggregates_RecalculateOnCollectionChanges(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	orders := createOrdersCollection(t, app)
+	saveOrder(t, app, orders, "abc", 10)
+	saveOrder(t, app, orders, "xyz", 99)
+
+	sum := savePoolCF(t, app, "aggregatesum001", "abc_total", `SUMWHERE("orders", "customer = 'abc'", "total")`)
+	count := savePoolCF(t, app, "aggregatecount1", "", `COUNTWHERE("orders", "customer = 'abc'")`)
+	avg := savePoolCF(t, app, "aggregateavg001", "", `AVGWHERE("orders", "customer = 'abc'", "total")`)
+	double := savePoolCF(t, app, "aggregatedbl001", "", "abc_total * 2")
+
+	checkFormulaUpdate(t, app, sum.Id, `SUMWHERE("orders", "customer = 'abc'", "total")`, "10", "")
+	checkFormulaUpdate(t, app, double.Id, "abc_total * 2", "20", "")
+
+	sum = mustFindCF(t, app, sum.Id)
+	var deps []string
+	if err := json.Unmarshal([]byte(sum.GetString("external_deps")), &deps); err != nil || len(deps) != 1 || deps[0] != "collection:orders" {
+		t.Fatalf("expected external_deps [collection:orders], got %s (%v)", sum.GetString("external_deps"), err)
+	}
+
+	// create
+	second := saveOrder(t, app, orders, "abc", 20)
+	checkFormulaUpdate(t, app, sum.Id, `SUMWHERE("orders", "customer = 'abc'", "total")`, "30", "")
+	checkFormulaUpdate(t, app, count.Id, `COUNTWHERE("orders", "customer = 'abc'")`, "2", "")
+	checkFormulaUpdate(t, app, avg.Id, `AVGWHERE("orders", "customer = 'abc'", "total")`, "15", "")
+	checkFormulaUpdate(t, app, double.Id, "abc_total * 2", "60", "")
+
+	// update
+	second.Set("total", 5)
+	if err := app.Save(second); err != nil {
+		t.Fatalf("failed to update order: %v", err)
+	}
+	checkFormulaUpdate(t, app, sum.Id, `SUMWHERE("orders", "customer = 'abc'", "total")`, "15", "")
+	checkFormulaUpdate(t, app, double.Id, "abc_total * 2", "30", "")
+
+	// delete
+	if err := app.Delete(second); err != nil {
+		t.Fatalf("failed to delete order: %v", err)
+	}
+	checkFormulaUpdate(t, app, sum.Id, `SUMWHERE("orders", "customer = 'abc'", "total")`, "10", "")
+	checkFormulaUpdate(t, app, count.Id, `COUNTWHERE("orders", "customer = 'abc'")`, "1", "")
+}
+
+func TestCalculatedFields_Aggregates_AvgOfNothingIsDivZero(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	createOrdersCollection(t, app)
+
+	avg := savePoolCF(t, app, "aggregateavg002", "", `AVGWHERE("orders", "customer = 'nobody'", "total")`)
+	checkFormulaUpdate(t, app, avg.Id, `AVGWHERE("orders", "customer = 'nobody'", "total")`, `"#DIV/0!"`, "AVGWHERE: no record matches the filter")
+
+	// è un errore di formula: IFERROR lo intercetta
+	checkFormulaUpdateAfterSave(t, app, avg.Id, `IFERROR(AVGWHERE("orders", "customer = 'nobody'", "total"), 0)`, "0")
+}
+
+func TestCalculatedFields_Aggregates_InvalidAggregateRejected(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	createOrdersCollection(t, app)
+	cf := savePoolCF(t, app, "aggregatebad001", "", "1")
+
+	formulas := []string{
+		`SUMWHERE("not_a_collection", "", "total")`,
+		`SUMWHERE("orders", "", "not_a_field")`,
+		`COUNTWHERE("calculated_fields", "")`,
+		`COUNTWHERE("ord" + "ers", "")`,
+		`SUMWHERE("orders", "")`,
+	}
+
+	for _, formula := range formulas {
+		cf = mustFindCF(t, app, cf.Id)
+		cf.Set("formula", formula)
+
+		err := app.Save(cf)
+		if err == nil {
+			t.Fatalf("expected error for formula %s", formula)
+		}
+		raw, _ := json.Marshal(err)
+		if !strings.Contains(string(raw), `"code":"1014"`) {
+			t.Fatalf("expected 1014 for %s, got %s (%v)", formula, raw, err)
+		}
+	}
+}
+
+// seedAggregateGuard prepara un admin che può aggiornare il CF ma elencare solo i propri ordini
+func seedAggregateGuard(t testing.TB, app *tests.TestApp, formula string) (cfId, token string) {
+	t.Helper()
+
+	orders := createOrdersCollection(t, app)
+	orders.ListRule = types.Pointer(`customer = @request.auth.id`)
+	if err := app.Save(orders); err != nil {
+		t.Fatalf("failed to update orders rules: %v", err)
+	}
+	saveOrder(t, app, orders, guardedAdminId, 10)
+	saveOrder(t, app, orders, "someoneelse0001", 99)
+
+	return seedGuardedCF(t, app, formula)
+}
+
+// guardedAdminId è l'admin (non superuser) di seedGuardedCF
+const guardedAdminId = "utadmaggr000001"
+
+// seedGuardedCF crea un CF che l'admin guardedAdminId può aggiornare e vedere, e ne restituisce il token
+func seedGuardedCF(t testing.TB, app *tests.TestApp, formula string) (cfId, token string) {
+	t.Helper()
+
+	ensureCalculatedFieldsViewRule(t, app)
+	adminId := guardedAdminId
+	seedAdmin(t, app, adminId, "ut_aggr")
+
+	ownerCol := "ut_owner_aggr"
+	ensureOwnerCollectionForUpdateGuard(t, app, ownerCol)
+	ownerRec := core.NewRecord(mustFindCol(t, app, ownerCol))
+	ownerRec.Set("id", "utowneraggr0001")
+	ownerRec.Set("allowed_admin", adminId)
+	if err := app.Save(ownerRec); err != nil {
+		t.Fatalf("failed to seed owner: %v", err)
+	}
+
+	cfId = "cfaggrguard0001"
+	createCF(t, app, cfId, formula, ownerCol, ownerRec.Id, "cf_orders", adminId)
+	return cfId, getAuthToken(app, "administrators", "ut_aggr")
+}
+
+func TestCalculatedFields_Aggregates_RequireListAccess(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		formula  string
+		status   int
+		expected []string
+	}{
+		{"aggregato sui soli record elencabili", `SUMWHERE("orders", "customer = '` + guardedAdminId + `'", "total")`, 200, []string{`"value":10`}},
+		{"aggregato su record non elencabili", `SUMWHERE("orders", "", "total")`, 403, []string{`"message":"Forbidden`}},
+		{"filtro non letterale", `SUMWHERE("orders", "customer = " + "'x'", "total")`, 403, []string{`"message":"Forbidden`}},
+		// i campi hidden non si possono sondare con il filtro né aggregare
+		{"filtro su campo hidden", `COUNTWHERE("orders", "customer = '` + guardedAdminId + `' && margin > 5")`, 400, []string{`"code":"1014"`}},
+		{"aggregato di un campo hidden", `SUMWHERE("orders", "customer = '` + guardedAdminId + `'", "margin")`, 400, []string{`"code":"1014"`}},
+	}
+
+	for _, s := range scenarios {
+		sc := &tests.ApiScenario{
+			Name:            s.name,
+			Method:          http.MethodPatch,
+			TestAppFactory:  setupTestApp,
+			ExpectedStatus:  s.status,
+			ExpectedContent: s.expected,
+		}
+		sc.BeforeTestFunc = func(t testing.TB, app *tests.TestApp, _ *core.ServeEvent) {
+			cfId, token := seedAggregateGuard(t, app, "1")
+			sc.URL = "/api/collections/calculated_fields/records/" + cfId
+			sc.Headers = map[string]string{"Authorization": token}
+			sc.Body = strings.NewReader(fmt.Sprintf(`{"formula":%q}`, s.formula))
+		}
+		sc.Test(t)
+	}
+}
+
+func TestCalculatedFields_Aggregates_MaskedWhenNotListable(t *testing.T) {
+	sc := &tests.ApiScenario{
+		Name:           "aggregato salvato da superuser, letto da chi non può elencare i record",
+		Method:         http.MethodGet,
+		TestAppFactory: setupTestApp,
+		ExpectedStatus: 200,
+		ExpectedContent: []string{
+			`"value":"#AUTH!"`,
+			`"error_code":"AUTH"`,
+		},
+		NotExpectedContent: []string{`"value":109`},
+	}
+	sc.BeforeTestFunc = func(t testing.TB, app *tests.TestApp, _ *core.ServeEvent) {
+		cfId, token := seedAggregateGuard(t, app, `SUMWHERE("orders", "", "total")`)
+		sc.URL = "/api/collections/calculated_fields/records/" + cfId
+		sc.Headers = map[string]string{"Authorization": token}
+	}
+	sc.Test(t)
+}
@@ -0,0 +1,260 @@
+package tests
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// seedPoolOwner crea (se manca) una riga owner in cf_owner_pool
+func seedPoolOwner(t testing.TB, app *tests.TestApp, id string) {
+	t.Helper()
+
+	if _, err := app.FindRecordById("cf_owner_pool", id); err == nil {
+		return
+	}
+
+	ownerCol, err := app.FindCollectionByNameOrId("cf_owner_pool")
+	if err != nil {
+		t.Fatalf("cannot find owner collection cf_owner_pool: %v", err)
+	}
+
+	r := core.NewRecord(ownerCol)
+	r.Set("id", id)
+	if err := app.UnsafeWithoutHooks().Save(r); err != nil {
+		t.Fatalf("failed to seed owner cf_owner_pool/%s: %v", id, err)
+	}
+}
+
+// savePoolCF crea un calculated_field con owner dedicato in cf_owner_pool (save normale, con hook)
+func savePoolCF(t testing.TB, app *tests.TestApp, id, alias, formula string) *core.Record {
+	t.Helper()
+
+	ownerRow := "cf_owner_" + id
+	seedPoolOwner(t, app, ownerRow)
+
+	cfCol, err := app.FindCollectionByNameOrId("calculated_fields")
+	if err != nil {
+		t.Fatalf("cannot find calculated_fields: %v", err)
+	}
+
+	rec := core.NewRecord(cfCol)
+	rec.Set("id", id)
+	rec.Set("alias", alias)
+	rec.Set("formula", formula)
+	rec.Set("owner_collection", "cf_owner_pool")
+	rec.Set("owner_row", ownerRow)
+	rec.Set("owner_field", "cf")
+
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("failed to create calculated_fields/%s: %v", id, err)
+	}
+	return rec
+}
+
+func mustFindCF(t testing.TB, app *tests.TestApp, id string) *core.Record {
+	t.Helper()
+
+	rec, err := app.FindRecordById("calculated_fields", id)
+	if err != nil {
+		t.Fatalf("cannot find calculated_fields/%s: %v", id, err)
+	}
+	return rec
+}
+
+func TestCalculatedFields_Alias_ResolvesDepsAndEvaluates(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	vat := savePoolCF(t, app, "aliasvatrate001", "vat_rate", "0.2")
+	net := savePoolCF(t, app, "aliasnettotal01", "net_total", "100")
+	tax := savePoolCF(t, app, "aliastaxamount1", "", "vat_rate * net_total")
+
+	tax = mustFindCF(t, app, tax.Id)
+	if got := tax.GetString("value"); got != "20" {
+		t.Fatalf("expected value 20, got %s (error=%q)", got, tax.GetString("error"))
+	}
+
+	deps := tax.GetStringSlice("depends_on")
+	sort.Strings(deps)
+	want := []string{vat.Id, net.Id}
+	sort.Strings(want)
+	if !reflect.DeepEqual(deps, want) {
+		t.Fatalf("expected depends_on %v, got %v", want, deps)
+	}
+
+	// la propagazione passa anche dai nodi referenziati per alias
+	vat = mustFindCF(t, app, vat.Id)
+	vat.Set("formula", "0.1")
+	if err := app.Save(vat); err != nil {
+		t.Fatalf("failed to update vat_rate: %v", err)
+	}
+	checkFormulaUpdate(t, app, tax.Id, "vat_rate * net_total", "10", "")
+}
+
+func TestCalculatedFields_Alias_RenameRewritesDependentFormulas(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	vat := savePoolCF(t, app, "aliasrenamevat1", "vat_rate", "0.2")
+	savePoolCF(t, app, "aliasrenamenet1", "net_total", "100")
+	tax := savePoolCF(t, app, "aliasrenametax1", "", `vat_rate * net_total + len("vat_rate")`)
+
+	vat = mustFindCF(t, app, vat.Id)
+	vat.Set("alias", "vat")
+	if err := app.Save(vat); err != nil {
+		t.Fatalf("failed to rename alias: %v", err)
+	}
+	// la stringa letterale non deve essere toccata
+	checkFormulaUpdate(t, app, tax.Id, `vat * net_total + len("vat_rate")`, "28", "")
+
+	// togliendo l'alias il riferimento torna all'id
+	vat = mustFindCF(t, app, vat.Id)
+	vat.Set("alias", "")
+	if err := app.Save(vat); err != nil {
+		t.Fatalf("failed to clear alias: %v", err)
+	}
+	checkFormulaUpdate(t, app, tax.Id, vat.Id+` * net_total + len("vat_rate")`, "28", "")
+}
+
+func TestCalculatedFields_Alias_DeleteReplacesAliasWithRef(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	vat := savePoolCF(t, app, "aliasdeletevat1", "vat_rate", "0.2")
+	tax := savePoolCF(t, app, "aliasdeletetax1", "", "vat_rate * 100")
+
+	if err := app.Delete(vat); err != nil {
+		t.Fatalf("failed to delete vat_rate: %v", err)
+	}
+
+	checkFormulaUpdate(t, app, tax.Id, "#REF! * 100", `"#REF!"`, "Formula contains reference to missing node (#REF!)")
+}
+
+func TestCalculatedFields_Alias_Validation(t *testing.T) {
+	autApp, _ := tests.NewTestApp("../tests/pb_data")
+	defer autApp.Cleanup()
+
+	superAuthHeader := map[string]string{"Authorization": getSuperuserToken(t, autApp)}
+
+	seed := func(t testing.TB, app *tests.TestApp, _ *core.ServeEvent) {
+		seedPoolOwner(t, app, "cf_owner_aliasvalidation")
+		savePoolCF(t, app, "aliasexisting01", "existing_alias", "1")
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "alias duplicato rifiutato",
+			Method: http.MethodPost,
+			URL:    "/api/collections/calculated_fields/records",
+			Body: strings.NewReader(`{
+  "formula": "1",
+  "alias": "existing_alias",
+  "owner_collection": "cf_owner_pool",
+  "owner_row": "cf_owner_aliasvalidation",
+  "owner_field": "cf"
+}`),
+			Headers:         superAuthHeader,
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  seed,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"code":"1013"`},
+		},
+		{
+			Name:   "alias riservato rifiutato",
+			Method: http.MethodPost,
+			URL:    "/api/collections/calculated_fields/records",
+			Body: strings.NewReader(`{
+  "formula": "1",
+  "alias": "true",
+  "owner_collection": "cf_owner_pool",
+  "owner_row": "cf_owner_aliasvalidation",
+  "owner_field": "cf"
+}`),
+			Headers:         superAuthHeader,
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  seed,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"code":"1013"`},
+		},
+		{
+			Name:   "alias uguale all'id di un altro nodo rifiutato",
+			Method: http.MethodPost,
+			URL:    "/api/collections/calculated_fields/records",
+			Body: strings.NewReader(`{
+  "formula": "1",
+  "alias": "aliasexisting01",
+  "owner_collection": "cf_owner_pool",
+  "owner_row": "cf_owner_aliasvalidation",
+  "owner_field": "cf"
+}`),
+			Headers:         superAuthHeader,
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  seed,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"code":"1013"`},
+		},
+		{
+			Name:   "alias non identificatore rifiutato",
+			Method: http.MethodPost,
+			URL:    "/api/collections/calculated_fields/records",
+			Body: strings.NewReader(`{
+  "formula": "1",
+  "alias": "1-bad alias",
+  "owner_collection": "cf_owner_pool",
+  "owner_row": "cf_owner_aliasvalidation",
+  "owner_field": "cf"
+}`),
+			Headers:         superAuthHeader,
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  seed,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"code":"1013"`},
+		},
+		{
+			Name:   "self-reference tramite alias",
+			Method: http.MethodPost,
+			URL:    "/api/collections/calculated_fields/records",
+			Body: strings.NewReader(`{
+  "formula": "my_self + 1",
+  "alias": "my_self",
+  "owner_collection": "cf_owner_pool",
+  "owner_row": "cf_owner_aliasvalidation",
+  "owner_field": "cf"
+}`),
+			Headers:         superAuthHeader,
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  seed,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"code":"1002"`},
+		},
+		{
+			Name:   "formula con alias esistente",
+			Method: http.MethodPost,
+			URL:    "/api/collections/calculated_fields/records",
+			Body: strings.NewReader(`{
+  "formula": "existing_alias + 41",
+  "owner_collection": "cf_owner_pool",
+  "owner_row": "cf_owner_aliasvalidation",
+  "owner_field": "cf"
+}`),
+			Headers:        superAuthHeader,
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: seed,
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"value":42`,
+				`"depends_on":["aliasexisting01"]`,
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/tests"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func enableAsyncMode(t testing.TB, app *tests.TestApp) {
+	t.Helper()
+
+	cfg := calculatedfields.GetConfig(app)
+	cfg.AsyncMode = true
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+}
+
+func checkCalcStatus(t testing.TB, app *tests.TestApp, id, expectedStatus, expectedValue string) {
+	t.Helper()
+
+	rec := mustFindCF(t, app, id)
+	if got := rec.GetString("calc_status"); got != expectedStatus {
+		t.Errorf("calc_status errato per %s. Atteso: %s, Ottenuto: %s", id, expectedStatus, got)
+	}
+	if got := rec.GetString("value"); got != expectedValue {
+		t.Errorf("Valore errato per %s. Atteso: %s, Ottenuto: %s", id, expectedValue, got)
+	}
+}
+
+func countRecalculationJobs(t testing.TB, app *tests.TestApp) int {
+	t.Helper()
+
+	n, err := app.CountRecords("calculated_fields_jobs")
+	if err != nil {
+		t.Fatalf("cannot count jobs: %v", err)
+	}
+	return int(n)
+}
+
+func TestCalculatedFields_Async_EnqueuesAndMarksStale(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "asyncnodea00001", "async_a", "1")
+	b := savePoolCF(t, app, "asyncnodeb00001", "", "async_a * 2")
+	checkCalcStatus(t, app, a.Id, "ok", "1")
+	checkCalcStatus(t, app, b.Id, "ok", "2")
+
+	enableAsyncMode(t, app)
+
+	a = mustFindCF(t, app, a.Id)
+	a.Set("formula", "5")
+	if err := app.Save(a); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if got := a.GetString("calc_status"); got != "pending" {
+		t.Fatalf("expected the saved record to be pending, got %q", got)
+	}
+	a.Set("formula", "6")
+	if err := app.Save(a); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	// valori vecchi, marcati come non aggiornati
+	checkCalcStatus(t, app, a.Id, "pending", "1")
+	checkCalcStatus(t, app, b.Id, "pending", "2")
+	if n := countRecalculationJobs(t, app); n != 1 {
+		t.Fatalf("expected one queued job, got %d", n)
+	}
+
+	processed, err := calculatedfields.ProcessRecalculationQueue(app)
+	if err != nil {
+		t.Fatalf("ProcessRecalculationQueue failed: %v", err)
+	}
+	if processed != 1 {
+		t.Fatalf("expected 1 processed job, got %d", processed)
+	}
+	checkCalcStatus(t, app, a.Id, "ok", "6")
+	checkCalcStatus(t, app, b.Id, "ok", "12")
+	if n := countRecalculationJobs(t, app); n != 0 {
+		t.Fatalf("expected an empty queue, got %d jobs", n)
+	}
+}
+
+func TestCalculatedFields_Async_ErrorStatus(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "asyncerrora0001", "async_err_a", "1")
+	b := savePoolCF(t, app, "asyncerrorb0001", "", "async_err_a + 1")
+
+	enableAsyncMode(t, app)
+
+	a = mustFindCF(t, app, a.Id)
+	a.Set("formula", "1/0")
+	if err := app.Save(a); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if _, err := calculatedfields.ProcessRecalculationQueue(app); err != nil {
+		t.Fatalf("ProcessRecalculationQueue failed: %v", err)
+	}
+	checkCalcStatus(t, app, a.Id, "error", `"#DIV/0!"`)
+	checkCalcStatus(t, app, b.Id, "error", `"#DIV/0!"`)
+}
+
+func TestCalculatedFields_Async_SyntaxErrorIsRejectedImmediately(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "asyncsyntaxa001", "", "1")
+	enableAsyncMode(t, app)
+
+	a = mustFindCF(t, app, a.Id)
+	a.Set("formula", "1 +")
+	err := app.Save(a)
+	if err == nil {
+		t.Fatal("expected a syntax error")
+	}
+	raw, _ := json.Marshal(err)
+	if !strings.Contains(string(raw), `"code":"1004"`) {
+		t.Fatalf("expected error code 1004, got %s", raw)
+	}
+	checkCalcStatus(t, app, a.Id, "ok", "1")
+	if n := countRecalculationJobs(t, app); n != 0 {
+		t.Fatalf("expected no queued job, got %d", n)
+	}
+}
+
+func TestCalculatedFields_Async_FailingJobDoesNotBlockTheBatch(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "asyncbatcha0001", "async_batch_a", "1")
+	b := savePoolCF(t, app, "asyncbatchb0001", "async_batch_b", "1")
+	b1 := savePoolCF(t, app, "asyncbatchb0002", "async_batch_b1", "async_batch_b + 1")
+	b2 := savePoolCF(t, app, "asyncbatchb0003", "", "async_batch_b1 + 1")
+
+	enableAsyncMode(t, app)
+	for id, formula := range map[string]string{a.Id: "7", b.Id: "5"} {
+		rec := mustFindCF(t, app, id)
+		rec.Set("formula", formula)
+		if err := app.Save(rec); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+
+	// il sottografo di b supera il limite già nella fase computing: a va comunque ricalcolato
+	cfg := calculatedfields.GetConfig(app)
+	cfg.MaxPropagationNodes = 2
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+
+	processed, err := calculatedfields.ProcessRecalculationQueue(app)
+	if err != nil {
+		t.Fatalf("ProcessRecalculationQueue failed: %v", err)
+	}
+	if processed != 2 {
+		t.Fatalf("expected 2 processed jobs, got %d", processed)
+	}
+	checkCalcStatus(t, app, a.Id, "ok", "7")
+	// nessun dipendente resta pending
+	checkCalcStatus(t, app, b.Id, "error", "1")
+	checkCalcStatus(t, app, b1.Id, "error", "2")
+	checkCalcStatus(t, app, b2.Id, "error", "3")
+	if n := countRecalculationJobs(t, app); n != 0 {
+		t.Fatalf("expected an empty queue, got %d jobs", n)
+	}
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/tests"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func TestCalculatedFields_Batch_SinglePropagationPass(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "batchnodea00001", "batch_a", "1")
+	b := savePoolCF(t, app, "batchnodeb00001", "batch_b", "2")
+	d := savePoolCF(t, app, "batchnoded00001", "", "DIAMOND_PROBE(batch_a + batch_b)")
+
+	before := diamondProbeCalls.Load()
+	records, err := calculatedfields.UpdateFormulas(app, []calculatedfields.FormulaUpdate{
+		{Id: a.Id, Formula: "10"},
+		{Id: b.Id, Formula: "batch_a * 2"},
+	})
+	if err != nil {
+		t.Fatalf("UpdateFormulas failed: %v", err)
+	}
+	if len(records) != 2 || records[1].GetString("value") != "20" {
+		t.Fatalf("unexpected batch result: %v", records)
+	}
+
+	checkFormulaUpdate(t, app, a.Id, "10", "10", "")
+	checkFormulaUpdate(t, app, b.Id, "batch_a * 2", "20", "")
+	checkFormulaUpdate(t, app, d.Id, "DIAMOND_PROBE(batch_a + batch_b)", "30", "")
+	if calls := diamondProbeCalls.Load() - before; calls != 1 {
+		t.Fatalf("expected the common dependent to be evaluated once, got %d", calls)
+	}
+}
+
+func TestCalculatedFields_Batch_CyclesOnCombinedGraph(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "batchcyclea0001", "cyc_a", "1")
+	b := savePoolCF(t, app, "batchcycleb0001", "cyc_b", "cyc_a + 1")
+
+	// A dipende da B solo sul grafo parziale: nel batch A diventa una costante
+	if _, err := calculatedfields.UpdateFormulas(app, []calculatedfields.FormulaUpdate{
+		{Id: a.Id, Formula: "cyc_b + 1"},
+		{Id: a.Id, Formula: "5"},
+	}); err == nil {
+		t.Fatal("expected error for duplicate updates")
+	}
+	if _, err := calculatedfields.UpdateFormulas(app, []calculatedfields.FormulaUpdate{
+		{Id: b.Id, Formula: "7"},
+		{Id: a.Id, Formula: "cyc_b + 1"},
+	}); err != nil {
+		t.Fatalf("expected batch to succeed, got %v", err)
+	}
+	checkFormulaUpdate(t, app, a.Id, "cyc_b + 1", "8", "")
+
+	// ciclo sul grafo combinato: rifiutato con il percorso, nessuna modifica applicata
+	_, err := calculatedfields.UpdateFormulas(app, []calculatedfields.FormulaUpdate{
+		{Id: b.Id, Formula: "cyc_a * 2"},
+		{Id: a.Id, Formula: "cyc_b + 1"},
+	})
+	raw, _ := json.Marshal(err)
+	if err == nil || !strings.Contains(string(raw), `"code":"1003"`) {
+		t.Fatalf("expected 1003, got %s (%v)", raw, err)
+	}
+	checkFormulaUpdate(t, app, b.Id, "7", "7", "")
+}
+
+func TestCalculatedFields_Batch_HTTP(t *testing.T) {
+	autApp, _ := tests.NewTestApp("../tests/pb_data")
+	superAuthHeader := map[string]string{"Authorization": getSuperuserToken(t, autApp)}
+	body := `{"updates": [
+		{"id": "yysba8o7a6773c3", "formula": "10"},
+		{"id": "c03u7o5plc4hucf", "formula": "yysba8o7a6773c3 * 3"}
+	]}`
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "batch senza superuser",
+			Method:          http.MethodPost,
+			URL:             "/api/calculated_fields/batch",
+			Body:            strings.NewReader(body),
+			TestAppFactory:  setupTestApp,
+			ExpectedStatus:  401,
+			ExpectedContent: []string{`"data":{}`},
+		},
+		{
+			Name:           "batch aggiorna le formule e propaga",
+			Method:         http.MethodPost,
+			URL:            "/api/calculated_fields/batch",
+			Body:           strings.NewReader(body),
+			Headers:        superAuthHeader,
+			TestAppFactory: setupTestApp,
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"id":"yysba8o7a6773c3"`,
+				`"value":10`,
+				`"id":"c03u7o5plc4hucf"`,
+				`"value":30`,
+			},
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				// C = B + 2
+				checkFormulaUpdate(t, app, "y3hvc2dtuhp2jjh", "c03u7o5plc4hucf+ 2", "32", "")
+			},
+		},
+		{
+			Name:            "batch con nodo inesistente",
+			Method:          http.MethodPost,
+			URL:             "/api/calculated_fields/batch",
+			Body:            strings.NewReader(`{"updates": [{"id": "missingnode0001", "formula": "1"}]}`),
+			Headers:         superAuthHeader,
+			TestAppFactory:  setupTestApp,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"code":"1005"`},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestCalculatedFields_Column_AggregatesOwnerField(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	q1 := createBookingQueue(t, app, "columnqueue0001")
+	q2 := createBookingQueue(t, app, "columnqueue0002")
+	setOwnerFieldFormula(t, app, q1, "act_fx", "10")
+	setOwnerFieldFormula(t, app, q2, "act_fx", "5")
+
+	filtered := `SUM(COLUMN("booking_queue", "act_fx", "id ~ 'columnqueue'"))`
+	total := savePoolCF(t, app, "columntotal0001", "col_total", filtered)
+	checkFormulaUpdate(t, app, total.Id, filtered, "15", "")
+
+	countFormula := `len(COLUMN("booking_queue", "act_fx"))`
+	count := savePoolCF(t, app, "columncount0001", "", countFormula)
+	members, err := app.CountRecords("calculated_fields", dbx.HashExp{"owner_collection": "booking_queue", "owner_field": "act_fx"})
+	if err != nil {
+		t.Fatalf("failed to count column members: %v", err)
+	}
+	checkFormulaUpdate(t, app, count.Id, countFormula, fmt.Sprint(members), "")
+
+	// le celle non finiscono in depends_on: l'arco colonna -> aggregatore sta nell'indice del grafo
+	if deps := mustFindCF(t, app, count.Id).GetStringSlice("depends_on"); len(deps) != 0 {
+		t.Fatalf("expected an empty depends_on for a COLUMN reader, got %v", deps)
+	}
+
+	// modifica di una cella: l'aggregatore e i suoi dipendenti si aggiornano
+	doubled := savePoolCF(t, app, "columndouble001", "", "col_total * 2")
+	setOwnerFieldFormula(t, app, q2, "act_fx", "7")
+	checkFormulaUpdate(t, app, total.Id, filtered, "17", "")
+	checkFormulaUpdate(t, app, doubled.Id, "col_total * 2", "34", "")
+
+	// nuova riga owner: la cella entra nella colonna
+	q3 := createBookingQueue(t, app, "columnqueue0003")
+	checkFormulaUpdate(t, app, count.Id, countFormula, fmt.Sprint(members+1), "")
+	setOwnerFieldFormula(t, app, q3, "act_fx", "3")
+	checkFormulaUpdate(t, app, total.Id, filtered, "20", "")
+	checkFormulaUpdate(t, app, doubled.Id, "col_total * 2", "40", "")
+
+	// riga owner eliminata: la cella esce dalla colonna senza #REF!
+	if err := app.Delete(q1); err != nil {
+		t.Fatalf("failed to delete queue: %v", err)
+	}
+	checkFormulaUpdate(t, app, total.Id, filtered, "10", "")
+	checkFormulaUpdate(t, app, count.Id, countFormula, fmt.Sprint(members), "")
+	checkFormulaUpdate(t, app, doubled.Id, "col_total * 2", "20", "")
+}
+
+func TestCalculatedFields_Column_FilterFollowsOwnerChanges(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	q1 := createBookingQueue(t, app, "columnfilter001")
+	q2 := createBookingQueue(t, app, "columnfilter002")
+	setOwnerFieldFormula(t, app, q1, "act_fx", "4")
+	setOwnerFieldFormula(t, app, q2, "act_fx", "6")
+
+	formula := `SUM(COLUMN("booking_queue", "act_fx", "id ~ 'columnfilter' && queue_name ~ 'vip'"))`
+	rec := savePoolCF(t, app, "columnfiltsum01", "", formula)
+	checkFormulaUpdate(t, app, rec.Id, formula, "0", "")
+
+	q2.Set("queue_name", "vip lane")
+	if err := app.Save(q2); err != nil {
+		t.Fatalf("failed to rename queue: %v", err)
+	}
+	checkFormulaUpdate(t, app, rec.Id, formula, "6", "")
+}
+
+func TestCalculatedFields_Column_ErrorsAndValidation(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	q1 := createBookingQueue(t, app, "columnerrors001")
+	createBookingQueue(t, app, "columnerrors002")
+	setOwnerFieldFormula(t, app, q1, "act_fx", "1 / 0")
+
+	formula := `SUM(COLUMN("booking_queue", "act_fx", "id ~ 'columnerrors'"))`
+	rec := savePoolCF(t, app, "columnerrsum001", "", formula)
+	checkFormulaUpdate(t, app, rec.Id, formula, `"#DIV/0!"`,
+		"Inherited error from "+q1.GetString("act_fx")+": Division by zero or infinite result")
+
+	guarded := `SUM(map(COLUMN("booking_queue", "act_fx", "id ~ 'columnerrors'"), IFERROR(#, 0)))`
+	checkFormulaUpdate(t, app, savePoolCF(t, app, "columnerrsafe01", "", guarded).Id, guarded, "0", "")
+
+	invalid := map[string]string{
+		`COLUMN("booking_queue", "queue_name")`:  "1014",
+		`COLUMN("missing_collection", "act_fx")`: "1014",
+		`COLUMN("booking_queue")`:                "1014",
+		`COLUMN(owner.queue_name, "act_fx")`:     "1014",
+		`SUM(COLUMN("booking_queue", "min_fx"))`: "1003", // la cella aggregherebbe la propria colonna
+	}
+	cellId := q1.GetString("min_fx")
+	for formula, code := range invalid {
+		cf := mustFindCF(t, app, cellId)
+		cf.Set("formula", formula)
+
+		err := app.Save(cf)
+		if err == nil {
+			t.Fatalf("expected error for formula %s", formula)
+		}
+		raw, _ := json.Marshal(err)
+		if !strings.Contains(string(raw), `"code":"`+code+`"`) {
+			t.Fatalf("expected %s for %s, got %s (%v)", code, formula, raw, err)
+		}
+	}
+
+	// una cella della colonna che legge l'aggregatore chiude un ciclo (arco colonna -> aggregatore)
+	cell := mustFindCF(t, app, q1.GetString("act_fx"))
+	cell.Set("formula", rec.Id+" + 1")
+	err := app.Save(cell)
+	raw, _ := json.Marshal(err)
+	if err == nil || !strings.Contains(string(raw), `"code":"1003"`) {
+		t.Fatalf("expected 1003 for a cell reading its aggregator, got %s (%v)", raw, err)
+	}
+}
+
+func TestCalculatedFields_Column_FilterRequiresListAccess(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		formula  string
+		status   int
+		expected string
+	}{
+		// celle visibili all'admin, nessuna lettura diretta di booking_queue
+		{"colonna senza filtro", `len(COLUMN("booking_queue", "act_fx"))`, 200, `"calc_status":"ok"`},
+		// il filtro legge le righe di booking_queue, che l'admin senza ruolo non può elencare
+		{"colonna filtrata", `len(COLUMN("booking_queue", "act_fx", "id != ''"))`, 403, `"message":"Forbidden`},
+	}
+
+	for _, s := range scenarios {
+		sc := &tests.ApiScenario{
+			Name:            s.name,
+			Method:          http.MethodPatch,
+			TestAppFactory:  setupTestApp,
+			ExpectedStatus:  s.status,
+			ExpectedContent: []string{s.expected},
+		}
+		sc.BeforeTestFunc = func(t testing.TB, app *tests.TestApp, _ *core.ServeEvent) {
+			createBookingQueue(t, app, "columnguard0001")
+			cfId, token := seedGuardedCF(t, app, "1")
+			_, err := app.DB().Update("calculated_fields",
+				dbx.Params{"allowed_view_admin": guardedAdminId},
+				dbx.HashExp{"owner_collection": "booking_queue"},
+			).Execute()
+			if err != nil {
+				t.Fatalf("failed to share the booking_queue cells: %v", err)
+			}
+			sc.URL = "/api/collections/calculated_fields/records/" + cfId
+			sc.Headers = map[string]string{"Authorization": token}
+			sc.Body = strings.NewReader(fmt.Sprintf(`{"formula":%q}`, s.formula))
+		}
+		sc.Test(t)
+	}
+}
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func TestCalculatedFields_DateFunctions(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cases := []struct {
+		formula string
+		value   string
+		err     string
+	}{
+		{`DATE(2024, 2, 29)`, `"2024-02-29T00:00:00Z"`, ""},
+		{`DATE(2024, 13, 1)`, `"2025-01-01T00:00:00Z"`, ""},
+		{`DATEDIF("2024-01-15", "2025-03-10", "Y")`, "1", ""},
+		{`DATEDIF("2024-01-15", "2025-03-10", "M")`, "13", ""},
+		{`DATEDIF("2024-01-15", "2025-03-10", "D")`, "420", ""},
+		{`DATEDIF("2024-01-15", "2025-03-10", "MD")`, "23", ""},
+		{`DATEDIF("2024-01-15", "2025-03-10", "YM")`, "1", ""},
+		{`DATEDIF("2024-01-15", "2025-03-10", "YD")`, "54", ""},
+		{`DATEDIF(DATE(2024, 3, 1), "2024-03-31 10:00:00.000Z", "D")`, "30", ""},
+		{`DATEDIF("2025-01-01", "2024-01-01", "D")`, `"#NUM!"`, "DATEDIF: the start date is after the end date"},
+		{`DATEDIF("2024-01-01", "2025-01-01", "W")`, `"#NUM!"`, `DATEDIF: unit "W" is not supported (Y, M, D, MD, YM, YD)`},
+		{`DATEDIF("yesterday", "2025-01-01", "D")`, `"#VALUE!"`, `DATEDIF: argument 1 is not a valid date ("yesterday")`},
+		{`EDATE("2024-01-31", 1)`, `"2024-02-29T00:00:00Z"`, ""},
+		{`EDATE("2024-03-31", -13)`, `"2023-02-28T00:00:00Z"`, ""},
+		{`WEEKDAY("2024-06-02")`, "1", ""},
+		{`WEEKDAY("2024-06-02", 2)`, "7", ""},
+		{`WEEKDAY("2024-06-03", 3)`, "0", ""},
+		{`WEEKDAY("2024-06-03", 4)`, `"#NUM!"`, "WEEKDAY: type 4 is not supported (1, 2 or 3)"},
+		// aritmetica con le durate di expr
+		{`DATEDIF("2024-01-01", DATE(2024, 1, 1) + duration("72h"), "D")`, "3", ""},
+	}
+
+	for i, c := range cases {
+		id := fmt.Sprintf("datefncase%05d", i)
+		savePoolCF(t, app, id, "", c.formula)
+		checkFormulaUpdate(t, app, id, c.formula, c.value, c.err)
+	}
+}
+
+func TestCalculatedFields_DateFunctions_DependenciesAsText(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	// il valore di un nodo data è salvato come testo RFC3339 e va riletto come data
+	savePoolCF(t, app, "datefnstart0001", "start_date", `DATE(2024, 5, 10)`)
+	days := savePoolCF(t, app, "datefndays00001", "", `DATEDIF(start_date, EDATE(start_date, 1), "D")`)
+	checkFormulaUpdate(t, app, days.Id, `DATEDIF(start_date, EDATE(start_date, 1), "D")`, "31", "")
+}
+
+// daysUntil replica DATEDIF(TODAY(), target, "D") nella timezone indicata
+func daysUntil(t testing.TB, tz string, target time.Time) string {
+	t.Helper()
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return fmt.Sprint(int(target.Sub(today).Hours() / 24))
+}
+
+func TestCalculatedFields_DateFunctions_VolatileCronRecalculation(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	// UTC-12 e UTC+14: TODAY() differisce sempre di almeno un giorno
+	if err := calculatedfields.SetConfig(app, calculatedfields.Config{Timezone: "Etc/GMT+12", VolatileCron: "*/5 * * * *"}); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+
+	target := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	formula := `DATEDIF(TODAY(), "2100-01-01", "D")`
+	cf := savePoolCF(t, app, "datefnvolatile1", "days_left", formula)
+	double := savePoolCF(t, app, "datefnvolatile2", "", "days_left * 2")
+	checkFormulaUpdate(t, app, cf.Id, formula, daysUntil(t, "Etc/GMT+12", target), "")
+
+	cf = mustFindCF(t, app, cf.Id)
+	if !strings.Contains(cf.GetString("external_deps"), `"volatile"`) {
+		t.Fatalf("expected volatile marker in external_deps, got %s", cf.GetString("external_deps"))
+	}
+
+	var job func()
+	for _, j := range app.Cron().Jobs() {
+		if j.Id() == "calculatedfields_volatile" {
+			if j.Expression() != "*/5 * * * *" {
+				t.Fatalf("unexpected cron expression %q", j.Expression())
+			}
+			job = j.Run
+		}
+	}
+	if job == nil {
+		t.Fatal("expected the volatile recalculation cron job to be registered")
+	}
+
+	if err := calculatedfields.SetConfig(app, calculatedfields.Config{Timezone: "Pacific/Kiritimati"}); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	job()
+
+	expected := daysUntil(t, "Pacific/Kiritimati", target)
+	checkFormulaUpdate(t, app, cf.Id, formula, expected, "")
+
+	var n int
+	fmt.Sscan(expected, &n)
+	checkFormulaUpdate(t, app, double.Id, "days_left * 2", fmt.Sprint(n*2), "")
+}
+
+func TestCalculatedFields_Config_Validate(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	if err := calculatedfields.SetConfig(app, calculatedfields.Config{Timezone: "Mars/Olympus"}); err == nil {
+		t.Fatal("expected invalid timezone error")
+	}
+	if err := calculatedfields.SetConfig(app, calculatedfields.Config{VolatileCron: "every minute"}); err == nil {
+		t.Fatal("expected invalid cron error")
+	}
+
+	if err := calculatedfields.SetConfig(app, calculatedfields.Config{}); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	if cfg := calculatedfields.GetConfig(app); cfg.Timezone != "UTC" || cfg.VolatileCron != "" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+}
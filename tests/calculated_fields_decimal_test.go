@@ -0,0 +1,188 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func TestCalculatedFields_DecimalMode_Global(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cfg := calculatedfields.DefaultConfig()
+	cfg.DecimalMode = true
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+
+	cases := []struct {
+		formula string
+		value   string
+		err     string
+	}{
+		{"0.1 + 0.2", `"0.30"`, ""},
+		{"1 / 3", `"0.33"`, ""},
+		{"2 / 3", `"0.67"`, ""},
+		{"-0.125 * 1", `"-0.13"`, ""},
+		{"10.005 - 0.001", `"10.00"`, ""},
+		{"1.1 ** 2", `"1.21"`, ""},
+		{"7 % 3", `"1.00"`, ""},
+		{"0.1 + 0.2 == 0.3", "true", ""},
+		{"IF(0.1 + 0.2 > 0.3, 1, 2)", `"2.00"`, ""},
+		{`"a" + "b"`, `"ab"`, ""},
+		{`CONCAT("tot: ", 0.1 + 0.2)`, `"tot: 0.3"`, ""},
+		{"ROUND(2.675, 2) + 0", `"2.68"`, ""},
+		{"max([0.1, 0.7]) * 2", `"1.40"`, ""},
+		{"[0.1 + 0.2, 1]", `["0.30","1.00"]`, ""},
+		{"1 / 0", `"#DIV/0!"`, "Division by zero"},
+	}
+
+	for i, c := range cases {
+		id := fmt.Sprintf("decimalcase%04d", i)
+		savePoolCF(t, app, id, "", c.formula)
+		checkFormulaUpdate(t, app, id, c.formula, c.value, c.err)
+	}
+}
+
+func TestCalculatedFields_DecimalMode_PerNodeAndPropagation(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	price := savePoolCF(t, app, "decimalprice001", "unit_price", "0.1")
+	total := savePoolCF(t, app, "decimaltotal001", "", "unit_price * 3")
+	checkFormulaUpdate(t, app, total.Id, "unit_price * 3", "0.30000000000000004", "")
+
+	// opt-in sul singolo nodo: cambiare number_mode ricalcola
+	total = mustFindCF(t, app, total.Id)
+	total.Set("number_mode", "decimal")
+	if err := app.Save(total); err != nil {
+		t.Fatalf("failed to set number_mode: %v", err)
+	}
+	checkFormulaUpdate(t, app, total.Id, "unit_price * 3", `"0.30"`, "")
+
+	// propagazione: il valore del genitore viene riletto come decimale esatto
+	price = mustFindCF(t, app, price.Id)
+	price.Set("formula", "0.7")
+	if err := app.Save(price); err != nil {
+		t.Fatalf("failed to update price: %v", err)
+	}
+	checkFormulaUpdate(t, app, total.Id, "unit_price * 3", `"2.10"`, "")
+
+	// un figlio float legge il testo decimale come numero
+	plusOne := savePoolCF(t, app, "decimalplusone1", "", "decimaltotal001 + 1")
+	checkFormulaUpdate(t, app, plusOne.Id, "decimaltotal001 + 1", "3.1", "")
+
+	// un nodo float resta float anche se la modalità globale è decimale
+	cfg := calculatedfields.DefaultConfig()
+	cfg.DecimalMode = true
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	floatNode := savePoolCF(t, app, "decimalfloat001", "", "0.1 + 0.2")
+	floatNode = mustFindCF(t, app, floatNode.Id)
+	checkFormulaUpdate(t, app, floatNode.Id, "0.1 + 0.2", `"0.30"`, "")
+	floatNode.Set("number_mode", "float")
+	if err := app.Save(floatNode); err != nil {
+		t.Fatalf("failed to set number_mode: %v", err)
+	}
+	checkFormulaUpdate(t, app, floatNode.Id, "0.1 + 0.2", "0.30000000000000004", "")
+}
+
+func TestCalculatedFields_DecimalMode_ScaleAndRounding(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cases := []struct {
+		scale    int
+		rounding string
+		value    string
+	}{
+		{2, calculatedfields.RoundHalfUp, `"0.13"`},
+		{2, calculatedfields.RoundHalfEven, `"0.12"`},
+		{2, calculatedfields.RoundDown, `"0.12"`},
+		{2, calculatedfields.RoundUp, `"0.13"`},
+		{2, calculatedfields.RoundFloor, `"0.12"`},
+		{2, calculatedfields.RoundCeiling, `"0.13"`},
+		{4, calculatedfields.RoundHalfUp, `"0.1250"`},
+		{0, calculatedfields.RoundHalfUp, `"0"`},
+	}
+
+	node := savePoolCF(t, app, "decimalround001", "", "1")
+	for _, c := range cases {
+		cfg := calculatedfields.DefaultConfig()
+		cfg.DecimalMode = true
+		cfg.DecimalScale = c.scale
+		cfg.DecimalRounding = c.rounding
+		if err := calculatedfields.SetConfig(app, cfg); err != nil {
+			t.Fatalf("SetConfig failed: %v", err)
+		}
+
+		// formula diversa a ogni giro per forzare il ricalcolo
+		formula := fmt.Sprintf("0.125 + 0 * %d", c.scale)
+		if c.rounding != calculatedfields.RoundHalfUp {
+			formula += fmt.Sprintf(" + 0 * len(%q)", c.rounding)
+		}
+		node = mustFindCF(t, app, node.Id)
+		node.Set("formula", formula)
+		if err := app.Save(node); err != nil {
+			t.Fatalf("failed to save formula %s: %v", formula, err)
+		}
+		checkFormulaUpdate(t, app, node.Id, formula, c.value, "")
+	}
+
+	cfg := calculatedfields.DefaultConfig()
+	cfg.DecimalRounding = "nearest"
+	if err := calculatedfields.SetConfig(app, cfg); err == nil {
+		t.Fatal("expected invalid rounding mode error")
+	}
+	cfg = calculatedfields.DefaultConfig()
+	cfg.DecimalScale = -1
+	if err := calculatedfields.SetConfig(app, cfg); err == nil {
+		t.Fatal("expected invalid scale error")
+	}
+}
+
+func TestCalculatedFields_DecimalMode_FunctionsAreExactAtHighScale(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cfg := calculatedfields.DefaultConfig()
+	cfg.DecimalMode = true
+	cfg.DecimalScale = 20
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+
+	orders := createOrdersCollection(t, app)
+	saveOrder(t, app, orders, "decimal", 0.1)
+	saveOrder(t, app, orders, "decimal", 0.2)
+
+	// con float64 ogni caso mostrerebbe l'errore di rappresentazione oltre la 16a cifra
+	cases := map[string]string{
+		"SUM(0.1, 0.2)":                   `"0.30000000000000000000"`,
+		"SUM([0.1, 0.2], 0.3)":            `"0.60000000000000000000"`,
+		"AVERAGE(1, 2, 2)":                `"1.66666666666666666667"`,
+		"MIN(0.3, 0.1 + 0.2, 0.4)":        `"0.30000000000000000000"`,
+		"MAX(0.1, 0.7) * 3":               `"2.10000000000000000000"`,
+		"ABS(-0.1 - 0.2)":                 `"0.30000000000000000000"`,
+		"ROUND(1 / 3, 18)":                `"0.33333333333333333300"`,
+		"ROUNDUP(0.1 + 0.2, 1)":           `"0.30000000000000000000"`,
+		"ROUND(1234.5, -2)":               `"1200.00000000000000000000"`,
+		"MOD(10.1, 3)":                    `"1.10000000000000000000"`,
+		"INT(-2.5)":                       `"-3.00000000000000000000"`,
+		"POWER(1.1, 3)":                   `"1.33100000000000000000"`,
+		"SQRT(2)":                         `"1.41421356237309504880"`,
+		`SUMWHERE("orders", "", "total")`: `"0.30000000000000000000"`,
+		`AVGWHERE("orders", "", "total") * 3 - 0.45`: `"0.00000000000000000000"`,
+	}
+
+	i := 0
+	for formula, value := range cases {
+		id := fmt.Sprintf("decimalscale%03d", i)
+		i++
+		savePoolCF(t, app, id, "", formula)
+		checkFormulaUpdate(t, app, id, formula, value, "")
+	}
+}
@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+// setFormulaIn salva la formula del nodo con l'app della transazione
+func setFormulaIn(txApp core.App, id, formula string) error {
+	rec, err := txApp.FindRecordById("calculated_fields", id)
+	if err != nil {
+		return err
+	}
+	rec.Set("formula", formula)
+	return txApp.Save(rec)
+}
+
+func TestCalculatedFields_Deferred_PropagatesOnce(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "deferrednodea01", "deferred_a", "1")
+	b := savePoolCF(t, app, "deferrednodeb01", "deferred_b", "2")
+	sum := savePoolCF(t, app, "deferredsum0001", "deferred_sum", "DIAMOND_PROBE(deferred_a + deferred_b)")
+	total := savePoolCF(t, app, "deferredtotal01", "", "deferred_sum * 10")
+
+	before := diamondProbeCalls.Load()
+	err := calculatedfields.Deferred(app, func(txApp core.App) error {
+		if err := setFormulaIn(txApp, a.Id, "10"); err != nil {
+			return err
+		}
+		if err := setFormulaIn(txApp, b.Id, "20"); err != nil {
+			return err
+		}
+		// il dipendente condiviso non è ancora stato ricalcolato
+		rec, err := txApp.FindRecordById("calculated_fields", sum.Id)
+		if err != nil {
+			return err
+		}
+		if got := rec.GetString("value"); got != "3" {
+			t.Errorf("expected the previous value 3 inside Deferred, got %s", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Deferred failed: %v", err)
+	}
+
+	if calls := diamondProbeCalls.Load() - before; calls != 1 {
+		t.Fatalf("expected the shared dependent to be evaluated once, got %d", calls)
+	}
+	checkFormulaUpdate(t, app, a.Id, "10", "10", "")
+	checkFormulaUpdate(t, app, b.Id, "20", "20", "")
+	checkFormulaUpdate(t, app, sum.Id, "DIAMOND_PROBE(deferred_a + deferred_b)", "30", "")
+	checkFormulaUpdate(t, app, total.Id, "deferred_sum * 10", "300", "")
+
+	// senza Deferred ogni salvataggio propaga
+	before = diamondProbeCalls.Load()
+	err = app.RunInTransaction(func(txApp core.App) error {
+		if err := setFormulaIn(txApp, a.Id, "1"); err != nil {
+			return err
+		}
+		return setFormulaIn(txApp, b.Id, "2")
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+	if calls := diamondProbeCalls.Load() - before; calls != 2 {
+		t.Fatalf("expected one evaluation per save, got %d", calls)
+	}
+	checkFormulaUpdate(t, app, total.Id, "deferred_sum * 10", "30", "")
+}
+
+func TestCalculatedFields_Deferred_RollsBackOnError(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "deferredrolla01", "deferred_roll_a", "1")
+	b := savePoolCF(t, app, "deferredrollb01", "", "deferred_roll_a + 1")
+
+	failure := errors.New("failure")
+	err := calculatedfields.Deferred(app, func(txApp core.App) error {
+		if err := setFormulaIn(txApp, a.Id, "5"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected the fn error, got %v", err)
+	}
+	checkFormulaUpdate(t, app, a.Id, "1", "1", "")
+	checkFormulaUpdate(t, app, b.Id, "deferred_roll_a + 1", "2", "")
+
+	// un errore di formula durante fn annulla tutto
+	err = calculatedfields.Deferred(app, func(txApp core.App) error {
+		if err := setFormulaIn(txApp, a.Id, "7"); err != nil {
+			return err
+		}
+		return setFormulaIn(txApp, b.Id, "1 +")
+	})
+	if err == nil {
+		t.Fatalf("expected the syntax error to abort Deferred")
+	}
+	checkFormulaUpdate(t, app, a.Id, "1", "1", "")
+	checkFormulaUpdate(t, app, b.Id, "deferred_roll_a + 1", "2", "")
+
+	// nessun change set rimasto attivo: un salvataggio successivo propaga subito
+	checkFormulaUpdateAfterSave(t, app, a.Id, "3", "3")
+	checkFormulaUpdate(t, app, b.Id, "deferred_roll_a + 1", "4", "")
+}
+
+func TestCalculatedFields_Deferred_DeletePropagatesBeforeCommit(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "deferreddela001", "deferred_del_a", "1")
+	b := savePoolCF(t, app, "deferreddelb001", "deferred_del_b", "deferred_del_a + 1")
+	c := savePoolCF(t, app, "deferreddelc001", "", "deferred_del_b * 2")
+
+	err := calculatedfields.Deferred(app, func(txApp core.App) error {
+		rec, err := txApp.FindRecordById("calculated_fields", a.Id)
+		if err != nil {
+			return err
+		}
+		if err := txApp.Delete(rec); err != nil {
+			return err
+		}
+		// il dipendente diretto ha già il #REF!, quelli transitivi aspettano il commit
+		if rec, err = txApp.FindRecordById("calculated_fields", c.Id); err != nil {
+			return err
+		}
+		if got := rec.GetString("value"); got != "4" {
+			t.Errorf("expected the previous value 4 inside Deferred, got %s", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Deferred failed: %v", err)
+	}
+
+	if got := mustFindCF(t, app, b.Id).GetString("value"); got != `"#REF!"` {
+		t.Fatalf("expected #REF! on the direct dependent, got %s", got)
+	}
+	if got := mustFindCF(t, app, c.Id).GetString("value"); got != `"#REF!"` {
+		t.Fatalf("expected #REF! on the transitive dependent after the commit, got %s", got)
+	}
+}
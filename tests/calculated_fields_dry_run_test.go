@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/tests"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func TestCalculatedFields_DryRun_ReportsBlastRadiusAndRollsBack(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "dryrunnodea0001", "dry_a", "1")
+	b := savePoolCF(t, app, "dryrunnodeb0001", "dry_b", "dry_a + 1")
+	c := savePoolCF(t, app, "dryrunnodec0001", "", "dry_b * 2")
+	other := savePoolCF(t, app, "dryrunother0001", "", "dry_a > 100")
+
+	nodes, err := calculatedfields.DryRunFormula(app, a.Id, "5")
+	if err != nil {
+		t.Fatalf("DryRunFormula failed: %v", err)
+	}
+
+	got := map[string]calculatedfields.DryRunNode{}
+	for _, n := range nodes {
+		got[n.Id] = n
+	}
+	if len(nodes) != 4 || nodes[0].Id != a.Id {
+		t.Fatalf("expected the node and its 3 dependents, got %+v", nodes)
+	}
+	if n := nodes[0]; n.OldValue != float64(1) || n.NewValue != float64(5) || !n.Changed {
+		t.Fatalf("unexpected dry run of %s: %+v", a.Id, n)
+	}
+	if n := got[b.Id]; n.OldValue != float64(2) || n.NewValue != float64(6) || !n.Changed {
+		t.Fatalf("unexpected dry run of %s: %+v", b.Id, n)
+	}
+	if n := got[c.Id]; n.OldValue != float64(4) || n.NewValue != float64(12) || !n.Changed {
+		t.Fatalf("unexpected dry run of %s: %+v", c.Id, n)
+	}
+	if n := got[other.Id]; n.Changed {
+		t.Fatalf("expected %s to be unchanged, got %+v", other.Id, n)
+	}
+
+	// nulla è stato salvato
+	checkFormulaUpdate(t, app, a.Id, "1", "1", "")
+	checkFormulaUpdate(t, app, b.Id, "dry_a + 1", "2", "")
+	checkFormulaUpdate(t, app, c.Id, "dry_b * 2", "4", "")
+
+	// la transazione annullata non lascia archi: una dipendenza simulata non viene ricalcolata
+	if _, err := calculatedfields.DryRunFormula(app, c.Id, "DIAMOND_PROBE(dry_a)"); err != nil {
+		t.Fatalf("DryRunFormula failed: %v", err)
+	}
+	before := diamondProbeCalls.Load()
+	checkFormulaUpdateAfterSave(t, app, a.Id, "2", "2")
+	if calls := diamondProbeCalls.Load() - before; calls != 0 {
+		t.Fatalf("expected no evaluation of the simulated formula, got %d", calls)
+	}
+}
+
+func TestCalculatedFields_DryRun_Errors(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "dryrunerror0001", "", "1")
+
+	for formula, code := range map[string]string{
+		"1 +":             "1004",
+		"dryrun_missing1": "1007",
+	} {
+		_, err := calculatedfields.DryRunFormula(app, a.Id, formula)
+		raw, _ := json.Marshal(err)
+		if err == nil || !strings.Contains(string(raw), `"code":"`+code+`"`) {
+			t.Fatalf("expected error code %s for %q, got %s", code, formula, raw)
+		}
+	}
+
+	_, err := calculatedfields.DryRunFormula(app, "missingnode0000", "1")
+	raw, _ := json.Marshal(err)
+	if !strings.Contains(string(raw), `"code":"1005"`) {
+		t.Fatalf("expected error code 1005, got %s", raw)
+	}
+}
+
+func TestCalculatedFields_DryRun_HTTP(t *testing.T) {
+	autApp, err := tests.NewTestApp("../tests/pb_data")
+	if err != nil {
+		t.Fatalf("Cannot initialize test app: %v", err)
+	}
+	defer autApp.Cleanup()
+	superAuthHeader := map[string]string{"Authorization": getSuperuserToken(t, autApp)}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "dry run senza superuser",
+			Method:          http.MethodPost,
+			URL:             "/api/calculated_fields/yysba8o7a6773c3/dry-run",
+			Body:            strings.NewReader(`{"formula": "10"}`),
+			TestAppFactory:  setupTestApp,
+			ExpectedStatus:  401,
+			ExpectedContent: []string{`"data":{}`},
+		},
+		{
+			Name:           "dry run mostra i dipendenti senza salvare",
+			Method:         http.MethodPost,
+			URL:            "/api/calculated_fields/yysba8o7a6773c3/dry-run",
+			Body:           strings.NewReader(`{"formula": "10"}`),
+			Headers:        superAuthHeader,
+			TestAppFactory: setupTestApp,
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"id":"c03u7o5plc4hucf"`,
+				`"old_value":6`,
+				`"new_value":11`,
+				`"id":"y3hvc2dtuhp2jjh"`,
+				`"new_value":13`,
+				`"changed":true`,
+			},
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				checkFormulaUpdate(t, app, "yysba8o7a6773c3", "5", "5", "")
+				checkFormulaUpdate(t, app, "y3hvc2dtuhp2jjh", "c03u7o5plc4hucf+ 2", "8", "")
+			},
+		},
+		{
+			Name:            "dry run con errore di sintassi",
+			Method:          http.MethodPost,
+			URL:             "/api/calculated_fields/yysba8o7a6773c3/dry-run",
+			Body:            strings.NewReader(`{"formula": "10 +"}`),
+			Headers:         superAuthHeader,
+			TestAppFactory:  setupTestApp,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"code":"1004"`},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCalculatedFields_ErrorPropagation_InheritsUpstreamError(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	ratio := savePoolCF(t, app, "errpropratio001", "ratio", "1 / 0")
+	checkFormulaUpdate(t, app, ratio.Id, "1 / 0", `"#DIV/0!"`, "Division by zero or infinite result")
+
+	// figlio e nipote ereditano il primo errore e la sorgente originale
+	child := savePoolCF(t, app, "errpropchild001", "scaled", "ratio * 100")
+	grandChild := savePoolCF(t, app, "errpropgrand001", "", "scaled + 1")
+
+	inherited := "Inherited error from errpropratio001: Division by zero or infinite result"
+	checkFormulaUpdate(t, app, child.Id, "ratio * 100", `"#DIV/0!"`, inherited)
+	checkFormulaUpdate(t, app, grandChild.Id, "scaled + 1", `"#DIV/0!"`, inherited)
+	for _, id := range []string{child.Id, grandChild.Id} {
+		if source := mustFindCF(t, app, id).GetString("error_source"); source != ratio.Id {
+			t.Fatalf("expected error_source %s for %s, got %q", ratio.Id, id, source)
+		}
+	}
+	if source := mustFindCF(t, app, ratio.Id).GetString("error_source"); source != "" {
+		t.Fatalf("expected empty error_source on the originating node, got %q", source)
+	}
+
+	// l'errore sparisce a valle quando il genitore torna valido
+	ratio = mustFindCF(t, app, ratio.Id)
+	ratio.Set("formula", "1 / 4")
+	if err := app.Save(ratio); err != nil {
+		t.Fatalf("failed to update ratio: %v", err)
+	}
+	checkFormulaUpdate(t, app, child.Id, "ratio * 100", "25", "")
+	checkFormulaUpdate(t, app, grandChild.Id, "scaled + 1", "26", "")
+	if source := mustFindCF(t, app, grandChild.Id).GetString("error_source"); source != "" {
+		t.Fatalf("expected error_source to be cleared, got %q", source)
+	}
+}
+
+func TestCalculatedFields_ErrorPropagation_InterceptFunctions(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	savePoolCF(t, app, "errpropdivzero1", "div_zero", "1 / 0")
+	savePoolCF(t, app, "errpropmissing1", "missing", `AVERAGE([])`)
+	savePoolCF(t, app, "errpropnotavail", "not_avail", `ROUND(nil)`)
+
+	cases := []struct {
+		formula string
+		value   string
+		err     string
+	}{
+		{"IFERROR(div_zero * 2, 0)", "0", ""},
+		{"IFERROR(div_zero, -1) + 1", "0", ""},
+		{"ISERROR(div_zero + 1)", "true", ""},
+		{"ISERROR(42)", "false", ""},
+		{"ISNA(not_avail)", "true", ""},
+		{"ISNA(div_zero)", "false", ""},
+		{"IFNA(not_avail, 7)", "7", ""},
+		{"IFNA(missing, 7)", `"#DIV/0!"`, "Inherited error from errpropmissing1: AVERAGE: no values"},
+		{"IF(true, 1, div_zero)", "1", ""},
+		{"IF(div_zero > 0, 1, 2)", `"#DIV/0!"`, "Inherited error from errpropdivzero1: Division by zero or infinite result"},
+		{"SUM([1, div_zero])", `"#DIV/0!"`, "Inherited error from errpropdivzero1: Division by zero or infinite result"},
+		// gli errori delle funzioni e degli operatori del nodo stesso sono intercettabili
+		{`IFERROR(ROUND("x"), 5)`, "5", ""},
+		{"IFERROR(nil + 1, 3)", "3", ""},
+		{`IFERROR(AVERAGE([]), "none")`, `"none"`, ""},
+	}
+
+	for i, c := range cases {
+		id := fmt.Sprintf("errpropcase%04d", i)
+		savePoolCF(t, app, id, "", c.formula)
+		checkFormulaUpdate(t, app, id, c.formula, c.value, c.err)
+	}
+}
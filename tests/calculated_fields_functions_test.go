@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCalculatedFields_StandardLibrary(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	savePoolCF(t, app, "stdlibprice0001", "price", "12.345")
+	savePoolCF(t, app, "stdlibname00001", "name", `"  Mario Rossi "`)
+
+	cases := []struct {
+		formula   string
+		wantValue string
+		wantError string // "" = nessun errore atteso, altrimenti prefisso del messaggio
+	}{
+		// logiche
+		{`IF(price > 10, "alto", "basso")`, `"alto"`, ""},
+		{`IF(0, 1)`, `false`, ""},
+		{`IFERROR(price / 0, -1)`, `-1`, ""},
+		{`IFERROR(price, -1)`, `12.345`, ""},
+		{`AND(true, price > 1, 1)`, `true`, ""},
+		{`OR(false, 0)`, `false`, ""},
+		{`NOT(false)`, `true`, ""},
+		{`COALESCE(nil, "", "x")`, `"x"`, ""},
+
+		// numeriche
+		{`ROUND(price, 2)`, `12.35`, ""},
+		{`ROUND(1.005, 2)`, `1.01`, ""},
+		{`ROUNDUP(-1.21, 1)`, `-1.3`, ""},
+		{`ROUNDDOWN(price)`, `12`, ""},
+		{`ABS(-price)`, `12.345`, ""},
+		{`INT(-2.5)`, `-3`, ""},
+		{`MOD(-3, 2)`, `1`, ""},
+		{`POWER(2, 10)`, `1024`, ""},
+		{`SUM(1, [2, 3], price)`, `18.345`, ""},
+		{`AVERAGE([2, 4], 6)`, `4`, ""},
+		{`MIN(3, [1, 2])`, `1`, ""},
+		{`MAX(3, [1, 9])`, `9`, ""},
+
+		// testo
+		{`CONCAT("a", 1, "-", 2.5)`, `"a1-2.5"`, ""},
+		{`LEFT(TRIM(name), 5)`, `"Mario"`, ""},
+		{`RIGHT(TRIM(name), 5)`, `"Rossi"`, ""},
+		{`MID("abcdef", 2, 3)`, `"bcd"`, ""},
+		{`LEN(TRIM(name))`, `11`, ""},
+		{`UPPER("abc") + LOWER("DEF")`, `"ABCdef"`, ""},
+
+		// validazione argomenti -> #VALUE! / #NUM! / #DIV/0!
+		{`ROUND("abc")`, `"#VALUE!"`, "ROUND: argument 1 must be a number"},
+		{`ROUND(1, 2, 3)`, `"#VALUE!"`, "ROUND requires 1 to 2 arguments"},
+		{`LEFT(price)`, `"#VALUE!"`, "LEFT: argument 1 must be a text"},
+		{`SQRT(-1)`, `"#NUM!"`, "SQRT: negative argument"},
+		{`MOD(1, 0)`, `"#DIV/0!"`, "MOD: division by zero"},
+		{`AVERAGE([])`, `"#DIV/0!"`, "AVERAGE: no values"},
+		{`ABS(nil)`, `"#N/A"`, "ABS: argument 1 is not available"},
+	}
+
+	for i, c := range cases {
+		t.Run(c.formula, func(t *testing.T) {
+			cf := savePoolCF(t, app, fmt.Sprintf("stdlibcase%05d", i), "", c.formula)
+			cf = mustFindCF(t, app, cf.Id)
+
+			if got := cf.GetString("value"); got != c.wantValue {
+				t.Fatalf("%s: expected value %s, got %s (error=%q)", c.formula, c.wantValue, got, cf.GetString("error"))
+			}
+			gotErr := cf.GetString("error")
+			if c.wantError == "" && gotErr != "" {
+				t.Fatalf("%s: unexpected error %q", c.formula, gotErr)
+			}
+			if c.wantError != "" && (len(gotErr) < len(c.wantError) || gotErr[:len(c.wantError)] != c.wantError) {
+				t.Fatalf("%s: expected error starting with %q, got %q", c.formula, c.wantError, gotErr)
+			}
+		})
+	}
+}
+
+func TestCalculatedFields_StandardLibrary_DependenciesInsideFunctions(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "stdlibdepa00001", "a", "4")
+	savePoolCF(t, app, "stdlibdepb00001", "b", "5")
+	c := savePoolCF(t, app, "stdlibdepc00001", "", "IF(a > 3, ROUND(b / 3, 1), 0)")
+
+	checkFormulaUpdate(t, app, c.Id, "IF(a > 3, ROUND(b / 3, 1), 0)", "1.7", "")
+
+	a = mustFindCF(t, app, a.Id)
+	a.Set("formula", "1")
+	if err := app.Save(a); err != nil {
+		t.Fatalf("failed to update a: %v", err)
+	}
+	checkFormulaUpdate(t, app, c.Id, "IF(a > 3, ROUND(b / 3, 1), 0)", "0", "")
+}
+
+func TestCalculatedFields_ReservedWordsAreNotIdentifiers(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cf := savePoolCF(t, app, "reservedwords01", "", "1")
+
+	// le keyword in qualsiasi maiuscolo/minuscolo non sono riferimenti ad altri nodi (niente 1007)
+	for _, formula := range []string{"TRUE", "Null", "NIL", "True && false"} {
+		saveFormula(t, app, cf.Id, formula)
+		if deps := mustFindCF(t, app, cf.Id).GetStringSlice("depends_on"); len(deps) != 0 {
+			t.Fatalf("expected no dependencies for %s, got %v", formula, deps)
+		}
+	}
+
+	// seguite da "(" sono chiamate alle funzioni della libreria standard
+	saveFormula(t, app, cf.Id, "IF(1 > 0, 1, 2)")
+	checkFormulaUpdate(t, app, cf.Id, "IF(1 > 0, 1, 2)", "1", "")
+}
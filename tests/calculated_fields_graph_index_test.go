@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func TestCalculatedFields_GraphIndex_RollbackDiscardsEdges(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "graphidxa000001", "graph_idx_a", "1")
+	b := savePoolCF(t, app, "graphidxb000001", "", "DIAMOND_PROBE(1)")
+
+	// b inizia a dipendere da a in una transazione che poi fallisce
+	rollback := errors.New("rollback")
+	err := app.RunInTransaction(func(txApp core.App) error {
+		rec, err := txApp.FindRecordById("calculated_fields", b.Id)
+		if err != nil {
+			return err
+		}
+		rec.Set("formula", "DIAMOND_PROBE(graph_idx_a)")
+		if err := txApp.Save(rec); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("expected the transaction to roll back, got %v", err)
+	}
+
+	// l'arco a → b non esiste più: modificare a non ricalcola b
+	before := diamondProbeCalls.Load()
+	checkFormulaUpdateAfterSave(t, app, a.Id, "2", "2")
+	if calls := diamondProbeCalls.Load() - before; calls != 0 {
+		t.Fatalf("expected no evaluation of the rolled back dependent, got %d", calls)
+	}
+	checkFormulaUpdate(t, app, b.Id, "DIAMOND_PROBE(1)", "1", "")
+}
+
+func TestCalculatedFields_GraphIndex_RebuildAfterManualEdit(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "graphidxa000002", "graph_idx_a2", "1")
+	b := savePoolCF(t, app, "graphidxb000002", "", "5")
+
+	// modifica diretta a db, senza hook: l'indice non la vede finché non viene ricostruito
+	_, err := app.DB().Update("calculated_fields", dbx.Params{
+		"formula":    "graph_idx_a2 * 10",
+		"depends_on": `["` + a.Id + `"]`,
+	}, dbx.HashExp{"id": b.Id}).Execute()
+	if err != nil {
+		t.Fatalf("manual update failed: %v", err)
+	}
+	if err := calculatedfields.RebuildGraphIndex(app); err != nil {
+		t.Fatalf("RebuildGraphIndex failed: %v", err)
+	}
+
+	checkFormulaUpdateAfterSave(t, app, a.Id, "3", "3")
+	checkFormulaUpdate(t, app, b.Id, "graph_idx_a2 * 10", "30", "")
+}
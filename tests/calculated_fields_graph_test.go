@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+var diamondProbeCalls atomic.Int64
+
+func init() {
+	// conta le valutazioni del nodo che la usa (restituisce l'argomento)
+	calculatedfields.RegisterFunction("DIAMOND_PROBE", func(params ...any) (any, error) {
+		diamondProbeCalls.Add(1)
+		return params[0], nil
+	})
+}
+
+func TestCalculatedFields_Graph_DiamondEvaluatesEachNodeOnce(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	// A → B, A → C, B → D, C → D (B, C, D sulla stessa riga owner)
+	a := savePoolCF(t, app, "diamondnodea001", "diamond_a", "1")
+	q := createBookingQueue(t, app, "diamondqueue001")
+	setOwnerFieldFormula(t, app, q, "act_fx", "diamond_a + 1")
+	setOwnerFieldFormula(t, app, q, "min_fx", "diamond_a * 10")
+	d := setOwnerFieldFormula(t, app, q, "max_fx", "DIAMOND_PROBE(self.act_fx + self.min_fx)")
+	checkFormulaUpdate(t, app, d.Id, d.GetString("formula"), "12", "")
+
+	touches := 0
+	app.OnRecordUpdate("booking_queue").BindFunc(func(e *core.RecordEvent) error {
+		if e.Record.Id == q.Id {
+			touches++
+		}
+		return e.Next()
+	})
+
+	before := diamondProbeCalls.Load()
+	a = mustFindCF(t, app, a.Id)
+	a.Set("formula", "5")
+	if err := app.Save(a); err != nil {
+		t.Fatalf("failed to update A: %v", err)
+	}
+
+	checkFormulaUpdate(t, app, d.Id, d.GetString("formula"), "56", "")
+	if calls := diamondProbeCalls.Load() - before; calls != 1 {
+		t.Fatalf("expected D to be evaluated once, got %d evaluations", calls)
+	}
+	if touches != 1 {
+		t.Fatalf("expected the owner to be touched once, got %d", touches)
+	}
+}
+
+func TestCalculatedFields_Graph_RejectsCycleWithPath(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "cyclenodea00001", "cycle_a", "1")
+	savePoolCF(t, app, "cyclenodeb00001", "cycle_b", "cycle_a + 1")
+	savePoolCF(t, app, "cyclenodec00001", "cycle_c", "cycle_b + 1")
+
+	a = mustFindCF(t, app, a.Id)
+	a.Set("formula", "cycle_c * 2")
+	err := app.Save(a)
+	if err == nil {
+		t.Fatal("expected circular dependency error")
+	}
+
+	raw, _ := json.Marshal(err)
+	path := "cyclenodea00001 → cyclenodec00001 → cyclenodeb00001 → cyclenodea00001"
+	for _, want := range []string{
+		`"code":"1003"`,
+		path,
+		`"cycle":["cyclenodea00001","cyclenodec00001","cyclenodeb00001","cyclenodea00001"]`,
+	} {
+		if !strings.Contains(string(raw), want) {
+			t.Fatalf("expected %s in error, got %s", want, raw)
+		}
+	}
+
+	// il rollback lascia la formula e il valore precedenti
+	checkFormulaUpdate(t, app, a.Id, "1", "1", "")
+}
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+const jsvmTestHooks = `
+$calculatedFields.registerFunction("js_margin", (price, cost) => (price - cost) / price)
+$calculatedFields.registerFunction("js_pair", (a) => [a, a * 2, { label: "x" + a }])
+$calculatedFields.registerFunction("js_nothing", () => undefined)
+$calculatedFields.registerFunction("js_boom", () => { throw new Error("boom") })
+$calculatedFields.registerFunction("js_negative", (x) => {
+	if (x < 0) {
+		throw $calculatedFields.formulaError("#NUM!", "negative input")
+	}
+	return Math.sqrt(x)
+})
+$calculatedFields.registerFunction("js_mutate", (arr) => { arr.push(99); return arr.length })
+$calculatedFields.registerFunction("js_go_object", () => $calculatedFields)
+`
+
+func TestCalculatedFields_JSVM_RegisterAndEvaluate(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	vm := goja.New()
+	calculatedfields.BindJSVM(app, vm)
+	if _, err := vm.RunString(jsvmTestHooks); err != nil {
+		t.Fatalf("failed to run hooks script: %v", err)
+	}
+
+	price := savePoolCF(t, app, "jsvmprice000001", "js_price", "200")
+	savePoolCF(t, app, "jsvmcost0000001", "js_cost", "150")
+	savePoolCF(t, app, "jsvmlist0000001", "js_list", "[1, 2]")
+
+	margin := savePoolCF(t, app, "jsvmmargin00001", "", "js_margin(js_price, js_cost)")
+	checkFormulaUpdate(t, app, margin.Id, "js_margin(js_price, js_cost)", "0.25", "")
+
+	// propagazione attraverso la funzione JS
+	price = mustFindCF(t, app, price.Id)
+	price.Set("formula", "300")
+	if err := app.Save(price); err != nil {
+		t.Fatalf("failed to update price: %v", err)
+	}
+	checkFormulaUpdate(t, app, margin.Id, "js_margin(js_price, js_cost)", "0.5", "")
+
+	cases := []struct {
+		id, formula, value, errMsg string
+	}{
+		{"jsvmpair0000001", "js_pair(3)", `[3,6,{"label":"x3"}]`, ""},
+		{"jsvmnothing0001", "js_nothing()", "null", ""},
+		{"jsvmboom0000001", "js_boom()", `"#VALUE!"`, "js_boom: Error: boom"},
+		{"jsvmnegative001", "js_negative(-4)", `"#NUM!"`, "negative input"},
+		{"jsvmsqrt0000001", "js_negative(16)", "4", ""},
+		{"jsvmdivzero0001", "js_margin(0, 1)", `"#NUM!"`, "js_margin: invalid numeric result (-Inf)"},
+		{"jsvmgoobject001", "js_go_object()", `"#VALUE!"`, ""},
+		// il JS riceve una copia: la lista del nodo js_list non cambia
+		{"jsvmmutate00001", "js_mutate(js_list) + len(js_list)", "5", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.formula, func(t *testing.T) {
+			cf := mustFindCF(t, app, savePoolCF(t, app, c.id, "", c.formula).Id)
+			if got := cf.GetString("value"); got != c.value {
+				t.Fatalf("expected value %s, got %s (error=%q)", c.value, got, cf.GetString("error"))
+			}
+			if c.errMsg != "" && cf.GetString("error") != c.errMsg {
+				t.Fatalf("expected error %q, got %q", c.errMsg, cf.GetString("error"))
+			}
+		})
+	}
+}
+
+func TestCalculatedFields_JSVM_RegistrationErrors(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	vm := goja.New()
+	calculatedfields.BindJSVM(app, vm)
+
+	scripts := map[string]string{
+		"not a function":     `$calculatedFields.registerFunction("js_not_fn", 42)`,
+		"clash with stdlib":  `$calculatedFields.registerFunction("ROUND", () => 1)`,
+		"invalid name":       `$calculatedFields.registerFunction("bad name", () => 1)`,
+		"unknown error code": `$calculatedFields.formulaError("#OOPS", "x")`,
+	}
+	for name, script := range scripts {
+		if _, err := vm.RunString(script); err == nil {
+			t.Errorf("%s: expected JS exception", name)
+		}
+	}
+
+	if _, err := vm.RunString(`$calculatedFields.registerVolatileFunction("js_volatile_once", () => Date.now())`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err := vm.RunString(`$calculatedFields.registerFunction("js_volatile_once", () => 1)`)
+	if err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Fatalf("expected duplicate registration error, got %v", err)
+	}
+
+	cf := savePoolCF(t, app, "jsvmvolatile001", "", "js_volatile_once()")
+	if deps := mustFindCF(t, app, cf.Id).GetString("external_deps"); !strings.Contains(deps, "volatile") {
+		t.Fatalf("expected volatile marker, got %s", deps)
+	}
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tests"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func init() {
+	// una funzione lenta: la valutazione di un solo nodo supera EvalTimeout
+	calculatedfields.RegisterFunction("SLOW_PROBE", func(params ...any) (any, error) {
+		time.Sleep(300 * time.Millisecond)
+		return params[0], nil
+	})
+}
+
+func setLimits(t testing.TB, app *tests.TestApp, apply func(cfg *calculatedfields.Config)) {
+	t.Helper()
+
+	cfg := calculatedfields.GetConfig(app)
+	apply(&cfg)
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+}
+
+func expectLimitError(t testing.TB, app *tests.TestApp, id, formula string) {
+	t.Helper()
+
+	rec := mustFindCF(t, app, id)
+	rec.Set("formula", formula)
+	err := app.Save(rec)
+	if err == nil {
+		t.Fatalf("expected a limit error for %q", formula)
+	}
+	raw, _ := json.Marshal(err)
+	if !strings.Contains(string(raw), `"code":"1016"`) {
+		t.Fatalf("expected error code 1016 for %q, got %s", formula, raw)
+	}
+}
+
+func TestCalculatedFields_Limits_Formula(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "limitformula001", "", "1")
+
+	setLimits(t, app, func(cfg *calculatedfields.Config) { cfg.MaxFormulaLength = 10 })
+	expectLimitError(t, app, a.Id, "1+1+1+1+1+1+1")
+
+	setLimits(t, app, func(cfg *calculatedfields.Config) {
+		cfg.MaxFormulaLength = 0
+		cfg.MaxFormulaNodes = 5
+	})
+	expectLimitError(t, app, a.Id, "1+2+3+4+5+6")
+
+	setLimits(t, app, func(cfg *calculatedfields.Config) {
+		cfg.MaxFormulaNodes = 0
+		cfg.MaxMemoryBudget = 1000
+	})
+	expectLimitError(t, app, a.Id, "len(1..100000)")
+
+	// nessuna modifica applicata
+	checkFormulaUpdate(t, app, a.Id, "1", "1", "")
+
+	// entro i limiti
+	checkFormulaUpdateAfterSave(t, app, a.Id, "len(1..10)", "10")
+}
+
+func checkFormulaUpdateAfterSave(t testing.TB, app *tests.TestApp, id, formula, expectedValue string) {
+	t.Helper()
+
+	rec := mustFindCF(t, app, id)
+	rec.Set("formula", formula)
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("save of %q failed: %v", formula, err)
+	}
+	checkFormulaUpdate(t, app, id, formula, expectedValue, "")
+}
+
+func TestCalculatedFields_Limits_Propagation(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "limitchaina0001", "limit_a", "1")
+	savePoolCF(t, app, "limitchainb0001", "limit_b", "limit_a + 1")
+	c := savePoolCF(t, app, "limitchainc0001", "", "limit_b + 1")
+
+	setLimits(t, app, func(cfg *calculatedfields.Config) { cfg.MaxPropagationNodes = 1 })
+	expectLimitError(t, app, a.Id, "2")
+
+	setLimits(t, app, func(cfg *calculatedfields.Config) {
+		cfg.MaxPropagationNodes = 0
+		cfg.MaxDependencyDepth = 1
+	})
+	expectLimitError(t, app, a.Id, "2")
+
+	setLimits(t, app, func(cfg *calculatedfields.Config) {
+		cfg.MaxDependencyDepth = 0
+		cfg.EvalTimeout = "1ns"
+	})
+	expectLimitError(t, app, a.Id, "2")
+	checkFormulaUpdate(t, app, c.Id, "limit_b + 1", "3", "")
+
+	setLimits(t, app, func(cfg *calculatedfields.Config) {
+		cfg.MaxPropagationNodes = 2
+		cfg.MaxDependencyDepth = 2
+		cfg.EvalTimeout = "0"
+	})
+	checkFormulaUpdateAfterSave(t, app, a.Id, "2", "2")
+	checkFormulaUpdate(t, app, c.Id, "limit_b + 1", "4", "")
+}
+
+func TestCalculatedFields_Limits_TimeoutInsideEvaluation(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "limitslownode01", "", "1")
+
+	// un solo nodo: la scadenza vale anche dentro la valutazione, non solo tra un nodo e l'altro
+	setLimits(t, app, func(cfg *calculatedfields.Config) { cfg.EvalTimeout = "50ms" })
+	started := time.Now()
+	expectLimitError(t, app, a.Id, "SLOW_PROBE(2)")
+	if elapsed := time.Since(started); elapsed >= 300*time.Millisecond {
+		t.Fatalf("expected the evaluation to be interrupted at the timeout, took %s", elapsed)
+	}
+	checkFormulaUpdate(t, app, a.Id, "1", "1", "")
+
+	setLimits(t, app, func(cfg *calculatedfields.Config) { cfg.EvalTimeout = "5s" })
+	checkFormulaUpdateAfterSave(t, app, a.Id, "SLOW_PROBE(2)", "2")
+}
+
+func TestCalculatedFields_Limits_InvalidConfig(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cfg := calculatedfields.DefaultConfig()
+	cfg.MaxDependencyDepth = -1
+	if err := calculatedfields.SetConfig(app, cfg); err == nil {
+		t.Fatal("expected an error for a negative limit")
+	}
+	cfg = calculatedfields.DefaultConfig()
+	cfg.EvalTimeout = "soon"
+	if err := calculatedfields.SetConfig(app, cfg); err == nil {
+		t.Fatal("expected an error for an invalid eval_timeout")
+	}
+}
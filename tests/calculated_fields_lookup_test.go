@@ -0,0 +1,229 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func createTariffsCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	cfCol, err := app.FindCollectionByNameOrId("calculated_fields")
+	if err != nil {
+		t.Fatalf("cannot find calculated_fields: %v", err)
+	}
+
+	col := core.NewBaseCollection("tariffs")
+	col.Fields.Add(&core.TextField{Name: "code"})
+	col.Fields.Add(&core.RelationField{Name: "rate_fx", CollectionId: cfCol.Id, MaxSelect: 1})
+	if err := app.Save(col); err != nil {
+		t.Fatalf("failed to create tariffs collection: %v", err)
+	}
+	return col
+}
+
+func saveTariff(t testing.TB, app *tests.TestApp, col *core.Collection, id, code, rate string) *core.Record {
+	t.Helper()
+
+	rec := core.NewRecord(col)
+	rec.Set("id", id)
+	rec.Set("code", code)
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("failed to save tariff %s: %v", code, err)
+	}
+	rec, err := app.FindRecordById("tariffs", id)
+	if err != nil {
+		t.Fatalf("cannot reload tariffs/%s: %v", id, err)
+	}
+	setOwnerFieldFormula(t, app, rec, "rate_fx", rate)
+	return rec
+}
+
+func TestCalculatedFields_Lookup_FollowsKeyAndValue(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	col := createTariffsCollection(t, app)
+	std := saveTariff(t, app, col, "tariffstandard1", "STD", "10")
+	saveTariff(t, app, col, "tariffpremium01", "PRE", "25")
+	saveTariff(t, app, col, "tariffnumeric01", "42", "3")
+
+	savePoolCF(t, app, "lookupkeynode01", "tariff_code", `"STD"`)
+	formula := `LOOKUP("tariffs", "code", tariff_code, "rate_fx") * 2`
+	rec := savePoolCF(t, app, "lookupprice0001", "", formula)
+	checkFormulaUpdate(t, app, rec.Id, formula, "20", "")
+
+	numeric := `LOOKUP("tariffs", "code", 40 + 2, "rate_fx")`
+	checkFormulaUpdate(t, app, savePoolCF(t, app, "lookupnumeric01", "", numeric).Id, numeric, "3", "")
+
+	// il valore della cella trovata cambia
+	setOwnerFieldFormula(t, app, std, "rate_fx", "12")
+	checkFormulaUpdate(t, app, rec.Id, formula, "24", "")
+
+	// la chiave cercata cambia
+	key := mustFindCF(t, app, "lookupkeynode01")
+	key.Set("formula", `"PRE"`)
+	if err := app.Save(key); err != nil {
+		t.Fatalf("failed to update key: %v", err)
+	}
+	checkFormulaUpdate(t, app, rec.Id, formula, "50", "")
+
+	// il record trovato cambia chiave: #N/A, poi un nuovo record con quella chiave viene trovato
+	pre, err := app.FindRecordById("tariffs", "tariffpremium01")
+	if err != nil {
+		t.Fatalf("cannot load tariff: %v", err)
+	}
+	pre.Set("code", "OLD")
+	if err := app.Save(pre); err != nil {
+		t.Fatalf("failed to rename tariff: %v", err)
+	}
+	checkFormulaUpdate(t, app, rec.Id, formula, `"#N/A"`, "LOOKUP: no record of tariffs with code = PRE")
+
+	saveTariff(t, app, col, "tariffpremium02", "PRE", "30")
+	checkFormulaUpdate(t, app, rec.Id, formula, "60", "")
+
+	// il record trovato viene eliminato
+	pre2, err := app.FindRecordById("tariffs", "tariffpremium02")
+	if err != nil {
+		t.Fatalf("cannot load tariff: %v", err)
+	}
+	if err := app.Delete(pre2); err != nil {
+		t.Fatalf("failed to delete tariff: %v", err)
+	}
+	checkFormulaUpdate(t, app, rec.Id, formula, `"#N/A"`, "LOOKUP: no record of tariffs with code = PRE")
+}
+
+func TestCalculatedFields_Lookup_InvalidArguments(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	createTariffsCollection(t, app)
+	cf := savePoolCF(t, app, "lookupinvalid01", "", "0")
+
+	formulas := []string{
+		`LOOKUP("missing", "code", "STD", "rate_fx")`,
+		`LOOKUP("tariffs", "nope", "STD", "rate_fx")`,
+		`LOOKUP("tariffs", "code", "STD", "code")`,
+		`LOOKUP("tariffs", "code", "STD")`,
+		`LOOKUP("tari" + "ffs", "code", "STD", "rate_fx")`,
+	}
+	for _, formula := range formulas {
+		cf = mustFindCF(t, app, cf.Id)
+		cf.Set("formula", formula)
+
+		err := app.Save(cf)
+		if err == nil {
+			t.Fatalf("expected error for formula %s", formula)
+		}
+		raw, _ := json.Marshal(err)
+		if !strings.Contains(string(raw), `"code":"1014"`) {
+			t.Fatalf("expected 1014 for %s, got %s (%v)", formula, raw, err)
+		}
+	}
+}
+
+func TestCalculatedFields_Lookup_RequiresViewAccess(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		viewRule *string
+		status   int
+		expected string
+	}{
+		{"tariffe pubbliche", types.Pointer(""), 200, `"value":20`},
+		{"tariffe solo superuser", nil, 403, `"message":"Forbidden`},
+		// la chiave è calcolata in valutazione: servono tutte le righe, non solo quella cercata
+		{"tariffe visibili in parte", types.Pointer("code = 'STD'"), 403, `"message":"Forbidden`},
+	}
+
+	for _, s := range scenarios {
+		sc := &tests.ApiScenario{
+			Name:            s.name,
+			Method:          http.MethodPatch,
+			TestAppFactory:  setupTestApp,
+			ExpectedStatus:  s.status,
+			ExpectedContent: []string{s.expected},
+		}
+		sc.BeforeTestFunc = func(t testing.TB, app *tests.TestApp, _ *core.ServeEvent) {
+			col := createTariffsCollection(t, app)
+			col.ListRule = types.Pointer("")
+			col.ViewRule = s.viewRule
+			if err := app.Save(col); err != nil {
+				t.Fatalf("failed to update tariffs rules: %v", err)
+			}
+			saveTariff(t, app, col, "tariffstandard1", "STD", "10")
+			saveTariff(t, app, col, "tariffpremium01", "PRE", "25")
+
+			cfId, token := seedGuardedCF(t, app, "1")
+			_, err := app.DB().Update("calculated_fields",
+				dbx.Params{"allowed_view_admin": guardedAdminId},
+				dbx.HashExp{"owner_collection": "tariffs"},
+			).Execute()
+			if err != nil {
+				t.Fatalf("failed to share the tariffs cells: %v", err)
+			}
+			sc.URL = "/api/collections/calculated_fields/records/" + cfId
+			sc.Headers = map[string]string{"Authorization": token}
+			sc.Body = strings.NewReader(`{"formula":"LOOKUP(\"tariffs\", \"code\", \"STD\", \"rate_fx\") * 2"}`)
+		}
+		sc.Test(t)
+	}
+}
+
+func TestCalculatedFields_Lookup_ProtectedFieldsRejected(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cfCol, err := app.FindCollectionByNameOrId("calculated_fields")
+	if err != nil {
+		t.Fatalf("cannot find calculated_fields: %v", err)
+	}
+	col := createTariffsCollection(t, app)
+	col.Fields.Add(&core.TextField{Name: "secret_code", Hidden: true})
+	col.Fields.Add(&core.RelationField{Name: "secret_fx", CollectionId: cfCol.Id, MaxSelect: 1, Hidden: true})
+	if err := app.Save(col); err != nil {
+		t.Fatalf("failed to update tariffs: %v", err)
+	}
+	// auth collection: email è protetta anche senza hidden (emailVisibility)
+	admins, err := app.FindCollectionByNameOrId("administrators")
+	if err != nil {
+		t.Fatalf("cannot find administrators: %v", err)
+	}
+	admins.Fields.Add(&core.RelationField{Name: "rate_fx", CollectionId: cfCol.Id, MaxSelect: 1})
+	if err := app.Save(admins); err != nil {
+		t.Fatalf("failed to update administrators: %v", err)
+	}
+
+	cf := savePoolCF(t, app, "lookupprotect01", "", "0")
+	formulas := []string{
+		`LOOKUP("tariffs", "secret_code", "STD", "rate_fx")`,
+		`LOOKUP("tariffs", "code", "STD", "secret_fx")`,
+		`LOOKUP("administrators", "email", "admin@example.com", "rate_fx")`,
+		`LOOKUP("administrators", "password", "x", "rate_fx")`,
+		`COLUMN("tariffs", "secret_fx")`,
+	}
+	for _, formula := range formulas {
+		cf = mustFindCF(t, app, cf.Id)
+		cf.Set("formula", formula)
+
+		err := app.Save(cf)
+		if err == nil {
+			t.Fatalf("expected error for formula %s", formula)
+		}
+		raw, _ := json.Marshal(err)
+		if !strings.Contains(string(raw), `"code":"1014"`) {
+			t.Fatalf("expected 1014 for %s, got %s (%v)", formula, raw, err)
+		}
+	}
+
+	// i campi leggibili restano utilizzabili
+	formula := `LOOKUP("administrators", "username", "nobody", "rate_fx")`
+	saveFormula(t, app, cf.Id, formula)
+	checkFormulaUpdate(t, app, cf.Id, formula, `"#N/A"`, "LOOKUP: no record of administrators with username = nobody")
+}
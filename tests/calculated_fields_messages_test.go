@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func TestCalculatedFields_ErrorCode_StoredOnRecord(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	div := savePoolCF(t, app, "errcodediv00001", "err_code_div", "1 / 0")
+	child := savePoolCF(t, app, "errcodechild001", "", "err_code_div + 1")
+
+	cases := []struct {
+		formula string
+		code    string
+	}{
+		{"1 / 0", "DIV0"},
+		{`"a" - 1`, "VALUE"},
+		{"NOT_REGISTERED(1)", "NAME"},
+		{"ABS(nil)", "NA"},
+		{"SQRT(-1)", "NUM"},
+		{"1", ""},
+	}
+	for _, c := range cases {
+		saveFormula(t, app, div.Id, c.formula)
+		if got := mustFindCF(t, app, div.Id).GetString("error_code"); got != c.code {
+			t.Errorf("expected error_code %q for %s, got %q", c.code, c.formula, got)
+		}
+	}
+
+	// l'errore ereditato mantiene il codice di origine
+	saveFormula(t, app, div.Id, "1 / 0")
+	if got := mustFindCF(t, app, child.Id).GetString("error_code"); got != "DIV0" {
+		t.Fatalf("expected the inherited error_code DIV0, got %q", got)
+	}
+}
+
+func saveFormula(t testing.TB, app *tests.TestApp, id, formula string) {
+	t.Helper()
+
+	rec := mustFindCF(t, app, id)
+	rec.Set("formula", formula)
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("save of %q failed: %v", formula, err)
+	}
+}
+
+func TestCalculatedFields_ErrorMessage_Catalog(t *testing.T) {
+	cases := []struct {
+		locales  []string
+		expected string
+	}{
+		{nil, "Division by zero"},
+		{[]string{"it"}, "Divisione per zero"},
+		{[]string{"it-IT"}, "Divisione per zero"},
+		{[]string{"xx", "it_IT"}, "Divisione per zero"},
+		{[]string{"xx"}, "Division by zero"},
+	}
+	for _, c := range cases {
+		if got := calculatedfields.ErrorMessage("DIV0", c.locales...); got != c.expected {
+			t.Errorf("expected %q for %v, got %q", c.expected, c.locales, got)
+		}
+	}
+	if got := calculatedfields.ErrorMessage("UNKNOWN"); got != "UNKNOWN" {
+		t.Errorf("expected the code itself for an unknown code, got %q", got)
+	}
+
+	if err := calculatedfields.RegisterErrorMessages("zz-test", map[string]string{"DIV0": "zz div0"}); err != nil {
+		t.Fatalf("RegisterErrorMessages failed: %v", err)
+	}
+	if got := calculatedfields.ErrorMessage("DIV0", "zz-TEST"); got != "zz div0" {
+		t.Errorf("expected the registered message, got %q", got)
+	}
+	// chiave mancante: messaggio inglese
+	if got := calculatedfields.ErrorMessage("NUM", "zz-test"); got != "Invalid number" {
+		t.Errorf("expected the default message, got %q", got)
+	}
+	if err := calculatedfields.RegisterErrorMessages(" ", nil); err == nil {
+		t.Errorf("expected an error for an empty locale")
+	}
+}
+
+func TestCalculatedFields_ErrorDetail_Catalog(t *testing.T) {
+	cases := []struct {
+		detail   string
+		locales  []string
+		expected string
+	}{
+		{"Division by zero or infinite result", nil, "Division by zero or infinite result"},
+		{"Division by zero or infinite result", []string{"it-IT"}, "Divisione per zero o risultato infinito"},
+		{"Division by zero or infinite result", []string{"en", "it"}, "Division by zero or infinite result"},
+		{"SQRT: negative argument (-1)", []string{"it"}, "SQRT: argomento negativo (-1)"},
+		{`DATEDIF: unit "W" is not supported (Y, M, D, MD, YM, YD)`, []string{"it"}, `DATEDIF: unità "W" non supportata (Y, M, D, MD, YM, YD)`},
+		// il dettaglio ereditato è tradotto a sua volta
+		{"Inherited error from abc: LOOKUP: no record of tariffs with code = PRE", []string{"it"},
+			"Errore ereditato da abc: LOOKUP: nessun record di tariffs con code = PRE"},
+		// testo senza formato nel catalogo (es. errori di expr o delle funzioni JS): invariato
+		{"negative input", []string{"it"}, "negative input"},
+	}
+	for _, c := range cases {
+		if got := calculatedfields.ErrorDetail(c.detail, c.locales...); got != c.expected {
+			t.Errorf("expected %q for %q %v, got %q", c.expected, c.detail, c.locales, got)
+		}
+	}
+
+	if err := calculatedfields.RegisterErrorDetails("zz-detail", map[string]string{"SQRT: negative argument (%v)": "zz sqrt %v"}); err != nil {
+		t.Fatalf("RegisterErrorDetails failed: %v", err)
+	}
+	if got := calculatedfields.ErrorDetail("SQRT: negative argument (-4)", "zz-detail"); got != "zz sqrt -4" {
+		t.Errorf("expected the registered detail, got %q", got)
+	}
+	if err := calculatedfields.RegisterErrorDetails("zz-detail", map[string]string{"SQRT: negative argument (%v)": "zz sqrt"}); err == nil {
+		t.Errorf("expected an error for a translation with different verbs")
+	}
+}
+
+func TestCalculatedFields_ErrorMessage_HTTP(t *testing.T) {
+	autApp, _ := tests.NewTestApp("../tests/pb_data")
+	superAuthHeader := map[string]string{"Authorization": getSuperuserToken(t, autApp)}
+
+	seedDivZero := func(t testing.TB, app *tests.TestApp, e *core.ServeEvent) {
+		savePoolCF(t, app, "errcodehttp0001", "", "1 / 0")
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "error_message in inglese per default",
+			Method:         http.MethodGet,
+			URL:            "/api/collections/calculated_fields/records/errcodehttp0001",
+			Headers:        superAuthHeader,
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: seedDivZero,
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"error_code":"DIV0"`,
+				`"error_message":"Division by zero"`,
+				`"error":"Division by zero or infinite result"`,
+			},
+		},
+		{
+			Name:   "error_message nella lingua della richiesta",
+			Method: http.MethodGet,
+			URL:    "/api/collections/calculated_fields/records/errcodehttp0001",
+			Headers: map[string]string{
+				"Authorization":   superAuthHeader["Authorization"],
+				"Accept-Language": "it-IT,it;q=0.9,en;q=0.8",
+			},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: seedDivZero,
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"error_code":"DIV0"`,
+				`"error_message":"Divisione per zero"`,
+				`"error":"Divisione per zero o risultato infinito"`,
+			},
+		},
+		{
+			Name:           "error_message vuoto senza errore",
+			Method:         http.MethodGet,
+			URL:            "/api/collections/calculated_fields/records/yysba8o7a6773c3",
+			Headers:        superAuthHeader,
+			TestAppFactory: setupTestApp,
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"error_code":""`,
+				`"error_message":""`,
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// addOwnerNumberFields aggiunge campi number "normali" alla collection owner
+func addOwnerNumberFields(t testing.TB, app *tests.TestApp, collection string, names ...string) {
+	t.Helper()
+
+	col, err := app.FindCollectionByNameOrId(collection)
+	if err != nil {
+		t.Fatalf("cannot find %s: %v", collection, err)
+	}
+	for _, name := range names {
+		col.Fields.Add(&core.NumberField{Name: name})
+	}
+	if err := app.Save(col); err != nil {
+		t.Fatalf("failed to add fields %v to %s: %v", names, collection, err)
+	}
+}
+
+// updateOwner aggiorna i campi della riga owner con un save normale (con hook)
+func updateOwner(t testing.TB, app *tests.TestApp, collection, id string, data map[string]any) {
+	t.Helper()
+
+	rec, err := app.FindRecordById(collection, id)
+	if err != nil {
+		t.Fatalf("cannot find %s/%s: %v", collection, id, err)
+	}
+	for k, v := range data {
+		rec.Set(k, v)
+	}
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("failed to update %s/%s: %v", collection, id, err)
+	}
+}
+
+func TestCalculatedFields_OwnerFields_EvaluateAndReactToOwnerUpdate(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	addOwnerNumberFields(t, app, "booking_queue", "price", "quantity")
+
+	queue := createBookingQueue(t, app, "ownerrefqueue01")
+	updateOwner(t, app, "booking_queue", queue.Id, map[string]any{"price": 2.5, "quantity": 4})
+
+	actFx := setOwnerFieldFormula(t, app, queue, "act_fx", "owner.price * owner.quantity")
+	if got := actFx.GetString("value"); got != "10" {
+		t.Fatalf("expected act_fx value 10, got %s (error=%q)", got, actFx.GetString("error"))
+	}
+	if deps := actFx.GetStringSlice("depends_on"); len(deps) != 0 {
+		t.Fatalf("owner fields must not end up in depends_on, got %v", deps)
+	}
+
+	// un CF di un altro owner che dipende da act_fx
+	total := savePoolCF(t, app, "ownerreftotal01", "", actFx.Id+" + 1")
+	checkFormulaUpdate(t, app, total.Id, actFx.Id+" + 1", "11", "")
+
+	// cambiando price sull'owner si ricalcola act_fx e si propaga
+	updateOwner(t, app, "booking_queue", queue.Id, map[string]any{"price": 5})
+	checkFormulaUpdate(t, app, actFx.Id, "owner.price * owner.quantity", "20", "")
+	checkFormulaUpdate(t, app, total.Id, actFx.Id+" + 1", "21", "")
+
+	// un campo non usato dalla formula non cambia nulla
+	updateOwner(t, app, "booking_queue", queue.Id, map[string]any{"queue_name": "renamed"})
+	checkFormulaUpdate(t, app, actFx.Id, "owner.price * owner.quantity", "20", "")
+}
+
+func TestCalculatedFields_OwnerFields_TextAndSiblings(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	addOwnerNumberFields(t, app, "booking_queue", "price")
+
+	queue := createBookingQueue(t, app, "ownerreftext001")
+	updateOwner(t, app, "booking_queue", queue.Id, map[string]any{"price": 3})
+
+	setOwnerFieldFormula(t, app, queue, "min_fx", "owner.price * 2")
+	actFx := setOwnerFieldFormula(t, app, queue, "act_fx", `owner.queue_name + ": " + string(self.min_fx)`)
+	if got := actFx.GetString("value"); got != `"queue ownerreftext001: 6"` {
+		t.Fatalf("unexpected act_fx value %s (error=%q)", got, actFx.GetString("error"))
+	}
+
+	updateOwner(t, app, "booking_queue", queue.Id, map[string]any{"price": 4, "queue_name": "q"})
+	checkFormulaUpdate(t, app, actFx.Id, `owner.queue_name + ": " + string(self.min_fx)`, `"q: 8"`, "")
+}
+
+func TestCalculatedFields_OwnerFields_UnknownFieldRejected(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	queue := createBookingQueue(t, app, "ownerrefmissing")
+
+	cf := mustFindCF(t, app, queue.GetString("act_fx"))
+	cf.Set("formula", "owner.not_a_field + 1")
+
+	err := app.Save(cf)
+	if err == nil {
+		t.Fatal("expected error for unknown owner field")
+	}
+	raw, _ := json.Marshal(err)
+	if !strings.Contains(string(raw), `"code":"1007"`) {
+		t.Fatalf("expected 1007, got %s (%v)", raw, err)
+	}
+}
+
+func TestCalculatedFields_OwnerFields_ProtectedFieldsRejected(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	col, err := app.FindCollectionByNameOrId("booking_queue")
+	if err != nil {
+		t.Fatalf("cannot find booking_queue: %v", err)
+	}
+	col.Fields.Add(&core.TextField{Name: "internal_note", Hidden: true})
+	if err := app.Save(col); err != nil {
+		t.Fatalf("failed to add hidden field: %v", err)
+	}
+	queue := createBookingQueue(t, app, "ownerrefhidden1")
+
+	// owner auth: password, tokenKey ed email non devono finire in value
+	seedAdmin(t, app, "ownerrefadmin01", "ownerref_admin")
+	adminCF := createCF(t, app, "ownerrefadmcf01", "1", "administrators", "ownerrefadmin01", "cf_secret", "")
+
+	cases := map[string]string{
+		"owner.internal_note": queue.GetString("act_fx"),
+		"owner.password":      adminCF.Id,
+		"owner.tokenKey":      adminCF.Id,
+		"owner.email":         adminCF.Id,
+	}
+	for formula, id := range cases {
+		cf := mustFindCF(t, app, id)
+		cf.Set("formula", formula)
+
+		err := app.Save(cf)
+		if err == nil {
+			t.Fatalf("expected error for %s, got value %s", formula, cf.GetString("value"))
+		}
+		raw, _ := json.Marshal(err)
+		if !strings.Contains(string(raw), `"code":"1007"`) {
+			t.Fatalf("expected 1007 for %s, got %s (%v)", formula, raw, err)
+		}
+	}
+
+	// controllo: un campo normale dell'auth owner resta leggibile
+	checkFormulaUpdateAfterSave(t, app, adminCF.Id, "owner.username", `"ownerref_admin"`)
+}
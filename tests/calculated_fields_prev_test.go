@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+const runningBalance = "COALESCE(prev.balance, 0) + owner.amount"
+
+func createLedgerCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	cfCol, err := app.FindCollectionByNameOrId("calculated_fields")
+	if err != nil {
+		t.Fatalf("cannot find calculated_fields: %v", err)
+	}
+
+	col := core.NewBaseCollection("ledger")
+	col.Fields.Add(&core.NumberField{Name: "position"})
+	col.Fields.Add(&core.NumberField{Name: "amount"})
+	col.Fields.Add(&core.RelationField{Name: "balance", CollectionId: cfCol.Id, MaxSelect: 1})
+	col.Fields.Add(&core.AutodateField{Name: "created", OnCreate: true})
+	col.Fields.Add(&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true})
+	if err := app.Save(col); err != nil {
+		t.Fatalf("failed to create ledger collection: %v", err)
+	}
+
+	cfg := calculatedfields.DefaultConfig()
+	cfg.RowOrder = map[string]string{"ledger": "position"}
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	return col
+}
+
+// saveLedgerRow crea una riga e imposta il saldo progressivo
+func saveLedgerRow(t testing.TB, app *tests.TestApp, col *core.Collection, id string, position, amount float64) *core.Record {
+	t.Helper()
+
+	rec := core.NewRecord(col)
+	rec.Set("id", id)
+	rec.Set("position", position)
+	rec.Set("amount", amount)
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("failed to save ledger/%s: %v", id, err)
+	}
+	rec, err := app.FindRecordById("ledger", id)
+	if err != nil {
+		t.Fatalf("cannot reload ledger/%s: %v", id, err)
+	}
+	setOwnerFieldFormula(t, app, rec, "balance", runningBalance)
+	return rec
+}
+
+func checkBalances(t testing.TB, app *tests.TestApp, rows map[*core.Record]string) {
+	t.Helper()
+	for row, want := range rows {
+		checkFormulaUpdate(t, app, row.GetString("balance"), runningBalance, want, "")
+	}
+}
+
+func TestCalculatedFields_Prev_RunningTotal(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	col := createLedgerCollection(t, app)
+	r1 := saveLedgerRow(t, app, col, "ledgerrow000001", 10, 100)
+	r2 := saveLedgerRow(t, app, col, "ledgerrow000002", 20, -30)
+	r3 := saveLedgerRow(t, app, col, "ledgerrow000003", 30, 5)
+	checkBalances(t, app, map[*core.Record]string{r1: "100", r2: "70", r3: "75"})
+
+	// un importo cambia: il saldo si propaga alle righe successive
+	r1.Set("amount", 50)
+	if err := app.Save(r1); err != nil {
+		t.Fatalf("failed to update amount: %v", err)
+	}
+	checkBalances(t, app, map[*core.Record]string{r1: "50", r2: "20", r3: "25"})
+
+	// inserimento in mezzo
+	r15 := saveLedgerRow(t, app, col, "ledgerrow000015", 15, 1)
+	checkBalances(t, app, map[*core.Record]string{r1: "50", r15: "51", r2: "21", r3: "26"})
+
+	// riordino: r3 diventa la prima riga
+	r3.Set("position", 1)
+	if err := app.Save(r3); err != nil {
+		t.Fatalf("failed to reorder: %v", err)
+	}
+	checkBalances(t, app, map[*core.Record]string{r3: "5", r1: "55", r15: "56", r2: "26"})
+
+	// cancellazione: la riga successiva si aggancia alla precedente, nessun #REF!
+	if err := app.Delete(r15); err != nil {
+		t.Fatalf("failed to delete row: %v", err)
+	}
+	checkBalances(t, app, map[*core.Record]string{r3: "5", r1: "55", r2: "25"})
+}
+
+func TestCalculatedFields_Prev_InvalidReference(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	col := createLedgerCollection(t, app)
+	row := saveLedgerRow(t, app, col, "ledgerinvalid01", 1, 1)
+
+	pool := savePoolCF(t, app, "prevpoolnode001", "", "0")
+
+	// prev.<field> deve essere una relation verso calculated_fields della collection owner del nodo
+	cases := map[string]string{
+		"prev.amount + 1":  row.GetString("balance"),
+		"prev.missing + 1": row.GetString("balance"),
+		"prev.balance + 1": pool.Id,
+	}
+	for formula, id := range cases {
+		cf := mustFindCF(t, app, id)
+		cf.Set("formula", formula)
+
+		err := app.Save(cf)
+		if err == nil {
+			t.Fatalf("expected error for formula %s", formula)
+		}
+		raw, _ := json.Marshal(err)
+		if !strings.Contains(string(raw), `"code":"1007"`) {
+			t.Fatalf("expected 1007 for %s, got %s (%v)", formula, raw, err)
+		}
+	}
+}
+
+func TestCalculatedFields_Prev_DescendingOrderWithTies(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	col := createLedgerCollection(t, app)
+	cfg := calculatedfields.GetConfig(app)
+	cfg.RowOrder = map[string]string{"ledger": "-position"}
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+
+	// a parità di position vale l'id
+	c := saveLedgerRow(t, app, col, "ledgerdesc0000c", 1, 100)
+	b := saveLedgerRow(t, app, col, "ledgerdesc0000b", 3, 10)
+	a := saveLedgerRow(t, app, col, "ledgerdesc0000a", 3, 1)
+	checkBalances(t, app, map[*core.Record]string{a: "1", b: "11", c: "111"})
+
+	// la riga precedente resta collegata in depends_on
+	if deps := mustFindCF(t, app, c.GetString("balance")).GetStringSlice("depends_on"); len(deps) != 1 || deps[0] != b.GetString("balance") {
+		t.Fatalf("expected the balance of %s in depends_on, got %v", b.Id, deps)
+	}
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"testing"
+
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func TestCalculatedFields_ProgramCache_HitsAndInvalidation(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+	// la cache è del processo: ripristina la capacità di default per gli altri test
+	defer calculatedfields.SetConfig(app, calculatedfields.DefaultConfig())
+
+	formula := "7 * 6 + 0.5"
+	before := calculatedfields.GetProgramCacheStats()
+	savePoolCF(t, app, "programcache001", "", formula)
+	afterFirst := calculatedfields.GetProgramCacheStats()
+	if afterFirst.Misses <= before.Misses {
+		t.Fatalf("expected a miss on first compilation, got %+v -> %+v", before, afterFirst)
+	}
+
+	rec := savePoolCF(t, app, "programcache002", "", formula)
+	checkFormulaUpdate(t, app, rec.Id, formula, "42.5", "")
+	afterSecond := calculatedfields.GetProgramCacheStats()
+	if afterSecond.Hits <= afterFirst.Hits {
+		t.Fatalf("expected a hit for the same formula, got %+v -> %+v", afterFirst, afterSecond)
+	}
+	if afterSecond.Size == 0 || afterSecond.Capacity != calculatedfields.DefaultConfig().ProgramCacheSize {
+		t.Fatalf("unexpected cache size/capacity: %+v", afterSecond)
+	}
+
+	// una nuova funzione custom invalida i programmi compilati
+	if err := calculatedfields.RegisterFunction("PROGRAM_CACHE_PROBE", func(params ...any) (any, error) { return 1, nil }); err != nil {
+		t.Fatalf("RegisterFunction failed: %v", err)
+	}
+	if stats := calculatedfields.GetProgramCacheStats(); stats.Size != 0 {
+		t.Fatalf("expected an empty cache after registering a function, got %+v", stats)
+	}
+
+	// capacità ridotta: i meno recenti vengono scartati, 0 disattiva la cache
+	cfg := calculatedfields.DefaultConfig()
+	cfg.ProgramCacheSize = 2
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	for i, f := range []string{"1 + 1", "2 + 2", "3 + 3"} {
+		savePoolCF(t, app, "programcachelr"+string(rune('a'+i)), "", f)
+	}
+	if stats := calculatedfields.GetProgramCacheStats(); stats.Size != 2 || stats.Evictions == 0 {
+		t.Fatalf("expected LRU eviction down to 2 programs, got %+v", stats)
+	}
+
+	cfg.ProgramCacheSize = 0
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	savePoolCF(t, app, "programcacheoff", "", formula)
+	if stats := calculatedfields.GetProgramCacheStats(); stats.Size != 0 {
+		t.Fatalf("expected the cache to be disabled, got %+v", stats)
+	}
+
+	cfg.ProgramCacheSize = -1
+	if err := calculatedfields.SetConfig(app, cfg); err == nil {
+		t.Fatal("expected error for negative program_cache_size")
+	}
+}
@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+var (
+	registerTestFunctionsOnce sync.Once
+	volatileCounter           atomic.Int64
+)
+
+// le funzioni custom sono globali al processo: vanno registrate una volta sola per tutti i test
+func registerTestFunctions(t testing.TB) {
+	t.Helper()
+
+	registerTestFunctionsOnce.Do(func() {
+		err := calculatedfields.RegisterFunction("TIER_PRICE", func(params ...any) (any, error) {
+			qty, ok := params[0].(float64)
+			if !ok {
+				return nil, &calculatedfields.FormulaError{Code: "#VALUE!", Message: "TIER_PRICE: quantity must be a number"}
+			}
+			if qty >= 100 {
+				return qty * 8, nil
+			}
+			return qty * 10, nil
+		})
+		if err != nil {
+			t.Fatalf("failed to register TIER_PRICE: %v", err)
+		}
+
+		err = calculatedfields.RegisterFunction("SLA_HOURS", func(params ...any) (any, error) {
+			return params[0].(float64) * 24, nil
+		}, new(func(float64) float64))
+		if err != nil {
+			t.Fatalf("failed to register SLA_HOURS: %v", err)
+		}
+
+		err = calculatedfields.RegisterVolatileFunction("NEXT_TICKET", func(params ...any) (any, error) {
+			return float64(volatileCounter.Add(1)), nil
+		})
+		if err != nil {
+			t.Fatalf("failed to register NEXT_TICKET: %v", err)
+		}
+	})
+}
+
+func TestCalculatedFields_CustomFunctions_Evaluate(t *testing.T) {
+	registerTestFunctions(t)
+
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	qty := savePoolCF(t, app, "customfnqty0001", "qty", "50")
+	price := savePoolCF(t, app, "customfnprice01", "", "TIER_PRICE(qty)")
+	checkFormulaUpdate(t, app, price.Id, "TIER_PRICE(qty)", "500", "")
+
+	qty = mustFindCF(t, app, qty.Id)
+	qty.Set("formula", "100")
+	if err := app.Save(qty); err != nil {
+		t.Fatalf("failed to update qty: %v", err)
+	}
+	checkFormulaUpdate(t, app, price.Id, "TIER_PRICE(qty)", "800", "")
+
+	// FormulaError restituito dalla funzione -> codice da foglio di calcolo
+	bad := savePoolCF(t, app, "customfnbad0001", "", `TIER_PRICE("many")`)
+	checkFormulaUpdate(t, app, bad.Id, `TIER_PRICE("many")`, `"#VALUE!"`, "TIER_PRICE: quantity must be a number")
+
+	// funzione sconosciuta -> #NAME? con il nome nel messaggio
+	unknown := savePoolCF(t, app, "customfnunknown", "", "NOT_REGISTERED(1)")
+	checkFormulaUpdate(t, app, unknown.Id, "NOT_REGISTERED(1)", `"#NAME?"`, "Unknown or undefined function: NOT_REGISTERED")
+}
+
+func TestCalculatedFields_CustomFunctions_SignaturesCheckedAtCompile(t *testing.T) {
+	registerTestFunctions(t)
+
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	sla := savePoolCF(t, app, "customfnsla0001", "", "SLA_HOURS(2)")
+	checkFormulaUpdate(t, app, sla.Id, "SLA_HOURS(2)", "48", "")
+
+	sla = mustFindCF(t, app, sla.Id)
+	sla.Set("formula", `SLA_HOURS("two")`)
+	err := app.Save(sla)
+	if err == nil {
+		t.Fatal("expected compile error for wrong argument type")
+	}
+	raw, _ := json.Marshal(err)
+	if !strings.Contains(string(raw), `"code":"1004"`) {
+		t.Fatalf("expected 1004, got %s (%v)", raw, err)
+	}
+}
+
+func TestCalculatedFields_CustomFunctions_Volatile(t *testing.T) {
+	registerTestFunctions(t)
+
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	ticket := savePoolCF(t, app, "customfnticket1", "ticket", "NEXT_TICKET()")
+	label := savePoolCF(t, app, "customfnlabel01", "", `"T-" + string(ticket)`)
+	pure := savePoolCF(t, app, "customfnpure001", "", "TIER_PRICE(1)")
+
+	ticket = mustFindCF(t, app, ticket.Id)
+	if !strings.Contains(ticket.GetString("external_deps"), `"volatile"`) {
+		t.Fatalf("expected volatile marker in external_deps, got %s", ticket.GetString("external_deps"))
+	}
+	if deps := mustFindCF(t, app, pure.Id).GetString("external_deps"); strings.Contains(deps, "volatile") {
+		t.Fatalf("pure function must not be marked volatile, got %s", deps)
+	}
+
+	before := ticket.GetString("value")
+	if err := calculatedfields.RecalculateVolatileCalculatedFields(app); err != nil {
+		t.Fatalf("RecalculateVolatileCalculatedFields failed: %v", err)
+	}
+
+	ticket = mustFindCF(t, app, ticket.Id)
+	after := ticket.GetString("value")
+	if after == before {
+		t.Fatalf("expected volatile node to change, still %s", after)
+	}
+	checkFormulaUpdate(t, app, label.Id, `"T-" + string(ticket)`, `"T-`+after+`"`, "")
+}
+
+func TestCalculatedFields_CustomFunctions_VolatileSharedDependentOnce(t *testing.T) {
+	registerTestFunctions(t)
+
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	// due nodi volatili con un dipendente comune: un solo ricalcolo del dipendente
+	savePoolCF(t, app, "volshareticket1", "vol_share_a", "NEXT_TICKET()")
+	savePoolCF(t, app, "volshareticket2", "vol_share_b", "NEXT_TICKET()")
+	sum := savePoolCF(t, app, "volsharesum0001", "", "DIAMOND_PROBE(vol_share_a + vol_share_b)")
+
+	before := diamondProbeCalls.Load()
+	if err := calculatedfields.RecalculateVolatileCalculatedFields(app); err != nil {
+		t.Fatalf("RecalculateVolatileCalculatedFields failed: %v", err)
+	}
+	if calls := diamondProbeCalls.Load() - before; calls != 1 {
+		t.Fatalf("expected the shared dependent to be evaluated once, got %d evaluations", calls)
+	}
+
+	a, _ := strconv.Atoi(mustFindCF(t, app, "volshareticket1").GetString("value"))
+	b, _ := strconv.Atoi(mustFindCF(t, app, "volshareticket2").GetString("value"))
+	checkFormulaUpdate(t, app, sum.Id, sum.GetString("formula"), strconv.Itoa(a+b), "")
+}
+
+func TestCalculatedFields_CustomFunctions_RegistrationErrors(t *testing.T) {
+	registerTestFunctions(t)
+
+	fn := func(params ...any) (any, error) { return nil, nil }
+
+	cases := map[string]error{
+		"duplicate":        calculatedfields.RegisterFunction("TIER_PRICE", fn),
+		"standard library": calculatedfields.RegisterFunction("ROUND", fn),
+		"aggregate":        calculatedfields.RegisterFunction("SUMWHERE", fn),
+		"reserved keyword": calculatedfields.RegisterFunction("self", fn),
+		"invalid name":     calculatedfields.RegisterFunction("bad-name", fn),
+		"nil function":     calculatedfields.RegisterFunction("NIL_FN", nil),
+	}
+	for name, err := range cases {
+		if err == nil {
+			t.Errorf("%s: expected registration error", name)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+// corruptCF modifica il calculated_field direttamente a db, senza hook (come un edit manuale o un restore)
+func corruptCF(t testing.TB, app *tests.TestApp, id string, params dbx.Params) {
+	t.Helper()
+
+	if _, err := app.DB().Update("calculated_fields", params, dbx.HashExp{"id": id}).Execute(); err != nil {
+		t.Fatalf("manual update of %s failed: %v", id, err)
+	}
+}
+
+func TestCalculatedFields_Repair_RebuildsGraph(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "repairnodea0001", "rep_a", "1")
+	b := savePoolCF(t, app, "repairnodeb0001", "rep_b", "rep_a + 1")
+	c := savePoolCF(t, app, "repairnodec0001", "", "3")
+	d := savePoolCF(t, app, "repairnoded0001", "rep_d", "4")
+	e := savePoolCF(t, app, "repairnodee0001", "rep_e", "5")
+
+	corruptCF(t, app, b.Id, dbx.Params{"depends_on": "[]", "value": "99"})
+	corruptCF(t, app, c.Id, dbx.Params{"formula": "rep_missing + 1", "depends_on": `["repairmissing01"]`})
+	corruptCF(t, app, d.Id, dbx.Params{"formula": "rep_e + 1"})
+	corruptCF(t, app, e.Id, dbx.Params{"formula": "rep_d + 1"})
+
+	report, err := calculatedfields.RepairGraph(app)
+	if err != nil {
+		t.Fatalf("RepairGraph failed: %v", err)
+	}
+
+	relinked := []string{}
+	for _, r := range report.Relinked {
+		relinked = append(relinked, r.Id)
+	}
+	for _, id := range []string{b.Id, d.Id, e.Id} {
+		if !slices.Contains(relinked, id) {
+			t.Errorf("expected %s to be relinked, got %v", id, relinked)
+		}
+	}
+	if !slices.Contains(report.Dangling, calculatedfields.RepairIssue{Id: c.Id, Code: "1007", Message: "Variable not found in DAG during evaluation: [rep_missing]"}) {
+		t.Errorf("expected %s as dangling (1007), got %+v", c.Id, report.Dangling)
+	}
+	if len(report.Cycles) != 1 || !slices.Contains(report.Cycles[0], d.Id) || !slices.Contains(report.Cycles[0], e.Id) {
+		t.Errorf("expected the cycle between %s and %s, got %v", d.Id, e.Id, report.Cycles)
+	}
+	if !slices.Contains(report.Recomputed, b.Id) {
+		t.Errorf("expected %s to be recomputed, got %v", b.Id, report.Recomputed)
+	}
+
+	checkFormulaUpdate(t, app, b.Id, "rep_a + 1", "2", "")
+	for _, id := range []string{c.Id, d.Id, e.Id} {
+		if got := mustFindCF(t, app, id).GetString("value"); got != `"#REF!"` {
+			t.Errorf("expected #REF! for %s, got %s", id, got)
+		}
+	}
+	// il nodo pendente non punta più a id inesistenti
+	if deps := mustFindCF(t, app, c.Id).GetStringSlice("depends_on"); len(deps) != 0 {
+		t.Errorf("expected an empty depends_on for %s, got %v", c.Id, deps)
+	}
+
+	// il grafo riparato propaga di nuovo
+	checkFormulaUpdateAfterSave(t, app, a.Id, "10", "10")
+	checkFormulaUpdate(t, app, b.Id, "rep_a + 1", "11", "")
+}
+
+func TestCalculatedFields_Repair_IgnoresEvalTimeout(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	a := savePoolCF(t, app, "repairtimeout01", "rep_to_a", "1")
+	b := savePoolCF(t, app, "repairtimeout02", "", "rep_to_a + 1")
+	corruptCF(t, app, b.Id, dbx.Params{"depends_on": "[]", "value": "99"})
+
+	cfg := calculatedfields.GetConfig(app)
+	cfg.EvalTimeout = "1ns"
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+
+	if _, err := calculatedfields.RepairGraph(app); err != nil {
+		t.Fatalf("RepairGraph failed: %v", err)
+	}
+	checkFormulaUpdate(t, app, a.Id, "1", "1", "")
+	checkFormulaUpdate(t, app, b.Id, "rep_to_a + 1", "2", "")
+}
+
+func TestCalculatedFields_Repair_HTTP(t *testing.T) {
+	autApp, _ := tests.NewTestApp("../tests/pb_data")
+	superAuthHeader := map[string]string{"Authorization": getSuperuserToken(t, autApp)}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "repair senza superuser",
+			Method:          http.MethodPost,
+			URL:             "/api/calculated_fields/repair",
+			TestAppFactory:  setupTestApp,
+			ExpectedStatus:  401,
+			ExpectedContent: []string{`"data":{}`},
+		},
+		{
+			Name:           "repair restituisce il report",
+			Method:         http.MethodPost,
+			URL:            "/api/calculated_fields/repair",
+			Headers:        superAuthHeader,
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t testing.TB, app *tests.TestApp, e *core.ServeEvent) {
+				// B perde la dipendenza da A
+				corruptCF(t, app, "c03u7o5plc4hucf", dbx.Params{"depends_on": "[]"})
+			},
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"checked":`,
+				`"id":"c03u7o5plc4hucf","old_depends_on":[],"new_depends_on":["yysba8o7a6773c3"]`,
+				`"cycles":[]`,
+			},
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if !slices.Contains(mustFindCF(t, app, "c03u7o5plc4hucf").GetStringSlice("depends_on"), "yysba8o7a6773c3") {
+					t.Fatalf("expected depends_on to be restored")
+				}
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
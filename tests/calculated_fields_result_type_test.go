@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	calculatedfields "github.com/vittorioparagallo/pocketbase-calculated-fields-plugin"
+)
+
+func TestCalculatedFields_ResultType_Coercion(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cases := []struct {
+		resultType string
+		formula    string
+		value      string
+		err        string
+	}{
+		{"number", "2 + 0.5", "2.5", ""},
+		{"number", `"42.5"`, "42.5", ""},
+		{"number", "true", "1", ""},
+		{"number", `"abc"`, `"#VALUE!"`, `The result "abc" cannot be converted to the declared type number`},
+		{"number", "[1, 2]", `"#VALUE!"`, "The result [1,2] cannot be converted to the declared type number"},
+		{"integer", "10 / 2", "5", ""},
+		{"integer", "10 / 4", `"#VALUE!"`, "The result 2.5 is not an integer"},
+		{"string", "1.5 * 2", `"3"`, ""},
+		{"string", "false", `"false"`, ""},
+		{"string", `{"a": 1}`, `"#VALUE!"`, `The result {"a":1} cannot be converted to the declared type string`},
+		{"boolean", "0", "false", ""},
+		{"boolean", `"TRUE"`, "true", ""},
+		{"boolean", `"yes"`, `"#VALUE!"`, `The result "yes" cannot be converted to the declared type boolean`},
+		{"date", `DATE(2024, 5, 10)`, `"2024-05-10 00:00:00.000Z"`, ""},
+		{"date", `"2024-05-10"`, `"2024-05-10 00:00:00.000Z"`, ""},
+		{"date", "42", `"#VALUE!"`, "The result 42 cannot be converted to the declared type date"},
+		{"json", `{"a": [1, "b"]}`, `{"a":[1,"b"]}`, ""},
+		// nil resta vuoto e i codici di errore passano invariati
+		{"number", "nil", "null", ""},
+		{"integer", "1 / 0", `"#DIV/0!"`, "Division by zero or infinite result"},
+	}
+
+	for i, c := range cases {
+		id := fmt.Sprintf("resulttype%05d", i)
+		rec := savePoolCF(t, app, id, "", "0")
+		rec = mustFindCF(t, app, rec.Id)
+		rec.Set("result_type", c.resultType)
+		rec.Set("formula", c.formula)
+		if err := app.Save(rec); err != nil {
+			t.Fatalf("failed to save %s (%s): %v", c.formula, c.resultType, err)
+		}
+		checkFormulaUpdate(t, app, id, c.formula, c.value, c.err)
+	}
+}
+
+func TestCalculatedFields_ResultType_ChangeRecalculates(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	rec := savePoolCF(t, app, "resulttypechg01", "", "7 / 2")
+	checkFormulaUpdate(t, app, rec.Id, "7 / 2", "3.5", "")
+
+	rec = mustFindCF(t, app, rec.Id)
+	rec.Set("result_type", "integer")
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("failed to set result_type: %v", err)
+	}
+	checkFormulaUpdate(t, app, rec.Id, "7 / 2", `"#VALUE!"`, "The result 3.5 is not an integer")
+
+	rec = mustFindCF(t, app, rec.Id)
+	rec.Set("result_type", "string")
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("failed to set result_type: %v", err)
+	}
+	checkFormulaUpdate(t, app, rec.Id, "7 / 2", `"3.5"`, "")
+
+	rec = mustFindCF(t, app, rec.Id)
+	rec.Set("result_type", "currency")
+	if err := app.Save(rec); err == nil {
+		t.Fatal("expected validation error for unknown result_type")
+	}
+}
+
+func TestCalculatedFields_ResultType_DecimalMode(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	cfg := calculatedfields.DefaultConfig()
+	cfg.DecimalMode = true
+	if err := calculatedfields.SetConfig(app, cfg); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+
+	cases := []struct {
+		resultType string
+		formula    string
+		value      string
+	}{
+		{"number", `"0.1"`, `"0.10"`},
+		{"integer", "0.5 * 4", "2"},
+		{"string", "0.1 + 0.2", `"0.3"`},
+	}
+
+	for i, c := range cases {
+		id := fmt.Sprintf("resulttypedec%02d", i)
+		rec := savePoolCF(t, app, id, "", "0")
+		rec = mustFindCF(t, app, rec.Id)
+		rec.Set("result_type", c.resultType)
+		rec.Set("formula", c.formula)
+		if err := app.Save(rec); err != nil {
+			t.Fatalf("failed to save %s: %v", c.formula, err)
+		}
+		checkFormulaUpdate(t, app, id, c.formula, c.value, "")
+	}
+}
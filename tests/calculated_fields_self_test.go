@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// createBookingQueue crea una riga booking_queue (save con hook: i CF act/min/max vengono auto-creati)
+func createBookingQueue(t testing.TB, app *tests.TestApp, id string) *core.Record {
+	t.Helper()
+
+	col, err := app.FindCollectionByNameOrId("booking_queue")
+	if err != nil {
+		t.Fatalf("cannot find booking_queue: %v", err)
+	}
+
+	rec := core.NewRecord(col)
+	rec.Set("id", id)
+	rec.Set("queue_name", "queue "+id)
+	rec.Set("booking_status", "booked")
+	if err := app.Save(rec); err != nil {
+		t.Fatalf("failed to create booking_queue/%s: %v", id, err)
+	}
+
+	rec, err = app.FindRecordById("booking_queue", id)
+	if err != nil {
+		t.Fatalf("cannot reload booking_queue/%s: %v", id, err)
+	}
+	return rec
+}
+
+// setOwnerFieldFormula aggiorna la formula del CF collegato a owner.<field>
+func setOwnerFieldFormula(t testing.TB, app *tests.TestApp, owner *core.Record, field, formula string) *core.Record {
+	t.Helper()
+
+	cf := mustFindCF(t, app, owner.GetString(field))
+	cf.Set("formula", formula)
+	if err := app.Save(cf); err != nil {
+		t.Fatalf("failed to set %s.%s formula %q: %v", owner.Id, field, formula, err)
+	}
+	return mustFindCF(t, app, cf.Id)
+}
+
+func TestCalculatedFields_SelfReference_ResolvesSiblings(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	queue := createBookingQueue(t, app, "selfrefqueue001")
+
+	minFx := setOwnerFieldFormula(t, app, queue, "min_fx", "3")
+	maxFx := setOwnerFieldFormula(t, app, queue, "max_fx", "7")
+	actFx := setOwnerFieldFormula(t, app, queue, "act_fx", "self.min_fx + self.max_fx")
+
+	if got := actFx.GetString("value"); got != "10" {
+		t.Fatalf("expected act_fx value 10, got %s (error=%q)", got, actFx.GetString("error"))
+	}
+
+	deps := actFx.GetStringSlice("depends_on")
+	if len(deps) != 2 || !(deps[0] == minFx.Id || deps[1] == minFx.Id) || !(deps[0] == maxFx.Id || deps[1] == maxFx.Id) {
+		t.Fatalf("expected depends_on [%s %s], got %v", minFx.Id, maxFx.Id, deps)
+	}
+
+	// la propagazione passa dai fratelli
+	setOwnerFieldFormula(t, app, queue, "max_fx", "17")
+	checkFormulaUpdate(t, app, actFx.Id, "self.min_fx + self.max_fx", "20", "")
+}
+
+func TestCalculatedFields_SelfReference_SurvivesCopyToAnotherRow(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	first := createBookingQueue(t, app, "selfrefcopy0001")
+	second := createBookingQueue(t, app, "selfrefcopy0002")
+
+	setOwnerFieldFormula(t, app, first, "min_fx", "1")
+	setOwnerFieldFormula(t, app, second, "min_fx", "100")
+
+	firstAct := setOwnerFieldFormula(t, app, first, "act_fx", "self.min_fx * 2")
+	// stessa formula copiata su un'altra riga: si riferisce al fratello della nuova riga
+	secondAct := setOwnerFieldFormula(t, app, second, "act_fx", firstAct.GetString("formula"))
+
+	if got := firstAct.GetString("value"); got != "2" {
+		t.Fatalf("expected first act_fx 2, got %s", got)
+	}
+	if got := secondAct.GetString("value"); got != "200" {
+		t.Fatalf("expected second act_fx 200, got %s", got)
+	}
+	if deps := secondAct.GetStringSlice("depends_on"); len(deps) != 1 || deps[0] != second.GetString("min_fx") {
+		t.Fatalf("expected second act_fx to depend on %s, got %v", second.GetString("min_fx"), deps)
+	}
+}
+
+func TestCalculatedFields_SelfReference_DeletedSiblingBecomesRef(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	queue := createBookingQueue(t, app, "selfrefdelete01")
+
+	setOwnerFieldFormula(t, app, queue, "max_fx", "5")
+	actFx := setOwnerFieldFormula(t, app, queue, "act_fx", "self.max_fx + 1")
+
+	if err := app.Delete(mustFindCF(t, app, queue.GetString("max_fx"))); err != nil {
+		t.Fatalf("failed to delete max_fx: %v", err)
+	}
+
+	checkFormulaUpdate(t, app, actFx.Id, "#REF! + 1", `"#REF!"`, "Formula contains reference to missing node (#REF!)")
+}
+
+func TestCalculatedFields_SelfReference_Errors(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	queue := createBookingQueue(t, app, "selfreferrors01")
+
+	cases := []struct {
+		name     string
+		formula  string
+		wantCode string
+	}{
+		{"self.<field> inesistente", "self.not_a_field + 1", `"code":"1007"`},
+		{"self.<field> che punta a se stesso", "self.act_fx + 1", `"code":"1002"`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cf := mustFindCF(t, app, queue.GetString("act_fx"))
+			cf.Set("formula", c.formula)
+
+			err := app.Save(cf)
+			if err == nil {
+				t.Fatalf("expected error for formula %q", c.formula)
+			}
+			raw, _ := json.Marshal(err)
+			if !strings.Contains(string(raw), c.wantCode) {
+				t.Fatalf("expected %s, got %s (%v)", c.wantCode, raw, err)
+			}
+		})
+	}
+}
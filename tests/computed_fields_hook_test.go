@@ -135,7 +135,7 @@ func TestComputedFieldsCreateFxCalculations(t *testing.T) {
 			ExpectedStatus: 200,
 			ExpectedContent: []string{
 				`"value":"#VALUE!"`,
-				`"error":"Tipo non compatibile nell'operazione"`,
+				`"error":"Incompatible type in operation"`,
 			},
 		},
 		{
@@ -154,7 +154,7 @@ func TestComputedFieldsCreateFxCalculations(t *testing.T) {
 			ExpectedStatus: 200,
 			ExpectedContent: []string{
 				`"value":"#DIV/0!"`,
-				`"error":"Divisione per zero o risultato infinito"`,
+				`"error":"Division by zero or infinite result"`,
 			},
 		},
 		{
@@ -232,7 +232,7 @@ func TestComputedFieldsCreateFxCalculations(t *testing.T) {
 			TestAppFactory: setupTestApp,
 			ExpectedStatus: 200,
 			ExpectedContent: []string{
-				`"error":"Valore non disponibile (null) in operazione"`,
+				`"error":"Value not available (null) in operation"`,
 				`"value":"#N/A"`,
 			},
 		},
@@ -308,7 +308,7 @@ func TestComputedFieldsCreateFxCalculations(t *testing.T) {
 			TestAppFactory: setupTestApp,
 			ExpectedStatus: 200,
 			ExpectedContent: []string{
-				`"error":"Tipo non compatibile nell'operazione"`, // tipo errato: somma tra array e numero
+				`"error":"Incompatible type in operation"`, // tipo errato: somma tra array e numero
 				`"value":"#VALUE!"`,
 			},
 		},
@@ -1165,6 +1165,10 @@ func setupTestApp(t testing.TB) *tests.TestApp {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// allinea lo schema di calculated_fields come farebbe il plugin al bootstrap
+	if err := calculatedfields.EnsureCalculatedFieldsSystemSchema(testApp); err != nil {
+		t.Fatal(err)
+	}
 	// reset globale hook prima di bindare
 	calculatedfields.BindCalculatedFieldsHooks(testApp)
 	return testApp
@@ -1459,7 +1463,7 @@ func TestCF_ParentValueEmptyString_IsHandledAsNull_NotCrash(t *testing.T) {
 		ExpectedContent: []string{
 			`"id":"childdeponempty"`,
 			`"value":"#VALUE!"`,
-			`"error":"Tipo non compatibile nell'operazione"`,
+			`"error":"Incompatible type in operation"`,
 		},
 	}).Test(t)
 }